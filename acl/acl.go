@@ -0,0 +1,289 @@
+// Package acl 提供基于CIDR的访问控制，支持IPv4和IPv6，
+// 规则可以直接配置，也可以从文件加载并在文件变化时自动重新加载。
+package acl
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 规则文件每行一条规则，格式为 "allow <cidr|ip>" 或 "deny <cidr|ip>"，#开头为注释
+type Config struct {
+	Allow  []string      `yaml:"allow"`
+	Deny   []string      `yaml:"deny"`
+	File   string        `yaml:"file"`
+	Reload time.Duration `yaml:"reload"`
+}
+
+const (
+	ACTION_ALLOW = "allow"
+	ACTION_DENY  = "deny"
+
+	defaultReload = 5 * time.Second
+)
+
+// 日志输出，调用方可以替换为自己的日志组件
+var Logf = log.Printf
+
+type Rule struct {
+	Action string
+	Net    *net.IPNet
+	Source string // 规则来源，配置或者文件名:行号
+}
+
+func (r *Rule) String() string {
+	return fmt.Sprintf("%s %s (%s)", r.Action, r.Net.String(), r.Source)
+}
+
+type rules struct {
+	allow []*Rule
+	deny  []*Rule
+}
+
+// 访问控制列表，deny优先；配置了allow时未命中任何allow规则的地址同样拒绝
+type List struct {
+	cfg   Config
+	rules atomic.Value
+
+	modTime time.Time
+	size    int64
+	stop    chan struct{}
+
+	sync.Mutex
+	rejected uint64
+	hits     map[string]uint64
+}
+
+// 解析单个地址或网段，单个地址按全长掩码处理
+func ParseNet(value string) (*net.IPNet, error) {
+	value = strings.TrimSpace(value)
+	if strings.Contains(value, "/") {
+		_, ipnet, err := net.ParseCIDR(value)
+		return ipnet, err
+	}
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %s", value)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+func appendRules(list []*Rule, action string, values []string, source string) ([]*Rule, error) {
+	for _, v := range values {
+		ipnet, err := ParseNet(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", source, err.Error())
+		}
+		list = append(list, &Rule{Action: action, Net: ipnet, Source: source})
+	}
+	return list, nil
+}
+
+func loadFile(path string, r *rules) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := scanner.Text()
+		if idx := strings.Index(text, "#"); idx >= 0 {
+			text = text[:idx]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		source := fmt.Sprintf("%s:%d", path, line)
+		if len(fields) != 2 {
+			return fmt.Errorf("%s: invalid rule %q", source, scanner.Text())
+		}
+		switch strings.ToLower(fields[0]) {
+		case ACTION_ALLOW:
+			r.allow, err = appendRules(r.allow, ACTION_ALLOW, fields[1:], source)
+		case ACTION_DENY:
+			r.deny, err = appendRules(r.deny, ACTION_DENY, fields[1:], source)
+		default:
+			err = fmt.Errorf("%s: unknown action %s", source, fields[0])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func (l *List) load() error {
+	r := &rules{}
+	var err error
+	r.allow, err = appendRules(r.allow, ACTION_ALLOW, l.cfg.Allow, "config")
+	if err != nil {
+		return err
+	}
+	r.deny, err = appendRules(r.deny, ACTION_DENY, l.cfg.Deny, "config")
+	if err != nil {
+		return err
+	}
+	if l.cfg.File != "" {
+		err = loadFile(l.cfg.File, r)
+		if err != nil {
+			return err
+		}
+	}
+	l.rules.Store(r)
+	return nil
+}
+
+// 文件变化时重新加载，加载失败保留原有规则
+func (l *List) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+		info, err := os.Stat(l.cfg.File)
+		if err != nil {
+			continue
+		}
+		if info.ModTime().Equal(l.modTime) && info.Size() == l.size {
+			continue
+		}
+		l.modTime, l.size = info.ModTime(), info.Size()
+		err = l.load()
+		if err != nil {
+			Logf("acl reload %s failed, keep old rules, %s", l.cfg.File, err.Error())
+			continue
+		}
+		Logf("acl reload %s success", l.cfg.File)
+	}
+}
+
+// 未配置时返回nil，nil列表允许所有地址
+func New(cfg *Config) (*List, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	l := &List{cfg: *cfg, hits: make(map[string]uint64)}
+	if cfg.File != "" {
+		info, err := os.Stat(cfg.File)
+		if err != nil {
+			return nil, err
+		}
+		l.modTime, l.size = info.ModTime(), info.Size()
+	}
+	err := l.load()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.File != "" {
+		interval := cfg.Reload
+		if interval <= 0 {
+			interval = defaultReload
+		}
+		l.stop = make(chan struct{})
+		go l.watch(interval)
+	}
+	return l, nil
+}
+
+// 检查地址是否允许接入，拒绝时返回命中的规则描述
+func (l *List) Check(ip net.IP) (bool, string) {
+	if l == nil {
+		return true, ""
+	}
+	r := l.rules.Load().(*rules)
+	for _, v := range r.deny {
+		if v.Net.Contains(ip) {
+			return false, v.String()
+		}
+	}
+	if len(r.allow) == 0 {
+		return true, ""
+	}
+	for _, v := range r.allow {
+		if v.Net.Contains(ip) {
+			return true, ""
+		}
+	}
+	return false, "not in allow list"
+}
+
+// 检查地址并对拒绝计数，addr可以是连接的RemoteAddr
+func (l *List) Allow(addr net.Addr) (bool, string) {
+	if l == nil {
+		return true, ""
+	}
+	var ip net.IP
+	switch v := addr.(type) {
+	case *net.TCPAddr:
+		ip = v.IP
+	case *net.UDPAddr:
+		ip = v.IP
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			host = addr.String()
+		}
+		ip = net.ParseIP(host)
+	}
+	if ip == nil {
+		return false, "invalid address"
+	}
+	ok, rule := l.Check(ip)
+	if !ok {
+		l.Lock()
+		l.rejected++
+		l.hits[rule]++
+		l.Unlock()
+	}
+	return ok, rule
+}
+
+// 拒绝总数
+func (l *List) Rejected() uint64 {
+	if l == nil {
+		return 0
+	}
+	l.Lock()
+	defer l.Unlock()
+	return l.rejected
+}
+
+// 按规则统计的拒绝次数
+func (l *List) Hits() map[string]uint64 {
+	if l == nil {
+		return nil
+	}
+	l.Lock()
+	defer l.Unlock()
+	output := make(map[string]uint64, len(l.hits))
+	for k, v := range l.hits {
+		output[k] = v
+	}
+	return output
+}
+
+// 停止文件监控
+func (l *List) Close() {
+	if l == nil || l.stop == nil {
+		return
+	}
+	close(l.stop)
+}
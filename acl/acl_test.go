@@ -0,0 +1,136 @@
+package acl
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckOrder(t *testing.T) {
+	list, err := New(&Config{
+		Allow: []string{"10.0.0.0/8", "2001:db8::/32"},
+		Deny:  []string{"10.1.0.0/16", "10.0.0.1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		ip    string
+		allow bool
+		rule  string
+	}{
+		{"10.2.3.4", true, ""},
+		// deny优先于allow
+		{"10.1.2.3", false, "deny 10.1.0.0/16 (config)"},
+		{"10.0.0.1", false, "deny 10.0.0.1/32 (config)"},
+		// 配置了allow时未命中的地址拒绝
+		{"192.168.1.1", false, "not in allow list"},
+		{"2001:db8::1", true, ""},
+		{"2001:db9::1", false, "not in allow list"},
+	}
+	for _, c := range cases {
+		allow, rule := list.Check(net.ParseIP(c.ip))
+		if allow != c.allow || rule != c.rule {
+			t.Errorf("check %s got %v %q, want %v %q", c.ip, allow, rule, c.allow, c.rule)
+		}
+	}
+
+	// 只有deny时其它地址都允许
+	list, err = New(&Config{Deny: []string{"10.0.0.0/8"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allow, _ := list.Check(net.ParseIP("192.168.1.1")); !allow {
+		t.Error("deny only list must allow other addresses")
+	}
+
+	var none *List
+	if allow, _ := none.Check(net.ParseIP("10.0.0.1")); !allow {
+		t.Error("nil list must allow all")
+	}
+}
+
+// 双栈监听时IPv4客户端的地址为IPv4映射的IPv6地址，需要按IPv4规则匹配
+func TestMappedIPv4(t *testing.T) {
+	list, err := New(&Config{Allow: []string{"10.0.0.0/8"}, Deny: []string{"10.9.9.9"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapped := &net.TCPAddr{IP: net.ParseIP("::ffff:10.0.0.1"), Port: 1234}
+	if len(mapped.IP) != net.IPv6len {
+		t.Fatal("expect a 16 byte address")
+	}
+	if allow, rule := list.Allow(mapped); !allow {
+		t.Fatalf("mapped %s denied by %s", mapped, rule)
+	}
+	if allow, _ := list.Allow(&net.TCPAddr{IP: net.ParseIP("::ffff:10.9.9.9"), Port: 1234}); allow {
+		t.Fatal("mapped address must match ipv4 deny rule")
+	}
+	if allow, _ := list.Allow(&net.TCPAddr{IP: net.ParseIP("::ffff:192.168.1.1"), Port: 1234}); allow {
+		t.Fatal("mapped address outside allow list must be denied")
+	}
+	if list.Rejected() != 2 {
+		t.Fatalf("rejected %d, want 2", list.Rejected())
+	}
+	if hits := list.Hits(); hits["deny 10.9.9.9/32 (config)"] != 1 || hits["not in allow list"] != 1 {
+		t.Fatalf("hits %v", hits)
+	}
+}
+
+func writeRules(t *testing.T, path string, body string) {
+	if err := ioutil.WriteFile(path, []byte(body), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func waitCheck(t *testing.T, list *List, ip string, allow bool) {
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if ok, _ := list.Check(net.ParseIP(ip)); ok == allow {
+			return
+		}
+		if time.Since(start) > 2*time.Second {
+			t.Fatalf("check %s not %v after reload", ip, allow)
+		}
+	}
+}
+
+func TestFileReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rules.txt")
+	writeRules(t, path, "# office\nallow 10.0.0.0/8\ndeny 10.0.0.1 # gateway\n")
+
+	list, err := New(&Config{File: path, Reload: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer list.Close()
+	if _, rule := list.Check(net.ParseIP("10.0.0.1")); rule != "deny 10.0.0.1/32 ("+path+":3)" {
+		t.Fatalf("rule source %q", rule)
+	}
+	waitCheck(t, list, "172.16.0.1", false)
+
+	writeRules(t, path, "allow 10.0.0.0/8\nallow 172.16.0.0/12\n")
+	waitCheck(t, list, "172.16.0.1", true)
+	waitCheck(t, list, "10.0.0.1", true)
+
+	// 规则文件有错误时保留原有规则
+	writeRules(t, path, "allow 10.0.0.0/8\nblock 172.16.0.0/12\n")
+	time.Sleep(100 * time.Millisecond)
+	waitCheck(t, list, "172.16.0.1", true)
+
+	if _, err := New(&Config{File: filepath.Join(dir, "missing.txt")}); err == nil {
+		t.Fatal("missing rule file must fail")
+	}
+	writeRules(t, path, "allow 10.0.0.0/33\n")
+	if _, err := New(&Config{File: path}); err == nil || !strings.Contains(err.Error(), path+":1") {
+		t.Fatalf("invalid rule got %v", err)
+	}
+}
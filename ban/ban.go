@@ -0,0 +1,288 @@
+// Package ban 提供类似fail2ban的临时封禁，按客户端IP统计窗口内的连接数、
+// TLS握手失败次数和连接后立即断开的次数，任意一项超过阈值后在accept时拒绝该IP一段时间。
+package ban
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 阈值为0表示不统计该项
+type Config struct {
+	MaxConns          int           `yaml:"maxconns"`
+	MaxHandshakeFails int           `yaml:"maxhandshakefails"`
+	MaxQuickCloses    int           `yaml:"maxquickcloses"`
+	QuickClose        time.Duration `yaml:"quickclose"`
+	Window            time.Duration `yaml:"window"`
+	BanTime           time.Duration `yaml:"bantime"`
+}
+
+const (
+	REASON_CONNS           = "too_many_connections"
+	REASON_HANDSHAKE_FAILS = "too_many_handshake_failures"
+	REASON_QUICK_CLOSES    = "too_many_quick_closes"
+
+	defaultQuickClose = time.Second
+	defaultWindow     = time.Minute
+	defaultBanTime    = 10 * time.Minute
+)
+
+type Ban struct {
+	IP       string    `json:"ip"`
+	Listener string    `json:"listener"`
+	Reason   string    `json:"reason"`
+	Since    time.Time `json:"since"`
+	Until    time.Time `json:"until"`
+}
+
+// 封禁表，所有监听共享，path不为空时每次变化都写入文件，重启后恢复
+type Table struct {
+	sync.Mutex
+
+	path string
+	bans map[string]*Ban
+}
+
+func NewTable(path string) (*Table, error) {
+	t := &Table{path: path, bans: make(map[string]*Ban, 1024)}
+	if path == "" {
+		return t, nil
+	}
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return t, nil
+		}
+		return nil, err
+	}
+	var list []Ban
+	err = json.Unmarshal(body, &list)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for i := range list {
+		if list[i].Until.After(now) {
+			t.bans[list[i].IP] = &list[i]
+		}
+	}
+	return t, nil
+}
+
+// 需要持有锁调用，写入失败返回错误但不影响内存中的封禁
+func (t *Table) save() error {
+	if t.path == "" {
+		return nil
+	}
+	body, err := json.MarshalIndent(t.list(), "", "  ")
+	if err != nil {
+		return err
+	}
+	temp := t.path + ".tmp"
+	err = ioutil.WriteFile(temp, body, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(temp, t.path)
+}
+
+func (t *Table) list() []Ban {
+	now := time.Now()
+	output := make([]Ban, 0, len(t.bans))
+	for ip, v := range t.bans {
+		if !v.Until.After(now) {
+			delete(t.bans, ip)
+			continue
+		}
+		output = append(output, *v)
+	}
+	sort.Slice(output, func(i, j int) bool {
+		return output[i].Since.Before(output[j].Since)
+	})
+	return output
+}
+
+// 判断IP是否处于封禁期
+func (t *Table) Banned(ip string) (bool, *Ban) {
+	if t == nil {
+		return false, nil
+	}
+	t.Lock()
+	defer t.Unlock()
+
+	v, ok := t.bans[ip]
+	if !ok {
+		return false, nil
+	}
+	if !v.Until.After(time.Now()) {
+		delete(t.bans, ip)
+		return false, nil
+	}
+	ban := *v
+	return true, &ban
+}
+
+func (t *Table) Add(ban Ban) error {
+	t.Lock()
+	defer t.Unlock()
+	t.bans[ban.IP] = &ban
+	return t.save()
+}
+
+// 当前有效的封禁列表
+func (t *Table) List() []Ban {
+	if t == nil {
+		return nil
+	}
+	t.Lock()
+	defer t.Unlock()
+	return t.list()
+}
+
+// 解除封禁，ip为空时清除全部，返回解除的数量
+func (t *Table) Clear(ip string) (int, error) {
+	if t == nil {
+		return 0, nil
+	}
+	t.Lock()
+	defer t.Unlock()
+
+	cnt := len(t.bans)
+	if ip == "" {
+		t.bans = make(map[string]*Ban, 1024)
+	} else if _, ok := t.bans[ip]; ok {
+		delete(t.bans, ip)
+		cnt = 1
+	} else {
+		return 0, nil
+	}
+	return cnt, t.save()
+}
+
+type counter struct {
+	start  time.Time
+	conns  int
+	fails  int
+	closes int
+}
+
+// 单个监听的封禁检测，按配置的窗口统计各客户端的异常行为
+type Detector struct {
+	sync.Mutex
+
+	cfg      Config
+	listener string
+	table    *Table
+	counters map[string]*counter
+	sweep    time.Time
+
+	// 发生封禁时回调，用于记录日志
+	OnBan func(ban Ban, err error)
+}
+
+// 未配置时返回nil，nil检测器不做任何统计
+func NewDetector(cfg *Config, listener string, table *Table) *Detector {
+	if cfg == nil || table == nil {
+		return nil
+	}
+	d := &Detector{cfg: *cfg, listener: listener, table: table, counters: make(map[string]*counter, 1024)}
+	if d.cfg.QuickClose <= 0 {
+		d.cfg.QuickClose = defaultQuickClose
+	}
+	if d.cfg.Window <= 0 {
+		d.cfg.Window = defaultWindow
+	}
+	if d.cfg.BanTime <= 0 {
+		d.cfg.BanTime = defaultBanTime
+	}
+	return d
+}
+
+// accept时调用，返回是否处于封禁期
+func (d *Detector) Banned(ip string) (bool, *Ban) {
+	if d == nil {
+		return false, nil
+	}
+	return d.table.Banned(ip)
+}
+
+// 更新统计，触发封禁时返回true
+func (d *Detector) record(ip string, update func(c *counter) string) bool {
+	if d == nil {
+		return false
+	}
+	now := time.Now()
+
+	d.Lock()
+	// 定期清理过期的统计，避免表无限增长
+	if now.Sub(d.sweep) > d.cfg.Window {
+		for k, v := range d.counters {
+			if now.Sub(v.start) > d.cfg.Window {
+				delete(d.counters, k)
+			}
+		}
+		d.sweep = now
+	}
+	c, ok := d.counters[ip]
+	if !ok || now.Sub(c.start) > d.cfg.Window {
+		c = &counter{start: now}
+		d.counters[ip] = c
+	}
+	reason := update(c)
+	if reason != "" {
+		delete(d.counters, ip)
+	}
+	d.Unlock()
+
+	if reason == "" {
+		return false
+	}
+	ban := Ban{IP: ip, Listener: d.listener, Reason: reason, Since: now, Until: now.Add(d.cfg.BanTime)}
+	err := d.table.Add(ban)
+	if d.OnBan != nil {
+		d.OnBan(ban, err)
+	}
+	return true
+}
+
+// 新连接，超过阈值时返回false，当前连接同样需要拒绝
+func (d *Detector) Connect(ip string) bool {
+	return !d.record(ip, func(c *counter) string {
+		c.conns++
+		if d.cfg.MaxConns > 0 && c.conns > d.cfg.MaxConns {
+			return REASON_CONNS
+		}
+		return ""
+	})
+}
+
+// TLS握手失败
+func (d *Detector) HandshakeFail(ip string) {
+	d.record(ip, func(c *counter) string {
+		c.fails++
+		if d.cfg.MaxHandshakeFails > 0 && c.fails > d.cfg.MaxHandshakeFails {
+			return REASON_HANDSHAKE_FAILS
+		}
+		return ""
+	})
+}
+
+// 连接关闭，up为客户端已转发到后端的字节数，client表示由客户端先断开。
+// 只有客户端在QuickClose内、尚未发送任何数据就断开时才视为立即断开，
+// 后端拒绝服务、超时或者正常的短请求不计入
+func (d *Detector) Closed(ip string, duration time.Duration, up int64, client bool) {
+	if d == nil || d.cfg.MaxQuickCloses <= 0 || !client || up > 0 || duration >= d.cfg.QuickClose {
+		return
+	}
+	d.record(ip, func(c *counter) string {
+		c.closes++
+		if c.closes > d.cfg.MaxQuickCloses {
+			return REASON_QUICK_CLOSES
+		}
+		return ""
+	})
+}
@@ -0,0 +1,171 @@
+package ban
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newDetector(t *testing.T, cfg Config) (*Detector, *Table) {
+	table, err := NewTable("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewDetector(&cfg, ":8080", table), table
+}
+
+func banned(d *Detector, ip string) string {
+	ok, ban := d.Banned(ip)
+	if !ok {
+		return ""
+	}
+	return ban.Reason
+}
+
+// 三项统计都在超过阈值时封禁，等于阈值时不封禁
+func TestThresholds(t *testing.T) {
+	d, _ := newDetector(t, Config{MaxConns: 3, MaxHandshakeFails: 3, MaxQuickCloses: 3})
+
+	for i := 0; i < 3; i++ {
+		if !d.Connect("10.0.0.1") {
+			t.Fatalf("connect %d rejected", i+1)
+		}
+	}
+	if banned(d, "10.0.0.1") != "" {
+		t.Fatal("banned at max connections")
+	}
+	if d.Connect("10.0.0.1") || banned(d, "10.0.0.1") != REASON_CONNS {
+		t.Fatal("not banned over max connections")
+	}
+
+	for i := 0; i < 3; i++ {
+		d.HandshakeFail("10.0.0.2")
+	}
+	if banned(d, "10.0.0.2") != "" {
+		t.Fatal("banned at max handshake failures")
+	}
+	d.HandshakeFail("10.0.0.2")
+	if banned(d, "10.0.0.2") != REASON_HANDSHAKE_FAILS {
+		t.Fatal("not banned over max handshake failures")
+	}
+
+	for i := 0; i < 3; i++ {
+		d.Closed("10.0.0.3", time.Millisecond, 0, true)
+	}
+	if banned(d, "10.0.0.3") != "" {
+		t.Fatal("banned at max quick closes")
+	}
+	d.Closed("10.0.0.3", time.Millisecond, 0, true)
+	if banned(d, "10.0.0.3") != REASON_QUICK_CLOSES {
+		t.Fatal("not banned over max quick closes")
+	}
+}
+
+// 只统计客户端在发送数据之前的立即断开
+func TestQuickCloseFilter(t *testing.T) {
+	d, _ := newDetector(t, Config{MaxQuickCloses: 1, QuickClose: time.Second})
+
+	for i := 0; i < 10; i++ {
+		// 后端先断开，例如后端拒绝服务
+		d.Closed("10.0.0.1", time.Millisecond, 0, false)
+		// 已经发送了请求的短连接
+		d.Closed("10.0.0.1", time.Millisecond, 100, true)
+		// 存活超过QuickClose
+		d.Closed("10.0.0.1", 2*time.Second, 0, true)
+	}
+	if reason := banned(d, "10.0.0.1"); reason != "" {
+		t.Fatalf("banned by %s", reason)
+	}
+
+	d.Closed("10.0.0.1", time.Millisecond, 0, true)
+	d.Closed("10.0.0.1", time.Millisecond, 0, true)
+	if banned(d, "10.0.0.1") != REASON_QUICK_CLOSES {
+		t.Fatal("client quick closes not counted")
+	}
+}
+
+func TestWindowAndBanTime(t *testing.T) {
+	d, table := newDetector(t, Config{MaxConns: 1, Window: 50 * time.Millisecond, BanTime: 50 * time.Millisecond})
+
+	// 超过窗口后重新计数
+	d.Connect("10.0.0.1")
+	time.Sleep(60 * time.Millisecond)
+	if !d.Connect("10.0.0.1") {
+		t.Fatal("counter not reset after window")
+	}
+
+	if d.Connect("10.0.0.1") {
+		t.Fatal("not banned")
+	}
+	if len(table.List()) != 1 {
+		t.Fatalf("bans %v", table.List())
+	}
+	time.Sleep(60 * time.Millisecond)
+	if banned(d, "10.0.0.1") != "" || len(table.List()) != 0 {
+		t.Fatal("ban not expired")
+	}
+
+	var none *Detector
+	if !none.Connect("10.0.0.1") {
+		t.Fatal("nil detector must not ban")
+	}
+	none.HandshakeFail("10.0.0.1")
+	none.Closed("10.0.0.1", 0, 0, true)
+	if NewDetector(nil, ":8080", table) != nil {
+		t.Fatal("detector without config must be nil")
+	}
+}
+
+func TestTablePersist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ban")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "bans.json")
+
+	table, err := NewTable(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	table.Add(Ban{IP: "10.0.0.1", Reason: REASON_CONNS, Since: now, Until: now.Add(time.Hour)})
+	table.Add(Ban{IP: "10.0.0.2", Reason: REASON_CONNS, Since: now.Add(time.Second), Until: now.Add(time.Hour)})
+	table.Add(Ban{IP: "10.0.0.3", Reason: REASON_CONNS, Since: now, Until: now.Add(-time.Second)})
+
+	// 重启后恢复未过期的封禁
+	table, err = NewTable(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := table.List()
+	if len(list) != 2 || list[0].IP != "10.0.0.1" || list[1].IP != "10.0.0.2" {
+		t.Fatalf("restored bans %v", list)
+	}
+
+	if cnt, err := table.Clear("10.0.0.1"); cnt != 1 || err != nil {
+		t.Fatalf("clear got %d, %v", cnt, err)
+	}
+	if cnt, _ := table.Clear("10.0.0.9"); cnt != 0 {
+		t.Fatalf("clear unknown got %d", cnt)
+	}
+	if cnt, _ := table.Clear(""); cnt != 1 {
+		t.Fatalf("clear all got %d", cnt)
+	}
+	table, err = NewTable(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(table.List()) != 0 {
+		t.Fatalf("bans left after clear %v", table.List())
+	}
+
+	if err := ioutil.WriteFile(path, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewTable(path); err == nil {
+		t.Fatal("invalid ban file must fail")
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"github.com/astaxie/beego/logs"
+	"github.com/lixiangyun/tcpproxy/acl"
+	"github.com/lxn/walk"
+	. "github.com/lxn/walk/declarative"
+	"strings"
+	"time"
+)
+
+func AclView(cfg *acl.Config) string {
+	if cfg == nil {
+		return "none"
+	}
+	output := fmt.Sprintf("allow %d, deny %d", len(cfg.Allow), len(cfg.Deny))
+	if cfg.File != "" {
+		output += fmt.Sprintf(", file %s", cfg.File)
+	}
+	return output
+}
+
+// 每行一个地址或网段，忽略空行
+func aclLines(text string) []string {
+	var output []string
+	for _, v := range strings.Split(text, "\n") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			output = append(output, v)
+		}
+	}
+	return output
+}
+
+// 访问控制配置对话框，确认后返回新的配置，取消返回原配置
+func AclToolBar(owner walk.Form, cfg *acl.Config) *acl.Config {
+	var dlg *walk.Dialog
+	var acceptPB, cancelPB *walk.PushButton
+	var allowTE, denyTE *walk.TextEdit
+	var fileLE *walk.LineEdit
+	var reloadNE *walk.NumberEdit
+
+	input := acl.Config{}
+	if cfg != nil {
+		input = *cfg
+	}
+
+	output := cfg
+
+	cnt, err := Dialog{
+		AssignTo: &dlg,
+		Title: "Access Control",
+		Icon: ICON_TOOL_SETTING,
+		DefaultButton: &acceptPB,
+		CancelButton: &cancelPB,
+		Size: Size{Width: 350, Height: 400},
+		MinSize: Size{Width: 350, Height: 400},
+		Layout:  VBox{ Margins: Margins{Top: 10, Bottom: 10, Left: 10, Right: 10}},
+		Children: []Widget{
+			Label{
+				Text: "Allow List (one CIDR or IP per line):",
+			},
+			TextEdit{
+				AssignTo: &allowTE,
+				Text: strings.Join(input.Allow, "\r\n"),
+				VScroll: true,
+			},
+			Label{
+				Text: "Deny List (one CIDR or IP per line):",
+			},
+			TextEdit{
+				AssignTo: &denyTE,
+				Text: strings.Join(input.Deny, "\r\n"),
+				VScroll: true,
+			},
+			Composite{
+				Layout: Grid{Columns: 2},
+				Children: []Widget{
+					Label{
+						Text: "Rule File:",
+					},
+					LineEdit{
+						AssignTo: &fileLE,
+						Text: input.File,
+						ToolTipText: "lines of \"allow <cidr>\" or \"deny <cidr>\"",
+					},
+					Label{
+						Text: "Reload Interval:",
+					},
+					NumberEdit{
+						AssignTo: &reloadNE,
+						Value: float64(input.Reload / time.Second),
+						ToolTipText: "check rule file change, 0 is 5 second",
+						MinValue: 0,
+						MaxValue: 3600,
+						Suffix: " Second",
+					},
+				},
+			},
+			Composite{
+				Layout: HBox{},
+				Children: []Widget{
+					PushButton{
+						AssignTo: &acceptPB,
+						Text: "OK",
+						OnClicked: func() {
+							result := &acl.Config{
+								Allow: aclLines(allowTE.Text()),
+								Deny: aclLines(denyTE.Text()),
+								File: strings.TrimSpace(fileLE.Text()),
+								Reload: time.Duration(reloadNE.Value()) * time.Second,
+							}
+							for _, v := range append(result.Allow, result.Deny...) {
+								if _, err := acl.ParseNet(v); err != nil {
+									ErrorBoxAction(dlg, err.Error())
+									return
+								}
+							}
+							if len(result.Allow) == 0 && len(result.Deny) == 0 && result.File == "" {
+								result = nil
+							}
+							output = result
+							dlg.Accept()
+						},
+					},
+					PushButton{
+						AssignTo: &cancelPB,
+						Text: "Cancel",
+						OnClicked: func() {
+							dlg.Cancel()
+						},
+					},
+				},
+			},
+		},
+	}.Run(owner)
+	if err != nil {
+		logs.Error(err.Error())
+	} else {
+		logs.Info("acl dialog return %d", cnt)
+	}
+	return output
+}
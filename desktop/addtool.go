@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"github.com/astaxie/beego/logs"
+	"github.com/lixiangyun/tcpproxy/limit"
+	"github.com/lixiangyun/tcpproxy/schema"
 	"github.com/lxn/walk"
 	. "github.com/lxn/walk/declarative"
 	"net"
@@ -10,19 +12,54 @@ import (
 	"sync"
 )
 
-type BackendConfig struct {
-	Address  string
-	Timeout  int
-	Weight   int
-	Standby  bool
+// 链路格式和引擎的import、export子命令共用
+type BackendConfig = schema.Backend
+
+type LinkConfig = schema.Link
+
+// 带宽输入框，单位KB/s，0表示不限制
+func BandwidthEdit(title string, up **walk.NumberEdit, down **walk.NumberEdit) []Widget {
+	return []Widget{
+		Label{
+			Text: title,
+		},
+		Composite{
+			Layout: HBox{MarginsZero: true},
+			Children: []Widget{
+				NumberEdit{
+					AssignTo: up,
+					ToolTipText: "upload, 0 is unlimited",
+					MinValue: 0,
+					MaxValue: 1024 * 1024,
+					Prefix: "↑",
+					Suffix: " KB/s",
+				},
+				NumberEdit{
+					AssignTo: down,
+					ToolTipText: "download, 0 is unlimited",
+					MinValue: 0,
+					MaxValue: 1024 * 1024,
+					Prefix: "↓",
+					Suffix: " KB/s",
+				},
+			},
+		},
+	}
 }
 
-type LinkConfig struct {
-	Iface      string
-	Port       int
-	Timeout    int
-	Mode       string
-	Backend  []BackendConfig
+func BandwidthOutput(link, client, session [2]*walk.NumberEdit) *limit.BandwidthConfig {
+	kb := func(edit *walk.NumberEdit) int64 {
+		return int64(edit.Value()) * 1024
+	}
+	cfg := &limit.BandwidthConfig{
+		Up: kb(link[0]), Down: kb(link[1]),
+		ClientUp: kb(client[0]), ClientDown: kb(client[1]),
+		SessionUp: kb(session[0]), SessionDown: kb(session[1]),
+	}
+	if *cfg == (limit.BandwidthConfig{}) {
+		return nil
+	}
+	return cfg
 }
 
 func IfaceOptions() []string {
@@ -30,7 +67,8 @@ func IfaceOptions() []string {
 	if err != nil {
 		logs.Error(err.Error())
 	}
-	output := []string{"0.0.0.0"}
+	// "::" 同时监听IPv4和IPv6
+	output := []string{"0.0.0.0", "::"}
 	for _, v := range ifaces {
 		if v.Flags & net.FlagUp == 0 {
 			continue
@@ -39,17 +77,16 @@ func IfaceOptions() []string {
 		if err != nil {
 			continue
 		}
-		if len(address) == 0 {
-			continue
+		for _, ip := range address {
+			output = append(output, ip.String())
 		}
-		output = append(output, address[0].String())
 	}
 	return output
 }
 
 func LoadBalanceModeOptions() []string {
 	return []string{
-		"Random","RoundRobin","WeightRoundRobin","AddressHash","MainStandby",
+		"Random","RoundRobin","WeightRoundRobin","AddressHash","MainStandby","LeastConn",
 	}
 }
 
@@ -214,6 +251,10 @@ func AddToolBar()  {
 	var consoleMode    *walk.ComboBox
 	var consolePort    *walk.NumberEdit
 	var consoleTimeout *walk.NumberEdit
+	var consoleMaxLife *walk.NumberEdit
+	var consoleResolve *walk.NumberEdit
+
+	var linkBandwidth, clientBandwidth, sessionBandwidth [2]*walk.NumberEdit
 
 	var BackendAddr    *walk.LineEdit
 	var BackendWeight  *walk.NumberEdit
@@ -237,8 +278,8 @@ func AddToolBar()  {
 		Icon: ICON_TOOL_ADD,
 		DefaultButton: &acceptPB,
 		CancelButton: &cancelPB,
-		Size: Size{350, 500},
-		MinSize: Size{350, 500},
+		Size: Size{350, 610},
+		MinSize: Size{350, 610},
 		Layout:  VBox{ Margins: Margins{Top: 10, Bottom: 10, Left: 10, Right: 10}},
 		Children: []Widget{
 			Composite{
@@ -269,12 +310,12 @@ func AddToolBar()  {
 						},
 					},
 					Label{
-						Text: "Bind Timeout:",
+						Text: "Idle Timeout:",
 					},
 					NumberEdit{
 						AssignTo: &consoleTimeout,
 						Value:    float64(addLink.Timeout),
-						ToolTipText: "0~3600",
+						ToolTipText: "0~3600, 0 is unlimited",
 						MaxValue: 3600,
 						MinValue: 0,
 						Suffix: " Second",
@@ -282,6 +323,28 @@ func AddToolBar()  {
 							addLink.Timeout = int(consoleTimeout.Value())
 						},
 					},
+					Label{
+						Text: "Max Session Time:",
+					},
+					NumberEdit{
+						AssignTo: &consoleMaxLife,
+						Value:    float64(addLink.MaxLife),
+						ToolTipText: "0~86400, 0 is unlimited",
+						MaxValue: 86400,
+						MinValue: 0,
+						Suffix: " Second",
+						OnValueChanged: func() {
+							addLink.MaxLife = int(consoleMaxLife.Value())
+						},
+					},
+					Composite{
+						Layout: Grid{Columns: 2, MarginsZero: true},
+						ColumnSpan: 2,
+						Children: append(append(
+							BandwidthEdit("Link Bandwidth:", &linkBandwidth[0], &linkBandwidth[1]),
+							BandwidthEdit("Client Bandwidth:", &clientBandwidth[0], &clientBandwidth[1])...),
+							BandwidthEdit("Session Bandwidth:", &sessionBandwidth[0], &sessionBandwidth[1])...),
+					},
 					Label{
 						Text: "Load Balance Mode:",
 					},
@@ -293,13 +356,27 @@ func AddToolBar()  {
 							addLink.Mode = consoleMode.Text()
 						},
 					},
+					Label{
+						Text: "DNS Refresh:",
+					},
+					NumberEdit{
+						AssignTo: &consoleResolve,
+						Value:    float64(addLink.Resolve),
+						ToolTipText: "re-resolve hostname and srv backends, 0 is 30 second",
+						MaxValue: 86400,
+						MinValue: 0,
+						Suffix: " Second",
+						OnValueChanged: func() {
+							addLink.Resolve = int(consoleResolve.Value())
+						},
+					},
 
 					Label{
 						Text: "Backend Address:",
 					},
 					LineEdit{
 						AssignTo: &BackendAddr,
-						CueBanner: "192.168.1.100:8080",
+						CueBanner: "192.168.1.100:8080, db.internal:5432 or srv:_svc._tcp.example.com",
 						Text: "",
 						OnEditingFinished: func() {
 							addr := BackendAddr.Text()
@@ -417,6 +494,24 @@ func AddToolBar()  {
 			Composite{
 				Layout: HBox{},
 				Children: []Widget{
+					PushButton{
+						Text: "Access Control...",
+						OnClicked: func() {
+							addLink.Acl = AclToolBar(dlg, addLink.Acl)
+						},
+					},
+					PushButton{
+						Text: "Ban Policy...",
+						OnClicked: func() {
+							addLink.Ban = BanPolicyToolBar(dlg, addLink.Ban)
+						},
+					},
+					PushButton{
+						Text: "Impairment...",
+						OnClicked: func() {
+							addLink.Impair = ImpairToolBar(dlg, addLink.Impair)
+						},
+					},
 					PushButton{
 						AssignTo: &acceptPB,
 						Text: "Add",
@@ -444,6 +539,7 @@ func AddToolBar()  {
 								}
 
 								addLink.Backend = output
+								addLink.Bandwidth = BandwidthOutput(linkBandwidth, clientBandwidth, sessionBandwidth)
 								err := LinkAdd(&addLink)
 								if err != nil {
 									ErrorBoxAction(dlg, err.Error())
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"fmt"
+	"github.com/astaxie/beego/logs"
+	"github.com/lixiangyun/tcpproxy/ban"
+	"github.com/lxn/walk"
+	. "github.com/lxn/walk/declarative"
+	"sort"
+	"sync"
+	"time"
+)
+
+func BanPolicyView(cfg *ban.Config) string {
+	if cfg == nil {
+		return "none"
+	}
+	limit := func(value int) string {
+		if value == 0 {
+			return "-"
+		}
+		return fmt.Sprintf("%d", value)
+	}
+	return fmt.Sprintf("conns %s, quick closes %s per %s, ban %s",
+		limit(cfg.MaxConns), limit(cfg.MaxQuickCloses), cfg.Window, cfg.BanTime)
+}
+
+// 封禁策略配置对话框，确认后返回新的配置，取消返回原配置
+func BanPolicyToolBar(owner walk.Form, cfg *ban.Config) *ban.Config {
+	var dlg *walk.Dialog
+	var acceptPB, cancelPB *walk.PushButton
+	var maxConns, maxCloses, quickClose, window, banTime *walk.NumberEdit
+
+	input := ban.Config{QuickClose: time.Second, Window: time.Minute, BanTime: 10 * time.Minute}
+	if cfg != nil {
+		input = *cfg
+	}
+
+	output := cfg
+
+	cnt, err := Dialog{
+		AssignTo: &dlg,
+		Title: "Ban Policy",
+		Icon: ICON_TOOL_SETTING,
+		DefaultButton: &acceptPB,
+		CancelButton: &cancelPB,
+		Size: Size{Width: 300, Height: 250},
+		MinSize: Size{Width: 300, Height: 250},
+		Layout:  VBox{ Margins: Margins{Top: 10, Bottom: 10, Left: 10, Right: 10}},
+		Children: []Widget{
+			Composite{
+				Layout: Grid{Columns: 2},
+				Children: []Widget{
+					Label{
+						Text: "Max Connections:",
+					},
+					NumberEdit{
+						AssignTo: &maxConns,
+						Value: float64(input.MaxConns),
+						ToolTipText: "connections per window, 0 is disable",
+						MinValue: 0,
+						MaxValue: 1000000,
+					},
+					Label{
+						Text: "Max Quick Closes:",
+					},
+					NumberEdit{
+						AssignTo: &maxCloses,
+						Value: float64(input.MaxQuickCloses),
+						ToolTipText: "immediate disconnects per window, 0 is disable",
+						MinValue: 0,
+						MaxValue: 1000000,
+					},
+					Label{
+						Text: "Quick Close:",
+					},
+					NumberEdit{
+						AssignTo: &quickClose,
+						Value: float64(input.QuickClose / time.Millisecond),
+						ToolTipText: "session shorter than this is an immediate disconnect",
+						MinValue: 0,
+						MaxValue: 60000,
+						Suffix: " ms",
+					},
+					Label{
+						Text: "Window:",
+					},
+					NumberEdit{
+						AssignTo: &window,
+						Value: float64(input.Window / time.Second),
+						MinValue: 1,
+						MaxValue: 86400,
+						Suffix: " Second",
+					},
+					Label{
+						Text: "Ban Time:",
+					},
+					NumberEdit{
+						AssignTo: &banTime,
+						Value: float64(input.BanTime / time.Second),
+						MinValue: 1,
+						MaxValue: 86400 * 30,
+						Suffix: " Second",
+					},
+				},
+			},
+			Composite{
+				Layout: HBox{},
+				Children: []Widget{
+					PushButton{
+						AssignTo: &acceptPB,
+						Text: "OK",
+						OnClicked: func() {
+							result := &ban.Config{
+								MaxConns: int(maxConns.Value()),
+								MaxQuickCloses: int(maxCloses.Value()),
+								QuickClose: time.Duration(quickClose.Value()) * time.Millisecond,
+								Window: time.Duration(window.Value()) * time.Second,
+								BanTime: time.Duration(banTime.Value()) * time.Second,
+							}
+							if result.MaxConns == 0 && result.MaxQuickCloses == 0 {
+								result = nil
+							}
+							output = result
+							dlg.Accept()
+						},
+					},
+					PushButton{
+						AssignTo: &cancelPB,
+						Text: "Cancel",
+						OnClicked: func() {
+							dlg.Cancel()
+						},
+					},
+				},
+			},
+		},
+	}.Run(owner)
+	if err != nil {
+		logs.Error(err.Error())
+	} else {
+		logs.Info("ban policy dialog return %d", cnt)
+	}
+	return output
+}
+
+type BanModel struct {
+	sync.RWMutex
+
+	walk.TableModelBase
+	walk.SorterBase
+	sortColumn int
+	sortOrder  walk.SortOrder
+
+	items      []ban.Ban
+	checked    map[string]bool
+}
+
+func (n *BanModel)Update(items []ban.Ban)  {
+	n.Lock()
+	defer n.Unlock()
+
+	n.items = items
+	n.PublishRowsReset()
+	n.Sort(n.sortColumn, n.sortOrder)
+}
+
+func (n *BanModel)SelectList() []string {
+	n.RLock()
+	defer n.RUnlock()
+
+	var output []string
+	for _, v := range n.items {
+		if n.checked[v.IP] {
+			output = append(output, v.IP)
+		}
+	}
+	return output
+}
+
+func (n *BanModel)RowCount() int {
+	return len(n.items)
+}
+
+func (n *BanModel)Value(row, col int) interface{} {
+	item := n.items[row]
+	switch col {
+	case 0:
+		return item.IP
+	case 1:
+		return item.Listener
+	case 2:
+		return item.Reason
+	case 3:
+		return item.Since.Format("2006-01-02 15:04:05")
+	case 4:
+		return item.Until.Format("2006-01-02 15:04:05")
+	}
+	panic("unexpected col")
+}
+
+func (n *BanModel) Checked(row int) bool {
+	return n.checked[n.items[row].IP]
+}
+
+func (n *BanModel) SetChecked(row int, checked bool) error {
+	n.checked[n.items[row].IP] = checked
+	return nil
+}
+
+func (m *BanModel) Sort(col int, order walk.SortOrder) error {
+	m.sortColumn, m.sortOrder = col, order
+	sort.SliceStable(m.items, func(i, j int) bool {
+		a, b := m.items[i], m.items[j]
+		c := func(ls bool) bool {
+			if m.sortOrder == walk.SortAscending {
+				return ls
+			}
+			return !ls
+		}
+		switch m.sortColumn {
+		case 0:
+			return c(a.IP < b.IP)
+		case 1:
+			return c(a.Listener < b.Listener)
+		case 2:
+			return c(a.Reason < b.Reason)
+		case 3:
+			return c(a.Since.Before(b.Since))
+		case 4:
+			return c(a.Until.Before(b.Until))
+		}
+		panic("unreachable")
+	})
+	return m.SorterBase.Sort(col, order)
+}
+
+// 封禁列表对话框，封禁表由全部链路共享
+func BanToolBar()  {
+	var dlg *walk.Dialog
+	var closePB *walk.PushButton
+
+	banModel := new(BanModel)
+	banModel.checked = make(map[string]bool)
+	banModel.Update(LinkBans())
+
+	cnt, err := Dialog{
+		AssignTo: &dlg,
+		Title: "Banned Clients",
+		Icon: walk.IconInformation(),
+		CancelButton: &closePB,
+		Size: Size{Width: 600, Height: 350},
+		MinSize: Size{Width: 400, Height: 250},
+		Layout:  VBox{
+			Margins: Margins{Top: 10, Bottom: 10, Left: 10, Right: 10},
+		},
+		Children: []Widget{
+			TableView{
+				AlternatingRowBG: true,
+				ColumnsOrderable: true,
+				CheckBoxes: true,
+				Columns: []TableViewColumn{
+					{Title: "Client", Width: 120},
+					{Title: "Link", Width: 120},
+					{Title: "Reason", Width: 150},
+					{Title: "Since", Width: 120},
+					{Title: "Until", Width: 120},
+				},
+				Model: banModel,
+			},
+			Composite{
+				Layout: HBox{MarginsZero: true},
+				Children: []Widget{
+					PushButton{
+						Text: "Clear",
+						OnClicked: func() {
+							list := banModel.SelectList()
+							if len(list) == 0 {
+								ErrorBoxAction(dlg, "No object selected")
+								return
+							}
+							LinkBanClear(list)
+							banModel.Update(LinkBans())
+						},
+					},
+					PushButton{
+						Text: "Clear All",
+						OnClicked: func() {
+							LinkBanClear([]string{""})
+							banModel.Update(LinkBans())
+						},
+					},
+					HSpacer{},
+					PushButton{
+						AssignTo: &closePB,
+						Text: "Close",
+						OnClicked: func() {
+							dlg.Cancel()
+						},
+					},
+				},
+			},
+		},
+	}.Run(MainWindowsCtrl())
+	if err != nil {
+		logs.Error(err.Error())
+	} else {
+		logs.Info("ban dialog return %d", cnt)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"github.com/astaxie/beego/logs"
+	"github.com/lixiangyun/tcpproxy/impair"
+	"github.com/lxn/walk"
+	. "github.com/lxn/walk/declarative"
+)
+
+func impairEdit(title string, edit **walk.NumberEdit, value int64, max float64, suffix string, tip string) []Widget {
+	return []Widget{
+		Label{
+			Text: title,
+		},
+		NumberEdit{
+			AssignTo: edit,
+			Value:    float64(value),
+			ToolTipText: tip,
+			MinValue: 0,
+			MaxValue: max,
+			Suffix: suffix,
+		},
+	}
+}
+
+// 网络损伤配置对话框，确认后返回新的配置，取消返回原配置
+func ImpairToolBar(owner walk.Form, cfg *impair.Config) *impair.Config {
+	var dlg *walk.Dialog
+	var acceptPB, cancelPB *walk.PushButton
+	var latency, jitter, refuse, reset, fragment, stallRate, stallTime *walk.NumberEdit
+
+	input := impair.Config{}
+	if cfg != nil {
+		input = *cfg
+	}
+
+	var children []Widget
+	children = append(children, impairEdit("Latency:", &latency, int64(input.Latency), 60000, " ms", "fixed delay")...)
+	children = append(children, impairEdit("Jitter:", &jitter, int64(input.Jitter), 60000, " ms", "random extra delay")...)
+	children = append(children, impairEdit("Refuse Rate:", &refuse, int64(input.RefuseRate), 100, " %", "probability of connection refusal")...)
+	children = append(children, impairEdit("Reset After:", &reset, input.ResetAfter/1024, 1024*1024, " KB", "reset session after bytes, 0 is disable")...)
+	children = append(children, impairEdit("Fragment:", &fragment, int64(input.Fragment), 65535, " Byte", "split writes into tiny pieces")...)
+	children = append(children, impairEdit("Stall Rate:", &stallRate, int64(input.StallRate), 100, " %", "probability of stall per chunk")...)
+	children = append(children, impairEdit("Stall Time:", &stallTime, int64(input.StallTime), 60000, " ms", "stall duration")...)
+
+	output := cfg
+
+	cnt, err := Dialog{
+		AssignTo: &dlg,
+		Title: "Network Impairment",
+		Icon: ICON_TOOL_SETTING,
+		DefaultButton: &acceptPB,
+		CancelButton: &cancelPB,
+		Size: Size{Width: 300, Height: 320},
+		MinSize: Size{Width: 300, Height: 320},
+		Layout:  VBox{ Margins: Margins{Top: 10, Bottom: 10, Left: 10, Right: 10}},
+		Children: []Widget{
+			Composite{
+				Layout: Grid{Columns: 2},
+				Children: children,
+			},
+			Composite{
+				Layout: HBox{},
+				Children: []Widget{
+					PushButton{
+						AssignTo: &acceptPB,
+						Text: "OK",
+						OnClicked: func() {
+							result := &impair.Config{
+								Latency: int(latency.Value()),
+								Jitter: int(jitter.Value()),
+								RefuseRate: int(refuse.Value()),
+								ResetAfter: int64(reset.Value()) * 1024,
+								Fragment: int(fragment.Value()),
+								StallRate: int(stallRate.Value()),
+								StallTime: int(stallTime.Value()),
+							}
+							if !result.Enable() {
+								result = nil
+							}
+							output = result
+							dlg.Accept()
+						},
+					},
+					PushButton{
+						AssignTo: &cancelPB,
+						Text: "Cancel",
+						OnClicked: func() {
+							dlg.Cancel()
+						},
+					},
+				},
+			},
+		},
+	}.Run(owner)
+	if err != nil {
+		logs.Error(err.Error())
+	} else {
+		logs.Info("impair dialog return %d", cnt)
+	}
+	return output
+}
@@ -1,175 +1,244 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/astaxie/beego/logs"
+	"github.com/lixiangyun/tcpproxy/acl"
+	"github.com/lixiangyun/tcpproxy/ban"
+	"github.com/lixiangyun/tcpproxy/discovery"
+	"github.com/lixiangyun/tcpproxy/impair"
+	"github.com/lixiangyun/tcpproxy/limit"
+	"github.com/lixiangyun/tcpproxy/proxy"
+	"github.com/lixiangyun/tcpproxy/sockopt"
+	"io"
 	"net"
-	"sync"
-	"sync/atomic"
 	"time"
 )
 
-type LinkChannel struct {
-	key    string
-	remote net.Conn
-	proxy  net.Conn
-	resvflow int64
-	sendflow int64
+type SessionItem struct {
+	Key       string
+	Client    string
+	Backend   string
+	Start     time.Time
+	Send      int64
+	Resv      int64
+	SendSpeed int64
+	ResvSpeed int64
+	Idle      time.Duration
 }
 
-type LinkInstance struct {
-	sync.RWMutex
-	sync.WaitGroup
+func (l *LinkInstance)update(list []discovery.Endpoint)  {
+	l.cluster.UpdateEndpoints(expandBackend(l.cfg.Mode, l.cfg.Backend, list))
+	logs.Info("link %s backend update %v", l.addr, list)
+}
 
-	close bool
+// 按原始配置的超时时间连接后端
+func (l *LinkInstance)dial(ep discovery.Endpoint) (net.Conn, error) {
+	var timeout time.Duration
+	for _, v := range l.cfg.Backend {
+		if v.Address == ep.Source {
+			timeout = time.Second * time.Duration(v.Timeout)
+			break
+		}
+	}
+	return sockopt.NewDialer(timeout, l.cfg.SockOpt).Dial("tcp", ep.Address)
+}
 
+type LinkInstance struct {
 	addr string
-	lb   LoadBalance
+	cluster *proxy.Cluster
+	pool *discovery.Pool
+	acl *acl.List
 	cfg *LinkConfig
-	list net.Listener
-	channels map[string]*LinkChannel
+	proxy *proxy.Proxy
 }
 
 func NewLinkInstance(item *LinkConfig) (*LinkInstance, error) {
-	address := fmt.Sprintf("%s:%d", item.Iface, item.Port)
-	list, err := net.Listen("tcp", address)
+	address := LinkAddress(item.Iface, item.Port)
+	access, err := acl.New(item.Acl)
 	if err != nil {
 		return nil, err
 	}
 
 	link := new(LinkInstance)
 	link.addr = address
-	link.list = list
-	link.channels = make(map[string]*LinkChannel, 1024)
 	link.cfg = item
-	link.lb = NewLoadBalance(item.Mode, item.Backend)
+	link.acl = access
 
-	link.Add(1)
-	go link.start()
-	return link, nil
-}
+	link.cluster = proxy.NewCluster(address, proxy.NewBalancer(linkBalanceMode(item.Mode)))
+	link.cluster.Dial = link.dial
 
-func (l *LinkInstance)proxy(wg *sync.WaitGroup, conn1 net.Conn)  {
-	var err error
-	var conn2 net.Conn
+	detector := ban.NewDetector(item.Ban, address, banTable)
+	if detector != nil {
+		detector.OnBan = banLog
+	}
 
-	defer func() {
-		wg.Done()
-		conn1.Close()
-		if conn2 != nil {
-			conn2.Close()
+	opts := []proxy.ListenerOption{
+		proxy.ListenSockOpt(item.SockOpt),
+		proxy.ListenLimit(limit.New(item.Limit)),
+		proxy.ListenThrottle(limit.NewThrottle(item.Bandwidth)),
+		proxy.ListenACL(access),
+		proxy.ListenBan(detector),
+		proxy.ListenPipe(link.pipe),
+	}
+	// 链路只有一个集群，路由到其它集群的连接由代理拒绝
+	if item.Route != "" {
+		router, err := proxy.NewRouter(item.Route, nil)
+		if err != nil {
+			access.Close()
+			return nil, err
 		}
-	}()
-
-	key   := conn1.RemoteAddr().String()
-	idx   := l.lb.Next(key)
-	proxy := l.cfg.Backend[idx]
+		opts = append(opts, proxy.ListenRouter(router))
+	}
 
-	if proxy.Timeout == 0 {
-		conn2, err = net.Dial("tcp", proxy.Address )
-	} else {
-		timeout := time.Second * time.Duration(proxy.Timeout)
-		conn2, err = net.DialTimeout("tcp", proxy.Address, timeout)
+	link.proxy = proxy.New(
+		proxy.WithCluster(link.cluster),
+		proxy.WithListener(address, link.cluster.Name, opts...),
+		proxy.WithIdleTimeout(time.Second * time.Duration(item.Timeout)),
+		proxy.WithMaxDuration(time.Second * time.Duration(item.MaxLife)),
+		proxy.WithMiddleware(middlewares...),
+		proxy.WithHooks(proxy.Hooks{OnAccept: link.refuse, OnError: link.reject, OnClose: link.closed}),
+	)
+
+	var entries []string
+	exist := make(map[string]bool)
+	for _, v := range item.Backend {
+		if !exist[v.Address] {
+			exist[v.Address] = true
+			entries = append(entries, v.Address)
+		}
 	}
+	link.pool = discovery.NewPoolAsync(entries, time.Second * time.Duration(item.Resolve))
+	link.update(link.pool.Endpoints())
+	link.pool.OnUpdate = link.update
 
+	err = link.proxy.Start(context.Background())
 	if err != nil {
-		logs.Error(err.Error())
-		return
+		link.pool.Close()
+		access.Close()
+		return nil, err
 	}
+	link.pool.Start()
 
-	channel := new(LinkChannel)
-	channel.remote = conn1
-	channel.proxy = conn2
-	channel.key = key
-
-	l.Lock()
-	l.channels[key] = channel
-	l.Unlock()
+	logs.Info("link instance %s start", address)
+	return link, nil
+}
 
-	wg2 := new(sync.WaitGroup)
-	wg2.Add(2)
-	go connect(wg2, conn1, conn2, &channel.sendflow)
-	go connect(wg2, conn2, conn1, &channel.resvflow)
-	wg2.Wait()
+// 按网络损伤配置的概率直接复位新连接
+func (l *LinkInstance)refuse(conn net.Conn) error {
+	if l.cfg.Impair.Refuse() {
+		impair.Reset(conn)
+		return errors.New(impair.REASON_REFUSE)
+	}
+	return nil
+}
 
-	l.Lock()
-	delete(l.channels, key)
-	l.Unlock()
+func (l *LinkInstance)reject(info *proxy.ConnInfo, err error)  {
+	key := info.Conn.RemoteAddr().String()
+	if ae, ok := err.(*proxy.AdmitError); ok && ae.Deny {
+		logs.Warn("link %s deny %s, %s", l.addr, key, err.Error())
+	} else {
+		logs.Warn("link %s reject %s, %s", l.addr, key, err.Error())
+	}
 }
 
-func (l *LinkInstance)start()  {
-	defer l.Done()
-	logs.Info("link instance %s start", l.addr)
+func (l *LinkInstance)closed(s *proxy.Session)  {
+	if len(s.Tags) > 0 {
+		logs.Info("link %s session %s close, %s, tags %v", l.addr, s.Client, s.Reason(), s.Tags)
+	} else {
+		logs.Info("link %s session %s close, %s", l.addr, s.Client, s.Reason())
+	}
+}
 
-	wg := new(sync.WaitGroup)
-	for  {
-		if l.close {
-			break
-		}
-		conn, err := l.list.Accept()
-		if err != nil {
+// 双向转发，配置了网络损伤时使用带损伤模拟的转发，配置可以在运行中修改
+func (l *LinkInstance)pipe(s *proxy.Session, client net.Conn, backend net.Conn, flow *limit.Flow)  {
+	cfg := l.cfg.Impair
+	if !cfg.Enable() {
+		proxy.SessionPipe(s, client, backend, flow)
+		return
+	}
+	for _, err := range impair.Pipe(client, backend, impairForwarder(s, flow, true, cfg),
+		impairForwarder(s, flow, false, cfg)) {
+		if err != nil && err != io.ErrClosedPipe {
 			logs.Error(err.Error())
-			continue
 		}
-		wg.Add(1)
-		go l.proxy(wg, conn)
 	}
-	wg.Wait()
-
-	logs.Info("link instance %s shutdown", l.addr)
 }
 
-func (l *LinkInstance)Close()  {
-	l.Lock()
-	l.close = true
-	l.list.Close()
-	for _, v := range l.channels {
-		v.remote.Close()
+// 带网络损伤模拟的单方向转发，会话累计字节数超过配置后以RST复位会话两端
+func impairForwarder(s *proxy.Session, flow *limit.Flow, up bool, cfg *impair.Config) *impair.Forwarder {
+	forwarder := s.Forwarder(up, flow)
+	return &impair.Forwarder{
+		Up: up,
+		Config: cfg,
+		Flow: flow,
+		Count: forwarder.Count,
+		Total: func() int64 {
+			send, resv := s.Flows()
+			return send + resv
+		},
+		Reset: func() {
+			s.SetReason(impair.REASON_RESET)
+			impair.Reset(s.ClientConn())
+			impair.Reset(s.BackendConn())
+		},
+		Done: forwarder.Done,
 	}
-	l.Unlock()
+}
 
-	l.Wait()
+func (l *LinkInstance)Close()  {
+	l.proxy.Close()
+	l.pool.Close()
+	l.acl.Close()
 	logs.Info("link instance %s close", l.addr)
 }
 
+// 访问控制拒绝的连接数
+func (l *LinkInstance)AclRejected() uint64 {
+	return l.acl.Rejected()
+}
+
 func (l *LinkInstance)Channels() int {
-	l.RLock()
-	defer l.RUnlock()
-	return len(l.channels)
+	return len(l.proxy.Sessions())
 }
 
 func (l *LinkInstance)Flows() int64 {
-	l.RLock()
-	defer l.RUnlock()
-
-	var resv, send int64
-	for _, v := range l.channels {
-		resv += v.resvflow
-		send += v.sendflow
+	var total int64
+	for _, v := range l.proxy.Sessions() {
+		send, resv := v.Flows()
+		total += send + resv
 	}
-	return resv + send
+	return total
 }
 
-
-func connect(wg *sync.WaitGroup, conn1 net.Conn, conn2 net.Conn, flow *int64)  {
-	defer func() {
-		wg.Done()
-	}()
-
-	var buf [8192]byte
-	for  {
-		cnt, err1 := conn1.Read(buf[:])
-		if cnt > 0 {
-			err2 := WriteFull(conn2, buf[:cnt])
-			if err2 != nil {
-				logs.Error(err2.Error())
-				return
-			}
-			atomic.AddInt64(flow, int64(cnt))
+func (l *LinkInstance)Sessions() []SessionItem {
+	list := l.proxy.Sessions()
+	output := make([]SessionItem, 0, len(list))
+	for _, v := range list {
+		send, resv := v.Flows()
+		item := SessionItem{
+			Key: v.Client,
+			Client: v.Client,
+			Backend: v.Backend,
+			Start: v.Start,
+			Send: send,
+			Resv: resv,
+			Idle: v.Idle(),
 		}
-		if err1 != nil {
-			logs.Error(err1.Error())
-			return
+		item.SendSpeed, item.ResvSpeed = v.Speed()
+		output = append(output, item)
+	}
+	return output
+}
+
+func (l *LinkInstance)SessionClose(key string) error {
+	for _, v := range l.proxy.Sessions() {
+		if v.Client == key {
+			v.Close()
+			return nil
 		}
 	}
-}
\ No newline at end of file
+	return fmt.Errorf("session %s not found", key)
+}
@@ -4,6 +4,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/astaxie/beego/logs"
+	"github.com/lixiangyun/tcpproxy/acl"
+	"github.com/lixiangyun/tcpproxy/ban"
+	"github.com/lixiangyun/tcpproxy/discovery"
+	"github.com/lixiangyun/tcpproxy/proxy"
+	"github.com/lixiangyun/tcpproxy/schema"
 	"io/ioutil"
 	"sync"
 	"time"
@@ -24,10 +29,19 @@ type LinkCtrl struct {
 
 var linkCtrl *LinkCtrl
 
+// 全部链路共享的封禁表，与link.json保存在同一目录
+var banTable *ban.Table
+
 func init()  {
 	linkCtrl = new(LinkCtrl)
 	linkCtrl.Cache = make([]*Link, 0)
 
+	acl.Logf = func(format string, v ...interface{}) {
+		logs.Info(format, v...)
+	}
+	discovery.Logf = acl.Logf
+	proxy.Logf = acl.Logf
+
 	go consoleUpdate()
 }
 
@@ -88,6 +102,52 @@ func LinkFind(bind string) *LinkConfig {
 	return nil
 }
 
+func LinkSessions(bind string) []SessionItem {
+	linkCtrl.RLock()
+	defer linkCtrl.RUnlock()
+
+	for _, v := range linkCtrl.Cache {
+		if v.Bind != bind || v.Instance == nil {
+			continue
+		}
+		return v.Instance.Sessions()
+	}
+	return nil
+}
+
+func LinkAclRejected(bind string) uint64 {
+	linkCtrl.RLock()
+	defer linkCtrl.RUnlock()
+
+	for _, v := range linkCtrl.Cache {
+		if v.Bind != bind || v.Instance == nil {
+			continue
+		}
+		return v.Instance.AclRejected()
+	}
+	return 0
+}
+
+func LinkSessionClose(bind string, keys []string) {
+	linkCtrl.RLock()
+	defer linkCtrl.RUnlock()
+
+	for _, v := range linkCtrl.Cache {
+		if v.Bind != bind || v.Instance == nil {
+			continue
+		}
+		for _, key := range keys {
+			err := v.Instance.SessionClose(key)
+			if err != nil {
+				logs.Error(err.Error())
+			} else {
+				logs.Info("link %s session %s terminate", bind, key)
+			}
+		}
+		break
+	}
+}
+
 func LinkStop(binds []string)  {
 	linkCtrl.Lock()
 	defer linkCtrl.Unlock()
@@ -119,7 +179,7 @@ func LinkAdd(cfg *LinkConfig) error {
 		return err
 	}
 
-	bind := fmt.Sprintf("%s:%d", cfg.Iface, cfg.Port)
+	bind := LinkAddress(cfg.Iface, cfg.Port)
 
 	linkCtrl.Lock()
 	linkCtrl.Cache = append(linkCtrl.Cache, &Link{
@@ -179,7 +239,7 @@ func syncToFile()  {
 		output = append(output, *v.Cfg)
 	}
 
-	value, err := json.Marshal(output)
+	value, err := schema.EncodeLinks(output)
 	if err != nil {
 		logs.Error(err.Error())
 		return
@@ -192,7 +252,37 @@ func syncToFile()  {
 	}
 }
 
+func banLog(item ban.Ban, err error) {
+	logs.Warn("ban %s on %s until %s, %s", item.IP, item.Listener,
+		item.Until.Format("2006-01-02 15:04:05"), item.Reason)
+	if err != nil {
+		logs.Error("ban save failed %s", err.Error())
+	}
+}
+
+func LinkBans() []ban.Ban {
+	return banTable.List()
+}
+
+func LinkBanClear(ips []string) {
+	for _, ip := range ips {
+		_, err := banTable.Clear(ip)
+		if err != nil {
+			logs.Error(err.Error())
+		} else {
+			logs.Info("ban %s clear", ip)
+		}
+	}
+}
+
 func LinkInit() error {
+	var err error
+	banTable, err = ban.NewTable(fmt.Sprintf("%s\\ban.json", appDataDir()))
+	if err != nil {
+		logs.Error(err.Error())
+		banTable, _ = ban.NewTable("")
+	}
+
 	file := fmt.Sprintf("%s\\link.json", appDataDir())
 
 	value, err := ioutil.ReadFile(file)
@@ -201,13 +291,24 @@ func LinkInit() error {
 		return nil
 	}
 
-	var output []LinkConfig
-	err = json.Unmarshal(value, &output)
+	output, version, err := schema.DecodeLinks(value)
 	if err != nil {
 		logs.Error(err.Error())
 		return nil
 	}
 
+	// 旧版本文件先备份，再按当前版本重新保存
+	if version < schema.VERSION {
+		backup := fmt.Sprintf("%s.v%d.bak", file, version)
+		err = SaveToFile(backup, value)
+		if err != nil {
+			logs.Error(err.Error())
+		} else {
+			logs.Info("link file version %d migrated to %d, backup %s", version, schema.VERSION, backup)
+			defer syncToFile()
+		}
+	}
+
 	for _, v := range output {
 		temp := v
 
@@ -216,7 +317,7 @@ func LinkInit() error {
 			logs.Error(err.Error())
 		}
 
-		bind := fmt.Sprintf("%s:%d", temp.Iface, temp.Port)
+		bind := LinkAddress(temp.Iface, temp.Port)
 		linkCtrl.Cache = append(linkCtrl.Cache, &Link{
 			Cfg: &temp, Instance: instance, Bind: bind,
 		})
@@ -1,128 +1,55 @@
 package main
 
 import (
-	"math/rand"
-	"net"
+	"github.com/lixiangyun/tcpproxy/discovery"
+	"github.com/lixiangyun/tcpproxy/proxy"
 	"strings"
-	"sync/atomic"
 )
 
-type LoadBalance interface {
-	Next(addr string) int
-}
-
-type RandomLB struct {
-	max  int
-}
-
-func (r *RandomLB)Next(addr string) int {
-	return rand.Int() % r.max
-}
-
-func NewRandom(items []BackendConfig) LoadBalance {
-	return &RandomLB{max: len(items)}
-}
-
-type RoundRobinLB struct {
-	idx uint32
-	max uint32
-}
-
-func (r *RoundRobinLB)Next(addr string) int {
-	idx := r.idx
-	atomic.AddUint32(&r.idx, 1)
-	return int(idx % r.max)
-}
-
-func NewRoundRobin(items []BackendConfig) LoadBalance {
-	return &RoundRobinLB{max: uint32(len(items))}
-}
-
-type AddressHashLB struct {
-	max int
-}
-
-func (r *AddressHashLB)Next(addr string) int {
-	idx := strings.Index(addr, ":")
-	if idx != -1 {
-		addr = addr[:idx]
-	}
-	ip := net.ParseIP(addr)
-	var sum int
-	for _, v := range ip {
-		sum += int(v)
+// 界面上的负载均衡方式对应的公共实现，只有WeightRoundRobin使用后端权重，
+// 所有方式都只在主用后端不可用时使用备用后端
+func linkBalanceMode(mode string) string {
+	switch mode {
+	case "Random":
+		return proxy.LB_RANDOM
+	case "AddressHash":
+		return proxy.LB_HASH
+	case "LeastConn":
+		return proxy.LB_LEASTCONN
 	}
-	return sum % r.max
-}
-
-func NewAddressHash(items []BackendConfig) LoadBalance {
-	return &AddressHashLB{max: len(items)}
-}
-
-type WeightRoundRobinLB struct {
-	List  []int
-	Idx     int
-	Gcd     int
-	MaxW    int
-	CurW    int
-}
-
-func (r *WeightRoundRobinLB)Next(addr string) int {
-	for {
-		r.Idx = (r.Idx + 1) % len(r.List)
-		if r.Idx == 0 {
-			r.CurW = r.CurW - r.Gcd
-			if r.CurW <= 0 {
-				r.CurW = r.MaxW
+	return proxy.LB_ROUNDROBIN
+}
+
+// 按解析结果展开后端配置，主机名的多个地址继承原配置，
+// SRV记录和成员列表使用各自的权重，非最高优先级的成员作为备用
+func expandBackend(mode string, items []BackendConfig, list []discovery.Endpoint) []discovery.Endpoint {
+	var output []discovery.Endpoint
+	for _, item := range items {
+		priority := -1
+		for _, v := range list {
+			if v.Source == item.Address && (priority < 0 || v.Priority < priority) {
+				priority = v.Priority
 			}
 		}
-		if r.List[r.Idx] >= r.CurW {
-			return r.Idx
-		}
-	}
-}
-
-func NewWeightRoundRobin(items []BackendConfig) LoadBalance {
-	s := &WeightRoundRobinLB{List: make([]int, len(items))}
-	for idx, v := range items {
-		s.List[idx] = v.Weight
-		if s.MaxW < v.Weight {
-			s.MaxW = v.Weight
-		}
-		if idx == 0 {
-			s.Gcd = v.Weight
-		} else {
-			s.Gcd = gcd(s.Gcd, v.Weight)
-		}
-	}
-	s.CurW = s.MaxW
-	return s
-}
-
-/* 迭代法（递推法）：欧几里得算法，计算最大公约数 */
-func gcd(m, n int) int {
-	for {
-		if m == 0 {
-			return n
+		for _, v := range list {
+			if v.Source != item.Address {
+				continue
+			}
+			member := discovery.Endpoint{Address: v.Address, Source: item.Address, Weight: 1}
+			standby := item.Standby
+			if strings.HasPrefix(item.Address, discovery.SRV_PREFIX) || discovery.IsProvider(item.Address) {
+				standby = standby || v.Priority > priority
+				if mode == "WeightRoundRobin" {
+					member.Weight = v.Weight
+				}
+			} else if mode == "WeightRoundRobin" {
+				member.Weight = item.Weight
+			}
+			if standby {
+				member.Priority = 1
+			}
+			output = append(output, member)
 		}
-		c := n % m
-		n = m
-		m = c
 	}
+	return output
 }
-
-func NewLoadBalance(mode string, items []BackendConfig) LoadBalance {
-	switch mode {
-	case "Random":
-		return NewRandom(items)
-	case "RoundRobin":
-		return NewRoundRobin(items)
-	case "WeightRoundRobin":
-		return NewWeightRoundRobin(items)
-	case "AddressHash":
-		return NewAddressHash(items)
-	case "MainStandby":
-		return nil
-	}
-	return nil
-}
\ No newline at end of file
@@ -0,0 +1,13 @@
+package main
+
+import (
+	"github.com/lixiangyun/tcpproxy/proxy"
+)
+
+// 全部链路共用的中间件，在同一包内的其它文件的init中通过Use注册，
+// 链路创建时生效
+var middlewares proxy.Chain
+
+func Use(m ...proxy.Middleware)  {
+	middlewares = append(middlewares, m...)
+}
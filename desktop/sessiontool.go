@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"github.com/astaxie/beego/logs"
+	"github.com/lxn/walk"
+	. "github.com/lxn/walk/declarative"
+	"sort"
+	"sync"
+	"time"
+)
+
+type SessionModel struct {
+	sync.RWMutex
+
+	walk.TableModelBase
+	walk.SorterBase
+	sortColumn int
+	sortOrder  walk.SortOrder
+
+	items      []*SessionItem
+	checked    map[string]bool
+}
+
+func (n *SessionModel)Update(items []SessionItem)  {
+	n.Lock()
+	defer n.Unlock()
+
+	var output []*SessionItem
+	for i := range items {
+		output = append(output, &items[i])
+	}
+
+	n.items = output
+	n.PublishRowsReset()
+	n.Sort(n.sortColumn, n.sortOrder)
+}
+
+func (n *SessionModel)SelectList() []string {
+	n.RLock()
+	defer n.RUnlock()
+
+	var output []string
+	for _, v := range n.items {
+		if n.checked[v.Key] {
+			output = append(output, v.Key)
+		}
+	}
+	return output
+}
+
+func (n *SessionModel)RowCount() int {
+	return len(n.items)
+}
+
+func (n *SessionModel)Value(row, col int) interface{} {
+	item := n.items[row]
+	switch col {
+	case 0:
+		return item.Client
+	case 1:
+		return item.Backend
+	case 2:
+		return item.Start.Format("2006-01-02 15:04:05")
+	case 3:
+		return ByteView(item.Send)
+	case 4:
+		return ByteView(item.Resv)
+	case 5:
+		return fmt.Sprintf("%s/s", ByteView(item.SendSpeed))
+	case 6:
+		return fmt.Sprintf("%s/s", ByteView(item.ResvSpeed))
+	case 7:
+		return item.Idle.Truncate(time.Second).String()
+	}
+	panic("unexpected col")
+}
+
+func (n *SessionModel) Checked(row int) bool {
+	return n.checked[n.items[row].Key]
+}
+
+func (n *SessionModel) SetChecked(row int, checked bool) error {
+	n.checked[n.items[row].Key] = checked
+	return nil
+}
+
+func (m *SessionModel) Sort(col int, order walk.SortOrder) error {
+	m.sortColumn, m.sortOrder = col, order
+	sort.SliceStable(m.items, func(i, j int) bool {
+		a, b := m.items[i], m.items[j]
+		c := func(ls bool) bool {
+			if m.sortOrder == walk.SortAscending {
+				return ls
+			}
+			return !ls
+		}
+		switch m.sortColumn {
+		case 0:
+			return c(a.Client < b.Client)
+		case 1:
+			return c(a.Backend < b.Backend)
+		case 2:
+			return c(a.Start.Before(b.Start))
+		case 3:
+			return c(a.Send < b.Send)
+		case 4:
+			return c(a.Resv < b.Resv)
+		case 5:
+			return c(a.SendSpeed < b.SendSpeed)
+		case 6:
+			return c(a.ResvSpeed < b.ResvSpeed)
+		case 7:
+			return c(a.Idle < b.Idle)
+		}
+		panic("unreachable")
+	})
+	return m.SorterBase.Sort(col, order)
+}
+
+func SessionToolBar(bind string)  {
+	var dlg *walk.Dialog
+	var closePB *walk.PushButton
+	var sessionView *walk.TableView
+
+	sessionTable := new(SessionModel)
+	sessionTable.items = make([]*SessionItem, 0)
+	sessionTable.checked = make(map[string]bool)
+	sessionTable.Update(LinkSessions(bind))
+
+	err := Dialog{
+		AssignTo: &dlg,
+		Title: "Link Sessions " + bind,
+		Icon: walk.IconInformation(),
+		CancelButton: &closePB,
+		Size: Size{Width: 700, Height: 400},
+		MinSize: Size{Width: 500, Height: 300},
+		Layout:  VBox{
+			Margins: Margins{Top: 10, Bottom: 10, Left: 10, Right: 10},
+		},
+		Children: []Widget{
+			TableView{
+				AssignTo: &sessionView,
+				AlternatingRowBG: true,
+				ColumnsOrderable: true,
+				CheckBoxes: true,
+				Columns: []TableViewColumn{
+					{Title: "Client", Width: 120},
+					{Title: "Backend", Width: 120},
+					{Title: "Start", Width: 120},
+					{Title: "Upload", Width: 60},
+					{Title: "Download", Width: 60},
+					{Title: "Up Speed", Width: 70},
+					{Title: "Down Speed", Width: 70},
+					{Title: "Idle", Width: 50},
+				},
+				StyleCell: func(style *walk.CellStyle) {
+					if style.Row()%2 == 0 {
+						style.BackgroundColor = walk.RGB(248, 248, 255)
+					} else {
+						style.BackgroundColor = walk.RGB(220, 220, 220)
+					}
+				},
+				Model: sessionTable,
+			},
+			Composite{
+				Layout: HBox{MarginsZero: true},
+				Children: []Widget{
+					PushButton{
+						Text: "Terminate",
+						OnClicked: func() {
+							list := sessionTable.SelectList()
+							if len(list) == 0 {
+								ErrorBoxAction(dlg, "No object selected")
+								return
+							}
+							LinkSessionClose(bind, list)
+							sessionTable.Update(LinkSessions(bind))
+						},
+					},
+					HSpacer{},
+					PushButton{
+						AssignTo: &closePB,
+						Text: "Close",
+						OnClicked: func() {
+							dlg.Cancel()
+						},
+					},
+				},
+			},
+		},
+	}.Create(MainWindowsCtrl())
+	if err != nil {
+		logs.Error(err.Error())
+		return
+	}
+
+	// 对话框创建之后再启动刷新，避免dlg尚未赋值
+	exit := make(chan struct{})
+	defer close(exit)
+
+	go func() {
+		ticker := time.NewTicker(2 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-exit:
+				return
+			case <-ticker.C:
+				items := LinkSessions(bind)
+				dlg.Synchronize(func() {
+					sessionTable.Update(items)
+				})
+			}
+		}
+	}()
+
+	cnt := dlg.Run()
+	logs.Info("session dialog return %d", cnt)
+}
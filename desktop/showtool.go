@@ -3,10 +3,26 @@ package main
 import (
 	"fmt"
 	"github.com/astaxie/beego/logs"
+	"github.com/lixiangyun/tcpproxy/limit"
 	"github.com/lxn/walk"
 	. "github.com/lxn/walk/declarative"
 )
 
+func BandwidthView(cfg *limit.BandwidthConfig) string {
+	if cfg == nil {
+		return "unlimited"
+	}
+	rate := func(value int64) string {
+		if value == 0 {
+			return "-"
+		}
+		return ByteView(value) + "/s"
+	}
+	return fmt.Sprintf("link ↑%s ↓%s, client ↑%s ↓%s, session ↑%s ↓%s",
+		rate(cfg.Up), rate(cfg.Down), rate(cfg.ClientUp), rate(cfg.ClientDown),
+		rate(cfg.SessionUp), rate(cfg.SessionDown))
+}
+
 func ShowToolBar(cfg * LinkConfig)  {
 	var dlg *walk.Dialog
 	var acceptPB *walk.PushButton
@@ -34,15 +50,45 @@ func ShowToolBar(cfg * LinkConfig)  {
 						Text: "Bind Address:",
 					},
 					Label{
-						Text: fmt.Sprintf("%s:%d",
-							cfg.Iface, cfg.Port),
+						Text: LinkAddress(cfg.Iface, cfg.Port),
 					},
 					Label{
-						Text: "Bind Timeout:",
+						Text: "Idle Timeout:",
 					},
 					Label{
 						Text: fmt.Sprintf("%d Second", cfg.Timeout),
 					},
+					Label{
+						Text: "Max Session Time:",
+					},
+					Label{
+						Text: fmt.Sprintf("%d Second", cfg.MaxLife),
+					},
+					Label{
+						Text: "Bandwidth:",
+					},
+					Label{
+						Text: BandwidthView(cfg.Bandwidth),
+					},
+					Label{
+						Text: "Access Control:",
+					},
+					Label{
+						Text: fmt.Sprintf("%s, rejected %d",
+							AclView(cfg.Acl), LinkAclRejected(LinkAddress(cfg.Iface, cfg.Port))),
+					},
+					Label{
+						Text: "Ban Policy:",
+					},
+					Label{
+						Text: BanPolicyView(cfg.Ban),
+					},
+					Label{
+						Text: "Impairment:",
+					},
+					Label{
+						Text: cfg.Impair.String(),
+					},
 					Label{
 						Text: "Load Balance:",
 					},
@@ -80,8 +126,20 @@ func ShowToolBar(cfg * LinkConfig)  {
 				},
 			},
 			Composite{
-				Layout: VBox{},
+				Layout: HBox{},
 				Children: []Widget{
+					PushButton{
+						Text: "Sessions",
+						OnClicked: func() {
+							SessionToolBar(LinkAddress(cfg.Iface, cfg.Port))
+						},
+					},
+					PushButton{
+						Text: "Bans",
+						OnClicked: func() {
+							BanToolBar()
+						},
+					},
 					PushButton{
 						AssignTo: &acceptPB,
 						Text: "OK",
@@ -4,9 +4,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/astaxie/beego/logs"
-	"io"
+	"github.com/lixiangyun/tcpproxy/discovery"
 	"io/ioutil"
 	"net"
+	"net/url"
 	"os"
 	"os/signal"
 	"strconv"
@@ -21,8 +22,13 @@ func VersionGet() string {
 	return "v1.0.0"
 }
 
+// 拼接监听地址，IPv6地址带中括号
+func LinkAddress(iface string, port int) string {
+	return net.JoinHostPort(iface, strconv.Itoa(port))
+}
+
 func ListenCheck(addr string, port int) bool {
-	list, err := net.Listen("tcp", fmt.Sprintf("%s:%d", addr, port))
+	list, err := net.Listen("tcp", LinkAddress(addr, port))
 	if err != nil {
 		logs.Error(err.Error())
 		return false
@@ -53,21 +59,64 @@ func InterfaceAddsGet(iface *net.Interface) ([]net.IP, error) {
 	return ips, nil
 }
 
+// 主机名由字母、数字、连字符和下划线组成，以点分隔
+func HostnameValid(host string) bool {
+	host = strings.TrimSuffix(host, ".")
+	if host == "" || len(host) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// 后端地址可以是IP或主机名加端口，也可以是 srv:<name> 形式的DNS SRV记录，
+// file:<path> 形式的成员列表文件，或者返回成员列表的HTTP地址
 func AddressValid(addr string) bool {
 	if addr == "" {
 		return false
 	}
-	list := strings.Split(addr,":")
-	if len(list) != 2 {
-		logs.Error("address valid fail, %s", addr)
+	if discovery.IsProvider(addr) {
+		if strings.HasPrefix(addr, discovery.FILE_PREFIX) {
+			return strings.TrimPrefix(addr, discovery.FILE_PREFIX) != ""
+		}
+		u, err := url.Parse(addr)
+		if err != nil || u.Host == "" {
+			logs.Error("address valid fail, %s", addr)
+			return false
+		}
+		return true
+	}
+	if strings.HasPrefix(addr, discovery.SRV_PREFIX) {
+		if !HostnameValid(strings.TrimPrefix(addr, discovery.SRV_PREFIX)) {
+			logs.Error("address valid fail, %s", addr)
+			return false
+		}
+		return true
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		logs.Error("address valid fail, %s", err.Error())
 		return false
 	}
-	ip := net.ParseIP(list[0])
-	if ip == nil {
+	// 链路本地IPv6地址可以带网卡区域，例如 [fe80::1%eth0]:80
+	if idx := strings.Index(host, "%"); idx != -1 && strings.Contains(host, ":") {
+		host = host[:idx]
+	}
+	ip := net.ParseIP(host)
+	if ip == nil && !HostnameValid(host) {
 		logs.Error("address valid fail, %s", addr)
 		return false
 	}
-	cnt, err := strconv.Atoi(list[1])
+	cnt, err := strconv.Atoi(port)
 	if err != nil {
 		logs.Error("address valid fail, %s", err.Error())
 		return false
@@ -80,7 +129,7 @@ func AddressValid(addr string) bool {
 }
 
 func IsIPv4(ip net.IP) bool {
-	return strings.Index(ip.String(), ".") != -1
+	return ip.To4() != nil
 }
 
 func InterfaceLocalIP(inface *net.Interface) ([]net.IP, error) {
@@ -88,14 +137,18 @@ func InterfaceLocalIP(inface *net.Interface) ([]net.IP, error) {
 	if err != nil {
 		return nil, err
 	}
-	var output []net.IP
+	// IPv4在前，链路本地IPv6地址需要指定网卡区域，不作为监听选项
+	var output, ipv6 []net.IP
 	for _, v := range addrs {
 		if IsIPv4(v) == true {
 			output = append(output, v)
+		} else if !v.IsLinkLocalUnicast() {
+			ipv6 = append(ipv6, v)
 		}
 	}
+	output = append(output, ipv6...)
 	if len(output) == 0 {
-		return nil, fmt.Errorf("interface not ipv4 address.")
+		return nil, fmt.Errorf("interface not ip address.")
 	}
 	return output, nil
 }
@@ -160,22 +213,6 @@ func LogInit() error {
 	return nil
 }
 
-func WriteFull(w io.Writer, body []byte) error {
-	begin := 0
-	for  {
-		cnt, err := w.Write(body[begin:])
-		if cnt > 0 {
-			begin += cnt
-		}
-		if begin >= len(body) {
-			return err
-		}
-		if err != nil {
-			return err
-		}
-	}
-}
-
 func init()  {
 	mathrand.Seed(time.Now().Unix())
 }
\ No newline at end of file
@@ -0,0 +1,166 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// consul://127.0.0.1:8500/<service>?tag=v1&dc=dc1&token=xxx&scheme=https
+	CONSUL_PREFIX = "consul://"
+
+	consulWait = 55 * time.Second
+)
+
+// 通过阻塞查询获取consul目录中服务的健康实例，
+// 权重取自 Meta["weight"]、标签 weight=N 或者 Weights.Passing
+type consulWatcher struct {
+	entry   string
+	base    string
+	service string
+	query   url.Values
+	token   string
+	client  *http.Client
+}
+
+type consulHealth struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		Address string
+		Port    int
+		Tags    []string
+		Meta    map[string]string
+		Weights struct {
+			Passing int
+		}
+	}
+}
+
+func newConsulWatcher(entry string) (*consulWatcher, error) {
+	u, err := url.Parse(entry)
+	if err != nil {
+		return nil, err
+	}
+	service := strings.Trim(u.Path, "/")
+	if u.Host == "" || service == "" {
+		return nil, fmt.Errorf("invalid consul address %s", entry)
+	}
+	query := u.Query()
+	scheme := query.Get("scheme")
+	if scheme == "" {
+		scheme = "http"
+	}
+	w := &consulWatcher{
+		entry:   entry,
+		base:    fmt.Sprintf("%s://%s", scheme, u.Host),
+		service: service,
+		query:   url.Values{},
+		token:   query.Get("token"),
+		client:  &http.Client{Timeout: consulWait + resolveTimeout},
+	}
+	w.query.Set("passing", "1")
+	for _, key := range []string{"tag", "dc", "ns"} {
+		if value := query.Get(key); value != "" {
+			w.query.Set(key, value)
+		}
+	}
+	return w, nil
+}
+
+// 从元数据或者 key=N 形式的标签中读取整数
+func consulValue(meta map[string]string, tags []string, key string) int {
+	if value, err := strconv.Atoi(meta[key]); err == nil {
+		return value
+	}
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, key+"=") {
+			if value, err := strconv.Atoi(strings.TrimPrefix(tag, key+"=")); err == nil {
+				return value
+			}
+		}
+	}
+	return 0
+}
+
+func (w *consulWatcher) Wait(ctx context.Context, index uint64) ([]Endpoint, uint64, error) {
+	query := url.Values{}
+	for k, v := range w.query {
+		query[k] = v
+	}
+	if index > 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", consulWait.String())
+	}
+	address := fmt.Sprintf("%s/v1/health/service/%s?%s", w.base, url.PathEscape(w.service), query.Encode())
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, address, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if w.token != "" {
+		request.Header.Set("X-Consul-Token", w.token)
+	}
+	response, err := w.client.Do(request)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("consul status %s, %s", response.Status, strings.TrimSpace(string(body)))
+	}
+
+	next, err := strconv.ParseUint(response.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("consul index invalid, %s", err.Error())
+	}
+	// 索引回退时需要重新开始，避免一直阻塞
+	if next < index {
+		next = 0
+	}
+	if next == index {
+		return nil, index, errNoChange
+	}
+
+	var list []consulHealth
+	err = json.Unmarshal(body, &list)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var output []Endpoint
+	for _, v := range list {
+		host := v.Service.Address
+		if host == "" {
+			host = v.Node.Address
+		}
+		weight := consulValue(v.Service.Meta, v.Service.Tags, "weight")
+		if weight <= 0 {
+			weight = v.Service.Weights.Passing
+		}
+		if weight <= 0 {
+			weight = 1
+		}
+		output = append(output, Endpoint{
+			Address:  net.JoinHostPort(host, strconv.Itoa(v.Service.Port)),
+			Priority: consulValue(v.Service.Meta, v.Service.Tags, "priority"),
+			Weight:   weight,
+			Source:   w.entry,
+		})
+	}
+	return output, next, nil
+}
@@ -0,0 +1,227 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 模拟consul的健康检查接口，index参数与当前索引相同时阻塞到变化或者超时
+type fakeConsul struct {
+	sync.Mutex
+	index   uint64
+	body    string
+	status  int
+	changed chan struct{}
+	queries []url.Values
+	tokens  []string
+	timeout time.Duration
+}
+
+func newFakeConsul(index uint64, body string) (*fakeConsul, *httptest.Server) {
+	f := &fakeConsul{index: index, body: body, status: http.StatusOK,
+		changed: make(chan struct{}), timeout: 200 * time.Millisecond}
+	return f, httptest.NewServer(f)
+}
+
+func (f *fakeConsul) update(index uint64, body string) {
+	f.Lock()
+	defer f.Unlock()
+	f.index, f.body = index, body
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/health/service/web" {
+		http.NotFound(w, r)
+		return
+	}
+	query := r.URL.Query()
+	f.Lock()
+	f.queries = append(f.queries, query)
+	f.tokens = append(f.tokens, r.Header.Get("X-Consul-Token"))
+	index, _ := strconv.ParseUint(query.Get("index"), 10, 64)
+	if index > 0 && index == f.index {
+		changed := f.changed
+		f.Unlock()
+		select {
+		case <-changed:
+		case <-time.After(f.timeout):
+		case <-r.Context().Done():
+		}
+		f.Lock()
+	}
+	defer f.Unlock()
+
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+	w.WriteHeader(f.status)
+	fmt.Fprint(w, f.body)
+}
+
+func (f *fakeConsul) lastQuery() url.Values {
+	f.Lock()
+	defer f.Unlock()
+	return f.queries[len(f.queries)-1]
+}
+
+func consulEntry(server *httptest.Server, query string) string {
+	return CONSUL_PREFIX + strings.TrimPrefix(server.URL, "http://") + "/web" + query
+}
+
+const consulServices = `[
+	{"Node": {"Address": "10.0.0.1"}, "Service": {"Address": "", "Port": 80}},
+	{"Node": {"Address": "10.0.0.9"}, "Service": {"Address": "10.0.0.2", "Port": 80,
+		"Meta": {"weight": "5", "priority": "1"}}},
+	{"Node": {"Address": "10.0.0.9"}, "Service": {"Address": "10.0.0.3", "Port": 81,
+		"Tags": ["v1", "weight=2"], "Weights": {"Passing": 7}}},
+	{"Node": {"Address": "10.0.0.9"}, "Service": {"Address": "10.0.0.4", "Port": 82,
+		"Weights": {"Passing": 3}}}
+]`
+
+func TestConsulWaitParse(t *testing.T) {
+	fake, server := newFakeConsul(10, consulServices)
+	defer server.Close()
+
+	watcher, err := newConsulWatcher(consulEntry(server, "?tag=v1&dc=dc1&token=secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, index, err := watcher.Wait(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index != 10 {
+		t.Fatalf("index %d, want 10", index)
+	}
+	want := "[10.0.0.1:80(p0,w1) 10.0.0.2:80(p1,w5) 10.0.0.3:81(p0,w2) 10.0.0.4:82(p0,w3)]"
+	if got := addresses(list); got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+
+	query := fake.lastQuery()
+	if query.Get("passing") != "1" || query.Get("tag") != "v1" || query.Get("dc") != "dc1" {
+		t.Fatalf("query %v", query)
+	}
+	if query.Get("index") != "" || query.Get("token") != "" {
+		t.Fatalf("first query %v must not block or carry token", query)
+	}
+	if fake.tokens[0] != "secret" {
+		t.Fatalf("token header %q", fake.tokens[0])
+	}
+}
+
+func TestConsulBlockingQuery(t *testing.T) {
+	fake, server := newFakeConsul(10, `[]`)
+	defer server.Close()
+
+	watcher, err := newConsulWatcher(consulEntry(server, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 索引没有变化时返回errNoChange并保持原索引
+	_, index, err := watcher.Wait(context.Background(), 10)
+	if err != errNoChange || index != 10 {
+		t.Fatalf("unchanged index got %d, %v", index, err)
+	}
+	query := fake.lastQuery()
+	if query.Get("index") != "10" || query.Get("wait") != consulWait.String() {
+		t.Fatalf("blocking query %v", query)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		fake.update(11, `[{"Node": {"Address": "10.0.0.1"}, "Service": {"Port": 80}}]`)
+	}()
+	list, index, err := watcher.Wait(context.Background(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index != 11 || addresses(list) != "[10.0.0.1:80(p0,w1)]" {
+		t.Fatalf("changed got %d %s", index, addresses(list))
+	}
+
+	// 索引回退时从0重新开始
+	fake.update(3, `[]`)
+	_, index, err = watcher.Wait(context.Background(), 11)
+	if err != nil || index != 0 {
+		t.Fatalf("index reset got %d, %v", index, err)
+	}
+}
+
+func TestConsulError(t *testing.T) {
+	fake, server := newFakeConsul(10, "no cluster leader")
+	defer server.Close()
+	fake.status = http.StatusInternalServerError
+
+	watcher, err := newConsulWatcher(consulEntry(server, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = watcher.Wait(context.Background(), 0)
+	if err == nil || !strings.Contains(err.Error(), "no cluster leader") {
+		t.Fatalf("expect status error, got %v", err)
+	}
+
+	if _, err := newConsulWatcher(CONSUL_PREFIX + "127.0.0.1:8500"); err == nil {
+		t.Fatal("expect error without service name")
+	}
+}
+
+func TestConsulPoolFollow(t *testing.T) {
+	fake, server := newFakeConsul(10, `[{"Node": {"Address": "10.0.0.1"}, "Service": {"Port": 80}}]`)
+	defer server.Close()
+
+	pool := NewPool([]string{consulEntry(server, "")}, 0)
+	if got := addresses(pool.Endpoints()); got != "[10.0.0.1:80(p0,w1)]" {
+		t.Fatalf("first resolve got %s", got)
+	}
+	updates := make(chan []Endpoint, 10)
+	pool.OnUpdate = func(list []Endpoint) {
+		updates <- list
+	}
+	pool.Start()
+	defer pool.Close()
+
+	time.Sleep(50 * time.Millisecond)
+	fake.update(12, `[{"Node": {"Address": "10.0.0.2"}, "Service": {"Port": 80}}]`)
+	select {
+	case list := <-updates:
+		if got := addresses(list); got != "[10.0.0.2:80(p0,w1)]" {
+			t.Fatalf("update got %s", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no update after consul index changed")
+	}
+	for start := time.Now(); fake.lastQuery().Get("index") != "12"; {
+		if time.Since(start) > time.Second {
+			t.Fatalf("follow must block on the new index, query %v", fake.lastQuery())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConsulMemberResolve(t *testing.T) {
+	_, server := newFakeConsul(10, `[{"Node": {"Address": "localhost"}, "Service": {"Port": 80}},
+	{"Node": {"Address": "10.0.0.1"}, "Service": {"Port": 81}}]`)
+	defer server.Close()
+
+	pool := NewPool([]string{consulEntry(server, "")}, 0)
+	defer pool.Close()
+
+	got := addresses(pool.Endpoints())
+	if strings.Contains(got, "localhost") || !strings.Contains(got, "10.0.0.1:81") {
+		t.Fatalf("consul member hostname must be resolved, got %s", got)
+	}
+	if !strings.Contains(got, "127.0.0.1:80") && !strings.Contains(got, "[::1]:80") {
+		t.Fatalf("localhost member missing, got %s", got)
+	}
+}
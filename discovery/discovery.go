@@ -0,0 +1,554 @@
+// Package discovery 提供后端地址的解析和动态更新，配置中的每一项可以是
+// IP地址、主机名、DNS SRV记录、成员列表文件、返回成员列表的HTTP地址，
+// 或者consul服务、etcd键前缀，解析结果展开为独立的后端成员，
+// 定期刷新或者监听变化，刷新时整体替换，不影响正在使用的监听。
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// SRV记录前缀，例如 srv:_mysql._tcp.example.com
+	SRV_PREFIX = "srv:"
+
+	defaultInterval = 30 * time.Second
+	resolveTimeout  = 10 * time.Second
+
+	fileCheckInterval = time.Second
+	watchRetry        = 5 * time.Second
+)
+
+// 日志输出，调用方可以替换为自己的日志组件
+var Logf = log.Printf
+
+// 阻塞等待超时且没有变化
+var errNoChange = errors.New("no change")
+
+// 支持监听变化的数据源，index为上一次返回的版本，为0时立即返回当前成员，
+// 否则阻塞直到版本变化，超时没有变化时返回errNoChange
+type Watcher interface {
+	Wait(ctx context.Context, index uint64) ([]Endpoint, uint64, error)
+}
+
+// consul和etcd配置项返回对应的Watcher，其他返回nil
+func NewWatcher(entry string) (Watcher, error) {
+	if strings.HasPrefix(entry, CONSUL_PREFIX) {
+		return newConsulWatcher(entry)
+	}
+	if strings.HasPrefix(entry, ETCD_PREFIX) {
+		return newEtcdWatcher(entry)
+	}
+	return nil, nil
+}
+
+// 解析后的后端成员，Priority越小越优先，同一优先级内按Weight分配
+type Endpoint struct {
+	Address  string `json:"address"`
+	Priority int    `json:"priority"`
+	Weight   int    `json:"weight"`
+	Source   string `json:"source"`
+}
+
+func (e Endpoint) String() string {
+	return fmt.Sprintf("%s(p%d,w%d)", e.Address, e.Priority, e.Weight)
+}
+
+// tls的ServerName，由主机名解析得到的成员使用配置中的主机名，其它使用成员地址中的IP
+func (e Endpoint) Host() string {
+	if !strings.HasPrefix(e.Source, SRV_PREFIX) && !IsProvider(e.Source) {
+		if host, _, err := net.SplitHostPort(e.Source); err == nil {
+			return host
+		}
+	}
+	host, _, _ := net.SplitHostPort(e.Address)
+	return host
+}
+
+// 配置项是否需要通过DNS解析
+func Dynamic(entry string) bool {
+	if strings.HasPrefix(entry, SRV_PREFIX) || IsProvider(entry) {
+		return true
+	}
+	host, _, err := net.SplitHostPort(entry)
+	if err != nil {
+		return false
+	}
+	return net.ParseIP(host) == nil
+}
+
+func lookupHost(ctx context.Context, resolver *net.Resolver, host string) ([]string, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []string{host}, nil
+	}
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	output := make([]string, 0, len(addrs))
+	for _, v := range addrs {
+		output = append(output, v.String())
+	}
+	return output, nil
+}
+
+// 监听的数据源返回的成员地址可能是主机名，与静态配置一样展开为IP，
+// 解析失败时保留原始地址，由拨号时解析
+func resolveMembers(ctx context.Context, resolver *net.Resolver, list []Endpoint) []Endpoint {
+	var output []Endpoint
+	for _, v := range list {
+		host, port, err := net.SplitHostPort(v.Address)
+		if err != nil || net.ParseIP(host) != nil {
+			output = append(output, v)
+			continue
+		}
+		hosts, err := lookupHost(ctx, resolver, host)
+		if err != nil {
+			Logf("resolve %s member %s failed, %s", v.Source, v.Address, err.Error())
+			output = append(output, v)
+			continue
+		}
+		for _, h := range hosts {
+			member := v
+			member.Address = net.JoinHostPort(h, port)
+			output = append(output, member)
+		}
+	}
+	return output
+}
+
+// 解析单个配置项，多个A/AAAA记录展开为多个成员
+func Resolve(ctx context.Context, resolver *net.Resolver, entry string) ([]Endpoint, error) {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	watcher, err := NewWatcher(entry)
+	if err != nil {
+		return nil, err
+	}
+	if watcher != nil {
+		list, _, err := watcher.Wait(ctx, 0)
+		if err != nil {
+			return nil, err
+		}
+		return resolveMembers(ctx, resolver, list), nil
+	}
+
+	if IsProvider(entry) {
+		return resolveProvider(ctx, resolver, entry)
+	}
+
+	if strings.HasPrefix(entry, SRV_PREFIX) {
+		_, records, err := resolver.LookupSRV(ctx, "", "", strings.TrimPrefix(entry, SRV_PREFIX))
+		if err != nil {
+			return nil, err
+		}
+		var output []Endpoint
+		for _, v := range records {
+			hosts, err := lookupHost(ctx, resolver, strings.TrimSuffix(v.Target, "."))
+			if err != nil {
+				Logf("resolve srv %s target %s failed, %s", entry, v.Target, err.Error())
+				continue
+			}
+			// 权重为0的记录按1处理，保证仍有机会被选中
+			weight := int(v.Weight)
+			if weight == 0 {
+				weight = 1
+			}
+			for _, host := range hosts {
+				output = append(output, Endpoint{
+					Address:  net.JoinHostPort(host, strconv.Itoa(int(v.Port))),
+					Priority: int(v.Priority),
+					Weight:   weight,
+					Source:   entry,
+				})
+			}
+		}
+		if len(output) == 0 {
+			return nil, fmt.Errorf("srv %s no usable target", entry)
+		}
+		return output, nil
+	}
+
+	host, port, err := net.SplitHostPort(entry)
+	if err != nil {
+		return nil, err
+	}
+	hosts, err := lookupHost(ctx, resolver, host)
+	if err != nil {
+		return nil, err
+	}
+	var output []Endpoint
+	for _, v := range hosts {
+		output = append(output, Endpoint{Address: net.JoinHostPort(v, port), Weight: 1, Source: entry})
+	}
+	return output, nil
+}
+
+// 动态后端列表，读取无锁，刷新时整体替换
+type Pool struct {
+	sync.Mutex
+
+	entries  []string
+	interval time.Duration
+	resolver *net.Resolver
+	value    atomic.Value
+	last     map[string][]Endpoint
+	watchers map[string]Watcher
+	index    map[string]uint64
+	stop     chan struct{}
+	cancel   context.CancelFunc
+	once     sync.Once
+	// 首次解析在Start后进行
+	pending bool
+
+	// 成员发生变化时回调
+	OnUpdate func(list []Endpoint)
+}
+
+// 创建时完成首次解析，interval为0时使用默认刷新间隔，小于0表示只解析一次
+func NewPool(entries []string, interval time.Duration) *Pool {
+	p := newPool(entries, interval)
+	p.resolve(context.Background())
+	return p
+}
+
+// 与NewPool相同，但首次解析在Start后于后台进行，完成后通过OnUpdate通知，
+// 用于不能阻塞的调用方，在此之前只有配置中的IP地址可用
+func NewPoolAsync(entries []string, interval time.Duration) *Pool {
+	p := newPool(entries, interval)
+	p.pending = true
+	for _, entry := range entries {
+		if !Dynamic(entry) {
+			p.last[entry] = []Endpoint{{Address: entry, Weight: 1, Source: entry}}
+		}
+	}
+	p.publish()
+	return p
+}
+
+func newPool(entries []string, interval time.Duration) *Pool {
+	p := &Pool{
+		entries:  entries,
+		interval: interval,
+		resolver: net.DefaultResolver,
+		last:     make(map[string][]Endpoint),
+		watchers: make(map[string]Watcher),
+		index:    make(map[string]uint64),
+	}
+	if p.interval == 0 {
+		p.interval = defaultInterval
+	}
+	return p
+}
+
+// 首次解析，创建监听的数据源并读取当前成员
+func (p *Pool) resolve(parent context.Context) {
+	ctx, cancel := context.WithTimeout(parent, resolveTimeout)
+	defer cancel()
+
+	for _, entry := range p.entries {
+		watcher, err := NewWatcher(entry)
+		if err != nil {
+			Logf("watch %s failed, %s", entry, err.Error())
+			continue
+		}
+		if watcher == nil {
+			continue
+		}
+		list, index, err := watcher.Wait(ctx, 0)
+		if err == nil {
+			list = resolveMembers(ctx, p.resolver, list)
+		}
+
+		p.Lock()
+		p.watchers[entry] = watcher
+		if err == nil {
+			p.last[entry], p.index[entry] = list, index
+		}
+		p.Unlock()
+		if err != nil {
+			Logf("watch %s failed, %s", entry, err.Error())
+		}
+	}
+
+	if parent.Err() == nil {
+		p.refresh()
+	}
+}
+
+// 启动定期刷新和变化监听，OnUpdate需要在此之前设置
+func (p *Pool) Start() {
+	if p.stop != nil {
+		return
+	}
+	p.stop = make(chan struct{})
+
+	var ctx context.Context
+	ctx, p.cancel = context.WithCancel(context.Background())
+	if !p.pending {
+		p.run(ctx)
+		return
+	}
+	go func() {
+		p.resolve(ctx)
+		if ctx.Err() == nil {
+			p.run(ctx)
+		}
+	}()
+}
+
+func (p *Pool) run(ctx context.Context) {
+	for entry, watcher := range p.watchers {
+		go p.follow(ctx, entry, watcher, p.index[entry])
+	}
+
+	dynamic := false
+	for _, v := range p.entries {
+		if Dynamic(v) && p.watchers[v] == nil {
+			dynamic = true
+		}
+	}
+	if dynamic && p.interval > 0 {
+		go p.watch()
+	}
+}
+
+// 持续监听单个数据源的变化，失败时间隔重试
+func (p *Pool) follow(ctx context.Context, entry string, watcher Watcher, index uint64) {
+	for {
+		start := time.Now()
+		list, next, err := watcher.Wait(ctx, index)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == errNoChange {
+			// 服务端没有阻塞时避免空转
+			if wait := time.Second - time.Since(start); wait > 0 {
+				time.Sleep(wait)
+			}
+			continue
+		}
+		if err != nil {
+			Logf("watch %s failed, %s", entry, err.Error())
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(watchRetry):
+			}
+			continue
+		}
+		index = next
+
+		resolveCtx, cancel := context.WithTimeout(ctx, resolveTimeout)
+		list = resolveMembers(resolveCtx, p.resolver, list)
+		cancel()
+
+		p.Lock()
+		p.last[entry] = list
+		p.publish()
+		p.Unlock()
+	}
+}
+
+func endpointsEqual(a, b []Endpoint) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// 解析失败时沿用上一次的结果，从未成功的主机名直接使用原始地址，由拨号时解析。
+// 每个配置项单独计算超时，解析过程不持有锁，避免慢的DNS阻塞监听数据源的更新
+func (p *Pool) refresh() {
+	var entries []string
+	p.Lock()
+	for _, entry := range p.entries {
+		// 监听的数据源由follow更新
+		if p.watchers[entry] == nil {
+			entries = append(entries, entry)
+		}
+	}
+	p.Unlock()
+
+	result := make(map[string][]Endpoint, len(entries))
+	for _, entry := range entries {
+		ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+		list, err := Resolve(ctx, p.resolver, entry)
+		cancel()
+		if err != nil {
+			Logf("resolve %s failed, %s", entry, err.Error())
+			continue
+		}
+		result[entry] = list
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	for _, entry := range entries {
+		list, ok := result[entry]
+		if ok {
+			p.last[entry] = list
+			continue
+		}
+		_, ok = p.last[entry]
+		if !ok && !strings.HasPrefix(entry, SRV_PREFIX) && !IsProvider(entry) {
+			p.last[entry] = []Endpoint{{Address: entry, Weight: 1, Source: entry}}
+		}
+	}
+	p.publish()
+}
+
+// 合并全部配置项的结果，有变化时替换并回调，需要持有锁调用
+func (p *Pool) publish() {
+	var output []Endpoint
+	for _, entry := range p.entries {
+		output = append(output, p.last[entry]...)
+	}
+	sort.SliceStable(output, func(i, j int) bool {
+		return output[i].Priority < output[j].Priority
+	})
+
+	old, _ := p.value.Load().([]Endpoint)
+	if old != nil && endpointsEqual(old, output) {
+		return
+	}
+	p.value.Store(output)
+	if old != nil {
+		Logf("backend update %v", output)
+	}
+	if p.OnUpdate != nil {
+		p.OnUpdate(output)
+	}
+}
+
+// 成员列表文件的修改时间，用于判断文件是否变化
+func (p *Pool) fileStamp() string {
+	var stamp []string
+	for _, v := range p.entries {
+		if !strings.HasPrefix(v, FILE_PREFIX) {
+			continue
+		}
+		info, err := os.Stat(strings.TrimPrefix(v, FILE_PREFIX))
+		if err != nil {
+			stamp = append(stamp, err.Error())
+			continue
+		}
+		stamp = append(stamp, fmt.Sprintf("%d-%d", info.ModTime().UnixNano(), info.Size()))
+	}
+	return strings.Join(stamp, ",")
+}
+
+func (p *Pool) watch() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	// 成员列表文件每秒检查一次，变化后立即刷新
+	stamp := p.fileStamp()
+	files := time.NewTicker(fileCheckInterval)
+	defer files.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.refresh()
+		case <-files.C:
+			if now := p.fileStamp(); now != stamp {
+				stamp = now
+				p.refresh()
+			}
+		}
+	}
+}
+
+// 当前全部成员，按优先级排序，调用方不能修改
+func (p *Pool) Endpoints() []Endpoint {
+	list, _ := p.value.Load().([]Endpoint)
+	return list
+}
+
+// 按优先级分组，优先级高的组全部不可用时才使用下一组
+func (p *Pool) Groups() [][]Endpoint {
+	return Groups(p.Endpoints())
+}
+
+// 按优先级分组，数值小的优先
+func Groups(list []Endpoint) [][]Endpoint {
+	list = append([]Endpoint(nil), list...)
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].Priority < list[j].Priority
+	})
+	var output [][]Endpoint
+	for i := 0; i < len(list); {
+		j := i
+		for j < len(list) && list[j].Priority == list[i].Priority {
+			j++
+		}
+		output = append(output, list[i:j])
+		i = j
+	}
+	return output
+}
+
+// 按权重轮询选择组内的起始成员，n为递增的计数，权重先按最大公约数约分，
+// 避免权重较大时连续选中同一个成员
+func Pick(group []Endpoint, n uint32) int {
+	total, div := 0, 0
+	for _, v := range group {
+		if v.Weight > 0 {
+			total += v.Weight
+			div = gcd(div, v.Weight)
+		}
+	}
+	if total <= 0 {
+		return int(n % uint32(len(group)))
+	}
+	offset := int(n % uint32(total/div))
+	for i, v := range group {
+		if v.Weight <= 0 {
+			continue
+		}
+		if offset < v.Weight/div {
+			return i
+		}
+		offset -= v.Weight / div
+	}
+	return 0
+}
+
+func gcd(m, n int) int {
+	for m != 0 {
+		m, n = n%m, m
+	}
+	return n
+}
+
+// 停止定期刷新，可以重复调用
+func (p *Pool) Close() {
+	if p == nil || p.stop == nil {
+		return
+	}
+	p.once.Do(func() {
+		p.cancel()
+		close(p.stop)
+	})
+}
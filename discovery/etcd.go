@@ -0,0 +1,202 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// etcd://127.0.0.1:2379/services/web/?scheme=https
+	ETCD_PREFIX = "etcd://"
+
+	etcdWait = 55 * time.Second
+)
+
+// 通过etcd v3的HTTP网关读取键前缀下的成员，值为地址字符串或者
+// {"address": "...", "weight": N, "priority": N}，变化通过watch接口感知
+type etcdWatcher struct {
+	entry    string
+	base     string
+	key      string
+	rangeEnd string
+	client   *http.Client
+}
+
+type etcdHeader struct {
+	Revision string `json:"revision"`
+}
+
+type etcdRange struct {
+	Header etcdHeader `json:"header"`
+	Kvs    []struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+	} `json:"kvs"`
+}
+
+type etcdWatch struct {
+	Result struct {
+		Header   etcdHeader        `json:"header"`
+		Created  bool              `json:"created"`
+		Canceled bool              `json:"canceled"`
+		Events   []json.RawMessage `json:"events"`
+	} `json:"result"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// 前缀查询的结束键，最后一个字节加一
+func etcdPrefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return "\x00"
+}
+
+func newEtcdWatcher(entry string) (*etcdWatcher, error) {
+	u, err := url.Parse(entry)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" || u.Path == "" {
+		return nil, fmt.Errorf("invalid etcd address %s", entry)
+	}
+	scheme := u.Query().Get("scheme")
+	if scheme == "" {
+		scheme = "http"
+	}
+	return &etcdWatcher{
+		entry:    entry,
+		base:     fmt.Sprintf("%s://%s", scheme, u.Host),
+		key:      base64.StdEncoding.EncodeToString([]byte(u.Path)),
+		rangeEnd: base64.StdEncoding.EncodeToString([]byte(etcdPrefixEnd(u.Path))),
+		client:   &http.Client{},
+	}, nil
+}
+
+func (w *etcdWatcher) post(ctx context.Context, path string, value interface{}) (*http.Response, error) {
+	body, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, w.base+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := w.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		return nil, fmt.Errorf("etcd status %s, %s", response.Status, strings.TrimSpace(string(body)))
+	}
+	return response, nil
+}
+
+func (w *etcdWatcher) list(ctx context.Context) ([]Endpoint, uint64, error) {
+	response, err := w.post(ctx, "/v3/kv/range", map[string]string{"key": w.key, "range_end": w.rangeEnd})
+	if err != nil {
+		return nil, 0, err
+	}
+	defer response.Body.Close()
+
+	var result etcdRange
+	err = json.NewDecoder(response.Body).Decode(&result)
+	if err != nil {
+		return nil, 0, err
+	}
+	revision, err := strconv.ParseUint(result.Header.Revision, 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("etcd revision invalid, %s", err.Error())
+	}
+
+	var output []Endpoint
+	for _, kv := range result.Kvs {
+		value, err := base64.StdEncoding.DecodeString(kv.Value)
+		if err != nil {
+			return nil, 0, err
+		}
+		var m Member
+		if json.Unmarshal(value, &m) != nil {
+			m.Address = strings.TrimSpace(string(value))
+		}
+		if m.Address == "" {
+			continue
+		}
+		if m.Weight <= 0 {
+			m.Weight = 1
+		}
+		output = append(output, Endpoint{Address: m.Address, Priority: m.Priority, Weight: m.Weight, Source: w.entry})
+	}
+	return output, revision, nil
+}
+
+// 等待键前缀下发生变化，超时返回errNoChange
+func (w *etcdWatcher) changed(ctx context.Context, index uint64) error {
+	ctx, cancel := context.WithTimeout(ctx, etcdWait)
+	defer cancel()
+
+	request := map[string]interface{}{
+		"create_request": map[string]interface{}{
+			"key":            w.key,
+			"range_end":      w.rangeEnd,
+			"start_revision": strconv.FormatUint(index+1, 10),
+		},
+	}
+	response, err := w.post(ctx, "/v3/watch", request)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return errNoChange
+		}
+		return err
+	}
+	defer response.Body.Close()
+
+	decoder := json.NewDecoder(response.Body)
+	for {
+		var event etcdWatch
+		err = decoder.Decode(&event)
+		if err != nil {
+			if ctx.Err() == context.DeadlineExceeded {
+				return errNoChange
+			}
+			return err
+		}
+		if event.Error != nil {
+			return fmt.Errorf("etcd watch %s", event.Error.Message)
+		}
+		if event.Result.Canceled {
+			return fmt.Errorf("etcd watch canceled")
+		}
+		if len(event.Result.Events) > 0 {
+			return nil
+		}
+	}
+}
+
+func (w *etcdWatcher) Wait(ctx context.Context, index uint64) ([]Endpoint, uint64, error) {
+	if index > 0 {
+		err := w.changed(ctx, index)
+		if err != nil {
+			return nil, index, err
+		}
+	}
+	return w.list(ctx)
+}
@@ -0,0 +1,258 @@
+package discovery
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 模拟etcd v3的HTTP网关，watch在start_revision之后有修改时返回事件，否则阻塞到修改
+type fakeEtcd struct {
+	sync.Mutex
+	revision uint64
+	values   map[string]string
+	// 每个键最后一次修改的版本
+	modified map[string]uint64
+	changed  chan struct{}
+	starts   []string
+	cancel   bool
+}
+
+func newFakeEtcd() (*fakeEtcd, *httptest.Server) {
+	f := &fakeEtcd{revision: 1, values: make(map[string]string),
+		modified: make(map[string]uint64), changed: make(chan struct{})}
+	return f, httptest.NewServer(f)
+}
+
+func (f *fakeEtcd) put(key string, value string) {
+	f.Lock()
+	defer f.Unlock()
+	f.revision++
+	f.values[key] = value
+	f.modified[key] = f.revision
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func etcdDecode(text string) string {
+	value, _ := base64.StdEncoding.DecodeString(text)
+	return string(value)
+}
+
+func etcdEncode(text string) string {
+	return base64.StdEncoding.EncodeToString([]byte(text))
+}
+
+func inRange(key string, start string, end string) bool {
+	return key >= start && key < end
+}
+
+func (f *fakeEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/v3/kv/range":
+		f.serveRange(w, r)
+	case "/v3/watch":
+		f.serveWatch(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeEtcd) serveRange(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Key      string `json:"key"`
+		RangeEnd string `json:"range_end"`
+	}
+	json.NewDecoder(r.Body).Decode(&request)
+	start, end := etcdDecode(request.Key), etcdDecode(request.RangeEnd)
+
+	f.Lock()
+	defer f.Unlock()
+	var keys []string
+	for k := range f.values {
+		if inRange(k, start, end) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	kvs := []map[string]string{}
+	for _, k := range keys {
+		kvs = append(kvs, map[string]string{"key": etcdEncode(k), "value": etcdEncode(f.values[k])})
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"header": map[string]string{"revision": strconv.FormatUint(f.revision, 10)},
+		"kvs":    kvs,
+	})
+}
+
+func (f *fakeEtcd) serveWatch(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Create struct {
+			Key           string `json:"key"`
+			RangeEnd      string `json:"range_end"`
+			StartRevision string `json:"start_revision"`
+		} `json:"create_request"`
+	}
+	json.NewDecoder(r.Body).Decode(&request)
+	start, end := etcdDecode(request.Create.Key), etcdDecode(request.Create.RangeEnd)
+	from, _ := strconv.ParseUint(request.Create.StartRevision, 10, 64)
+
+	f.Lock()
+	f.starts = append(f.starts, request.Create.StartRevision)
+	cancel := f.cancel
+	f.Unlock()
+
+	fmt.Fprintln(w, `{"result": {"header": {"revision": "1"}, "created": true}}`)
+	w.(http.Flusher).Flush()
+	if cancel {
+		fmt.Fprintln(w, `{"result": {"canceled": true}}`)
+		return
+	}
+
+	for {
+		f.Lock()
+		var events []string
+		for k, rev := range f.modified {
+			if rev >= from && inRange(k, start, end) {
+				events = append(events, fmt.Sprintf(`{"kv": {"key": "%s"}}`, etcdEncode(k)))
+			}
+		}
+		changed := f.changed
+		f.Unlock()
+
+		if len(events) > 0 {
+			fmt.Fprintf(w, `{"result": {"events": [%s]}}`+"\n", strings.Join(events, ","))
+			return
+		}
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (f *fakeEtcd) lastStart() string {
+	f.Lock()
+	defer f.Unlock()
+	return f.starts[len(f.starts)-1]
+}
+
+func etcdEntry(server *httptest.Server, prefix string) string {
+	return ETCD_PREFIX + strings.TrimPrefix(server.URL, "http://") + prefix
+}
+
+func TestEtcdList(t *testing.T) {
+	fake, server := newFakeEtcd()
+	defer server.Close()
+	fake.put("/services/web/a", "10.0.0.1:80")
+	fake.put("/services/web/b", `{"address": "10.0.0.2:80", "weight": 3, "priority": 1}`)
+	fake.put("/services/web/c", "")
+	fake.put("/services/web0", "10.0.0.8:80")
+	fake.put("/services/api/a", "10.0.0.9:80")
+
+	watcher, err := newEtcdWatcher(etcdEntry(server, "/services/web/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, revision, err := watcher.Wait(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revision != 6 {
+		t.Fatalf("revision %d, want 6", revision)
+	}
+	if got := addresses(list); got != "[10.0.0.1:80(p0,w1) 10.0.0.2:80(p1,w3)]" {
+		t.Fatalf("got %s", got)
+	}
+}
+
+func TestEtcdWatchRevision(t *testing.T) {
+	fake, server := newFakeEtcd()
+	defer server.Close()
+	fake.put("/services/web/a", "10.0.0.1:80")
+
+	watcher, err := newEtcdWatcher(etcdEntry(server, "/services/web/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, revision, err := watcher.Wait(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 前缀之外的修改不会唤醒watch
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		fake.put("/services/api/a", "10.0.0.9:80")
+		time.Sleep(50 * time.Millisecond)
+		fake.put("/services/web/b", "10.0.0.2:80")
+	}()
+	start := time.Now()
+	list, next, err := watcher.Wait(context.Background(), revision)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) < 100*time.Millisecond {
+		t.Fatal("watch returned before a key under the prefix changed")
+	}
+	if got := fake.lastStart(); got != strconv.FormatUint(revision+1, 10) {
+		t.Fatalf("watch start revision %s, want %d", got, revision+1)
+	}
+	if next != 4 || addresses(list) != "[10.0.0.1:80(p0,w1) 10.0.0.2:80(p0,w1)]" {
+		t.Fatalf("changed got %d %s", next, addresses(list))
+	}
+
+	// 上一次读取之后已经发生的修改不会丢失
+	fake.put("/services/web/c", "10.0.0.3:80")
+	list, next, err = watcher.Wait(context.Background(), next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next != 5 || len(list) != 3 {
+		t.Fatalf("missed change got %d %s", next, addresses(list))
+	}
+}
+
+func TestEtcdWatchCanceled(t *testing.T) {
+	fake, server := newFakeEtcd()
+	defer server.Close()
+	fake.cancel = true
+
+	watcher, err := newEtcdWatcher(etcdEntry(server, "/services/web/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, index, err := watcher.Wait(context.Background(), 1)
+	if err == nil || index != 1 {
+		t.Fatalf("canceled watch got %d, %v", index, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := watcher.Wait(ctx, 0); err == nil {
+		t.Fatal("expect error with canceled context")
+	}
+}
+
+func TestEtcdPrefixEnd(t *testing.T) {
+	cases := map[string]string{
+		"/services/web/": "/services/web0",
+		"a\xff":          "b",
+		"\xff\xff":       "\x00",
+	}
+	for prefix, want := range cases {
+		if got := etcdPrefixEnd(prefix); got != want {
+			t.Errorf("prefix %q end %q, want %q", prefix, got, want)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	// 成员列表文件前缀，例如 file:endpoints.yaml，文件变化时立即刷新
+	FILE_PREFIX = "file:"
+)
+
+// 文件或HTTP返回的成员，可以直接写地址字符串，也可以带权重和优先级
+type Member struct {
+	Address  string `json:"address" yaml:"address"`
+	Weight   int    `json:"weight" yaml:"weight"`
+	Priority int    `json:"priority" yaml:"priority"`
+}
+
+type member Member
+
+func (m *Member) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var address string
+	if err := unmarshal(&address); err == nil {
+		m.Address = address
+		return nil
+	}
+	return unmarshal((*member)(m))
+}
+
+func (m *Member) UnmarshalJSON(body []byte) error {
+	var address string
+	if err := json.Unmarshal(body, &address); err == nil {
+		m.Address = address
+		return nil
+	}
+	return json.Unmarshal(body, (*member)(m))
+}
+
+// 成员列表，支持顶层数组或者 {"endpoints": [...]} 两种格式
+type memberList []Member
+
+func (l *memberList) decode(body []byte) error {
+	var wrapper struct {
+		Endpoints []Member `json:"endpoints" yaml:"endpoints"`
+	}
+	text := strings.TrimSpace(string(body))
+	if strings.HasPrefix(text, "{") || strings.HasPrefix(text, "[") {
+		if strings.HasPrefix(text, "{") {
+			err := json.Unmarshal(body, &wrapper)
+			*l = wrapper.Endpoints
+			return err
+		}
+		return json.Unmarshal(body, (*[]Member)(l))
+	}
+	if err := yaml.Unmarshal(body, (*[]Member)(l)); err == nil {
+		return nil
+	}
+	err := yaml.Unmarshal(body, &wrapper)
+	*l = wrapper.Endpoints
+	return err
+}
+
+// 配置项是否为成员列表文件、HTTP地址或者consul、etcd
+func IsProvider(entry string) bool {
+	return strings.HasPrefix(entry, FILE_PREFIX) ||
+		strings.HasPrefix(entry, "http://") || strings.HasPrefix(entry, "https://") ||
+		strings.HasPrefix(entry, CONSUL_PREFIX) || strings.HasPrefix(entry, ETCD_PREFIX)
+}
+
+func loadMembers(ctx context.Context, entry string) ([]Member, error) {
+	var body []byte
+	var err error
+
+	if strings.HasPrefix(entry, FILE_PREFIX) {
+		body, err = ioutil.ReadFile(strings.TrimPrefix(entry, FILE_PREFIX))
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, entry, nil)
+		if err != nil {
+			return nil, err
+		}
+		request.Header.Set("Accept", "application/json, application/yaml")
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			return nil, err
+		}
+		defer response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("http status %s", response.Status)
+		}
+		body, err = ioutil.ReadAll(response.Body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var list memberList
+	err = list.decode(body)
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// 从文件或HTTP获取成员列表，成员地址同样按主机名或SRV展开
+func resolveProvider(ctx context.Context, resolver *net.Resolver, entry string) ([]Endpoint, error) {
+	members, err := loadMembers(ctx, entry)
+	if err != nil {
+		return nil, err
+	}
+	var output []Endpoint
+	for _, m := range members {
+		if m.Address == "" || IsProvider(m.Address) {
+			return nil, fmt.Errorf("invalid member address %q", m.Address)
+		}
+		list, err := Resolve(ctx, resolver, m.Address)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range list {
+			if m.Weight > 0 {
+				v.Weight = m.Weight
+			}
+			if m.Priority > 0 {
+				v.Priority = m.Priority
+			}
+			v.Source = entry
+			output = append(output, v)
+		}
+	}
+	return output, nil
+}
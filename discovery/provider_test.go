@@ -0,0 +1,155 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 返回可修改内容和状态码的成员列表接口
+type stubProvider struct {
+	sync.Mutex
+	status int
+	body   string
+	hits   int
+}
+
+func (s *stubProvider) set(status int, body string) {
+	s.Lock()
+	defer s.Unlock()
+	s.status, s.body = status, body
+}
+
+func (s *stubProvider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	s.hits++
+	w.WriteHeader(s.status)
+	fmt.Fprint(w, s.body)
+}
+
+func newStubProvider(body string) (*stubProvider, *httptest.Server) {
+	stub := &stubProvider{status: http.StatusOK, body: body}
+	return stub, httptest.NewServer(stub)
+}
+
+func addresses(list []Endpoint) string {
+	var output []string
+	for _, v := range list {
+		output = append(output, v.String())
+	}
+	return fmt.Sprint(output)
+}
+
+func TestProviderParse(t *testing.T) {
+	cases := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"json strings", `["10.0.0.1:80", "10.0.0.2:80"]`, "[10.0.0.1:80(p0,w1) 10.0.0.2:80(p0,w1)]"},
+		{"json objects", `[{"address": "10.0.0.1:80", "weight": 3, "priority": 2}]`, "[10.0.0.1:80(p2,w3)]"},
+		{"json wrapper", `{"endpoints": ["10.0.0.1:80", {"address": "10.0.0.2:80", "weight": 2}]}`,
+			"[10.0.0.1:80(p0,w1) 10.0.0.2:80(p0,w2)]"},
+		{"yaml list", "- 10.0.0.1:80\n- address: 10.0.0.2:80\n  priority: 1\n", "[10.0.0.1:80(p0,w1) 10.0.0.2:80(p1,w1)]"},
+		{"yaml wrapper", "endpoints:\n  - 10.0.0.1:80\n", "[10.0.0.1:80(p0,w1)]"},
+	}
+	for _, c := range cases {
+		_, server := newStubProvider(c.body)
+		list, err := Resolve(context.Background(), nil, server.URL)
+		server.Close()
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err.Error())
+			continue
+		}
+		if got := addresses(list); got != c.want {
+			t.Errorf("%s: got %s, want %s", c.name, got, c.want)
+		}
+		for _, v := range list {
+			if v.Source != server.URL {
+				t.Errorf("%s: source %s, want %s", c.name, v.Source, server.URL)
+			}
+		}
+	}
+}
+
+func TestProviderError(t *testing.T) {
+	cases := []struct {
+		name   string
+		status int
+		body   string
+	}{
+		{"status", http.StatusInternalServerError, `["10.0.0.1:80"]`},
+		{"syntax", http.StatusOK, `["10.0.0.1:80"`},
+		{"empty address", http.StatusOK, `[""]`},
+		{"nested provider", http.StatusOK, `["http://127.0.0.1/list"]`},
+		{"bad address", http.StatusOK, `["10.0.0.1"]`},
+	}
+	for _, c := range cases {
+		stub, server := newStubProvider(c.body)
+		stub.set(c.status, c.body)
+		_, err := Resolve(context.Background(), nil, server.URL)
+		server.Close()
+		if err == nil {
+			t.Errorf("%s: expect error", c.name)
+		}
+	}
+}
+
+func TestProviderPolling(t *testing.T) {
+	stub, server := newStubProvider(`["10.0.0.1:80"]`)
+	defer server.Close()
+
+	pool := NewPool([]string{server.URL}, 50*time.Millisecond)
+	if got := addresses(pool.Endpoints()); got != "[10.0.0.1:80(p0,w1)]" {
+		t.Fatalf("first resolve got %s", got)
+	}
+
+	updates := make(chan []Endpoint, 10)
+	pool.OnUpdate = func(list []Endpoint) {
+		updates <- list
+	}
+	pool.Start()
+	defer pool.Close()
+
+	// 接口出错时沿用上一次的结果
+	stub.set(http.StatusServiceUnavailable, "")
+	time.Sleep(200 * time.Millisecond)
+	select {
+	case list := <-updates:
+		t.Fatalf("unexpected update %s on error", addresses(list))
+	default:
+	}
+	if got := addresses(pool.Endpoints()); got != "[10.0.0.1:80(p0,w1)]" {
+		t.Fatalf("keep last result on error, got %s", got)
+	}
+
+	stub.set(http.StatusOK, `["10.0.0.1:80", "10.0.0.2:80"]`)
+	select {
+	case list := <-updates:
+		if got := addresses(list); got != "[10.0.0.1:80(p0,w1) 10.0.0.2:80(p0,w1)]" {
+			t.Fatalf("update got %s", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no update after provider changed")
+	}
+
+	stub.Lock()
+	hits := stub.hits
+	stub.Unlock()
+	if hits < 3 {
+		t.Fatalf("provider polled %d times", hits)
+	}
+}
+
+func TestPoolCloseTwice(t *testing.T) {
+	pool := NewPool([]string{"127.0.0.1:80"}, time.Second)
+	pool.Close()
+	pool.Start()
+	pool.Close()
+	pool.Close()
+}
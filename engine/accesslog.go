@@ -0,0 +1,179 @@
+package engine
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"github.com/lixiangyun/tcpproxy/proxy"
+	"log"
+	"text/template"
+	"time"
+)
+
+// 连接关闭或者被拒绝时输出的访问日志记录
+type AccessRecord struct {
+	Time       time.Time `json:"time"`
+	Start      time.Time `json:"start"`
+	Listener   string    `json:"listener"`
+	Client     string    `json:"client"`
+	Backend    string    `json:"backend"`
+	TlsVersion string    `json:"tls_version,omitempty"`
+	TlsSNI     string    `json:"tls_sni,omitempty"`
+	TlsPeer    string    `json:"tls_peer,omitempty"`
+	Up         int64     `json:"up"`
+	Down       int64     `json:"down"`
+	Duration   float64   `json:"duration"`
+	Reason     string    `json:"reason"`
+	Error      string    `json:"error,omitempty"`
+
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+type AccessLog struct {
+	format   string
+	template *template.Template
+	writer   *RotateWriter
+}
+
+var accessLog *AccessLog
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS1.0"
+	case tls.VersionTLS11:
+		return "TLS1.1"
+	case tls.VersionTLS12:
+		return "TLS1.2"
+	case tls.VersionTLS13:
+		return "TLS1.3"
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
+func NewAccessRecord(session *proxy.Session) *AccessRecord {
+	now := time.Now()
+	up, down := session.Flows()
+
+	record := &AccessRecord{
+		Time:     now,
+		Start:    session.Start,
+		Listener: session.Listener,
+		Client:   session.Client,
+		Backend:  session.Backend,
+		Up:       up,
+		Down:     down,
+		Duration: now.Sub(session.Start).Seconds(),
+		Reason:   session.Reason(),
+		Tags:     session.Tags,
+	}
+
+	conn, ok := session.ClientConn().(*tls.Conn)
+	if ok {
+		state := conn.ConnectionState()
+		if state.HandshakeComplete {
+			record.TlsVersion = tlsVersionName(state.Version)
+			record.TlsSNI = state.ServerName
+			if len(state.PeerCertificates) > 0 {
+				record.TlsPeer = state.PeerCertificates[0].Subject.String()
+			}
+		}
+	}
+
+	return record
+}
+
+// 没有建立会话的连接，访问控制或者封禁拒绝时为denied，后端连接失败时为connect_error，
+// 其它为rejected，具体原因记录在Error中
+func NewRejectRecord(info *proxy.ConnInfo, err error) *AccessRecord {
+	now := time.Now()
+	record := &AccessRecord{
+		Time:     now,
+		Start:    now,
+		Listener: info.Listener,
+		Client:   info.Conn.RemoteAddr().String(),
+		Backend:  info.Endpoint.Address,
+		Reason:   REASON_REJECTED,
+		Error:    err.Error(),
+		Tags:     info.Tags,
+	}
+	if ae, ok := err.(*proxy.AdmitError); ok && ae.Deny {
+		record.Reason = REASON_DENIED
+	} else if err == proxy.ErrNoBackend || info.Endpoint.Address != "" {
+		record.Reason = REASON_CONNECT_ERROR
+	}
+	return record
+}
+
+func AccessLogInit(cfg *AccessLogConfig) error {
+	if cfg == nil || cfg.Path == "" {
+		return nil
+	}
+
+	output := &AccessLog{format: cfg.Format}
+	switch cfg.Format {
+	case "", "json":
+		output.format = "json"
+	case "template":
+		temp, err := template.New("accesslog").Parse(cfg.Template)
+		if err != nil {
+			return err
+		}
+		output.template = temp
+	default:
+		return fmt.Errorf("access log format %s not support", cfg.Format)
+	}
+
+	writer, err := NewRotateWriter(cfg.Path, cfg.MaxSize*1024*1024, cfg.Rotate, cfg.MaxBackups)
+	if err != nil {
+		return err
+	}
+	output.writer = writer
+
+	accessLog = output
+	return nil
+}
+
+func (a *AccessLog) Write(record *AccessRecord) {
+	var buf bytes.Buffer
+
+	if a.template != nil {
+		err := a.template.Execute(&buf, record)
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+	} else {
+		err := json.NewEncoder(&buf).Encode(record)
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+	}
+
+	if buf.Len() == 0 || buf.Bytes()[buf.Len()-1] != '\n' {
+		buf.WriteByte('\n')
+	}
+
+	_, err := a.writer.Write(buf.Bytes())
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// 会话结束时写访问日志，未配置则忽略
+func AccessLogWrite(session *proxy.Session) {
+	if accessLog == nil {
+		return
+	}
+	accessLog.Write(NewAccessRecord(session))
+}
+
+// 连接被拒绝或者后端连接失败时写访问日志，未配置则忽略
+func AccessLogReject(info *proxy.ConnInfo, err error) {
+	if accessLog == nil {
+		return
+	}
+	accessLog.Write(NewRejectRecord(info, err))
+}
@@ -0,0 +1,101 @@
+package engine
+
+import (
+	"encoding/json"
+	"github.com/lixiangyun/tcpproxy/proxy"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+func adminWrite(w http.ResponseWriter, code int, value interface{}) {
+	body, err := json.Marshal(value)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(body)
+}
+
+func adminError(w http.ResponseWriter, code int, err error) {
+	adminWrite(w, code, map[string]string{"error": err.Error()})
+}
+
+// GET /sessions 获取当前全部会话
+func adminSessions(p *proxy.Proxy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		adminWrite(w, http.StatusOK, SessionList(p))
+	}
+}
+
+// POST /sessions/close?id=N 强制关闭指定会话
+func adminSessionClose(p *proxy.Proxy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+		if err != nil {
+			adminError(w, http.StatusBadRequest, err)
+			return
+		}
+		err = SessionClose(p, id)
+		if err != nil {
+			adminError(w, http.StatusNotFound, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// GET /bans 获取当前全部封禁
+func adminBans(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	adminWrite(w, http.StatusOK, banTable.List())
+}
+
+// POST /bans/clear?ip=X 解除指定IP的封禁，不带ip时解除全部
+func adminBanClear(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	cnt, err := banTable.Clear(r.URL.Query().Get("ip"))
+	if err != nil {
+		adminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	adminWrite(w, http.StatusOK, map[string]int{"cleared": cnt})
+}
+
+// 管理接口启动入口，address为空则不启动
+func AdminStart(address string, p *proxy.Proxy) {
+	if address == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sessions", adminSessions(p))
+	mux.HandleFunc("/sessions/close", adminSessionClose(p))
+	mux.HandleFunc("/bans", adminBans)
+	mux.HandleFunc("/bans/clear", adminBanClear)
+
+	log.Printf("admin listen : %s", address)
+
+	go func() {
+		err := http.ListenAndServe(address, mux)
+		if err != nil {
+			log.Fatalf("admin start failed %s.", err.Error())
+		}
+	}()
+}
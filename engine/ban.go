@@ -0,0 +1,29 @@
+package engine
+
+import (
+	"github.com/lixiangyun/tcpproxy/ban"
+	"log"
+	"time"
+)
+
+// 全部监听共享的封禁表
+var banTable *ban.Table
+
+func BanInit(path string) error {
+	table, err := ban.NewTable(path)
+	if err != nil {
+		return err
+	}
+	banTable = table
+	if list := table.List(); len(list) > 0 {
+		log.Printf("restore %d bans from %s", len(list), path)
+	}
+	return nil
+}
+
+func banLog(item ban.Ban, err error) {
+	log.Printf("ban %s on %s until %s, %s", item.IP, item.Listener, item.Until.Format(time.RFC3339), item.Reason)
+	if err != nil {
+		log.Printf("ban save failed %s", err.Error())
+	}
+}
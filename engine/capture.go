@@ -0,0 +1,252 @@
+package engine
+
+import (
+	"encoding/binary"
+	"github.com/lixiangyun/tcpproxy/proxy"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	pcapMagic       = 0xa1b2c3d4
+	pcapSnapLen     = 65535
+	pcapLinkTypeRaw = 101
+
+	tcpFlagFin = 0x01
+	tcpFlagSyn = 0x02
+	tcpFlagPsh = 0x08
+	tcpFlagAck = 0x10
+
+	// 单个报文承载的最大数据长度，保证IPv4总长度不溢出
+	captureSegment = 65000
+)
+
+// 监听端口的抓包配置，输出为pcap文件
+type Capture struct {
+	writer *RotateWriter
+	nets   []*net.IPNet
+}
+
+// 解析CIDR列表
+func ParseCIDRs(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, v := range list {
+		_, ipnet, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+// 判断地址是否在CIDR列表中，列表为空视为全部匹配
+func MatchCIDRs(nets []*net.IPNet, ip net.IP) bool {
+	if len(nets) == 0 {
+		return true
+	}
+	for _, v := range nets {
+		if v.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func NewCapture(cfg *CaptureConfig) (*Capture, error) {
+	nets, err := ParseCIDRs(cfg.CIDR)
+	if err != nil {
+		return nil, err
+	}
+
+	capture := &Capture{nets: nets}
+
+	writer, err := NewRotateWriter(cfg.Path, cfg.MaxSize*1024*1024, 0, cfg.MaxBackups)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(header[20:], pcapLinkTypeRaw)
+
+	err = writer.Header(header)
+	if err != nil {
+		writer.Close()
+		return nil, err
+	}
+
+	capture.writer = writer
+	return capture, nil
+}
+
+// 为会话创建抓包旁路，客户端地址不在过滤范围内则返回nil
+func (c *Capture) NewTap(session *proxy.Session) proxy.Tap {
+	client, ok1 := session.ClientConn().RemoteAddr().(*net.TCPAddr)
+	backend, ok2 := session.BackendConn().RemoteAddr().(*net.TCPAddr)
+	if !ok1 || !ok2 || !MatchCIDRs(c.nets, client.IP) {
+		return nil
+	}
+
+	tap := &captureTap{
+		capture: c,
+		client:  client,
+		backend: backend,
+		seqUp:   uint32(time.Now().UnixNano()),
+		seqDown: uint32(time.Now().UnixNano() >> 16),
+	}
+
+	// 构造三次握手，便于wireshark识别会话
+	tap.packet(true, tcpFlagSyn, nil)
+	tap.seqUp++
+	tap.packet(false, tcpFlagSyn|tcpFlagAck, nil)
+	tap.seqDown++
+	tap.packet(true, tcpFlagAck, nil)
+
+	return tap
+}
+
+type captureTap struct {
+	sync.Mutex
+
+	capture *Capture
+	client  *net.TCPAddr
+	backend *net.TCPAddr
+	seqUp   uint32
+	seqDown uint32
+}
+
+func (t *captureTap) Data(up bool, body []byte) {
+	t.Lock()
+	defer t.Unlock()
+
+	for len(body) > 0 {
+		cnt := len(body)
+		if cnt > captureSegment {
+			cnt = captureSegment
+		}
+		t.packet(up, tcpFlagPsh|tcpFlagAck, body[:cnt])
+		if up {
+			t.seqUp += uint32(cnt)
+		} else {
+			t.seqDown += uint32(cnt)
+		}
+		body = body[cnt:]
+	}
+}
+
+func (t *captureTap) Close() {
+	t.Lock()
+	defer t.Unlock()
+
+	t.packet(true, tcpFlagFin|tcpFlagAck, nil)
+	t.seqUp++
+	t.packet(false, tcpFlagFin|tcpFlagAck, nil)
+	t.seqDown++
+	t.packet(true, tcpFlagAck, nil)
+}
+
+func (t *captureTap) packet(up bool, flags byte, payload []byte) {
+	src, dst := t.client, t.backend
+	seq, ack := t.seqUp, t.seqDown
+	if !up {
+		src, dst = t.backend, t.client
+		seq, ack = t.seqDown, t.seqUp
+	}
+	if flags&tcpFlagAck == 0 {
+		ack = 0
+	}
+
+	tcp := make([]byte, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(tcp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+	copy(tcp[20:], payload)
+
+	var ip []byte
+	srcip, dstip := src.IP.To4(), dst.IP.To4()
+	if srcip != nil && dstip != nil {
+		ip = ipv4Header(srcip, dstip, tcp)
+	} else {
+		ip = ipv6Header(src.IP.To16(), dst.IP.To16(), tcp)
+	}
+
+	now := time.Now()
+	record := make([]byte, 16, 16+len(ip)+len(tcp))
+	binary.LittleEndian.PutUint32(record[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(record[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:], uint32(len(ip)+len(tcp)))
+	binary.LittleEndian.PutUint32(record[12:], uint32(len(ip)+len(tcp)))
+	record = append(record, ip...)
+	record = append(record, tcp...)
+
+	_, err := t.capture.writer.Write(record)
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+func checksum(sum uint32, body []byte) uint32 {
+	for i := 0; i+1 < len(body); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(body[i:]))
+	}
+	if len(body)%2 == 1 {
+		sum += uint32(body[len(body)-1]) << 8
+	}
+	return sum
+}
+
+func checksumFold(sum uint32) uint16 {
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
+
+func ipv4Header(src, dst net.IP, tcp []byte) []byte {
+	header := make([]byte, 20)
+	header[0] = 0x45
+	binary.BigEndian.PutUint16(header[2:], uint16(20+len(tcp)))
+	header[8] = 64
+	header[9] = 6
+	copy(header[12:], src)
+	copy(header[16:], dst)
+	binary.BigEndian.PutUint16(header[10:], checksumFold(checksum(0, header)))
+
+	pseudo := make([]byte, 12)
+	copy(pseudo[0:], src)
+	copy(pseudo[4:], dst)
+	pseudo[9] = 6
+	binary.BigEndian.PutUint16(pseudo[10:], uint16(len(tcp)))
+	binary.BigEndian.PutUint16(tcp[16:], checksumFold(checksum(checksum(0, pseudo), tcp)))
+
+	return header
+}
+
+func ipv6Header(src, dst net.IP, tcp []byte) []byte {
+	header := make([]byte, 40)
+	header[0] = 0x60
+	binary.BigEndian.PutUint16(header[4:], uint16(len(tcp)))
+	header[6] = 6
+	header[7] = 64
+	copy(header[8:], src)
+	copy(header[24:], dst)
+
+	pseudo := make([]byte, 40)
+	copy(pseudo[0:], src)
+	copy(pseudo[16:], dst)
+	binary.BigEndian.PutUint32(pseudo[32:], uint32(len(tcp)))
+	pseudo[39] = 6
+	binary.BigEndian.PutUint16(tcp[16:], checksumFold(checksum(checksum(0, pseudo), tcp)))
+
+	return header
+}
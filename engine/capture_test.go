@@ -0,0 +1,173 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// pcap中的单个报文
+type pcapPacket struct {
+	ip      []byte
+	tcp     []byte
+	payload []byte
+}
+
+// 解析pcap文件，校验全局头和每条记录的长度
+func decodePcap(t *testing.T, path string) []pcapPacket {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(body) < 24 {
+		t.Fatalf("pcap %d bytes, missing global header", len(body))
+	}
+	header := body[:24]
+	if binary.LittleEndian.Uint32(header[0:]) != pcapMagic ||
+		binary.LittleEndian.Uint16(header[4:]) != 2 || binary.LittleEndian.Uint16(header[6:]) != 4 ||
+		binary.LittleEndian.Uint32(header[16:]) != pcapSnapLen ||
+		binary.LittleEndian.Uint32(header[20:]) != pcapLinkTypeRaw {
+		t.Fatalf("invalid global header %x", header)
+	}
+
+	var output []pcapPacket
+	for body = body[24:]; len(body) > 0; {
+		if len(body) < 16 {
+			t.Fatalf("truncated record header %x", body)
+		}
+		incl := binary.LittleEndian.Uint32(body[8:])
+		orig := binary.LittleEndian.Uint32(body[12:])
+		if incl != orig || incl > pcapSnapLen || int(incl) > len(body)-16 {
+			t.Fatalf("invalid record length %d/%d, left %d", incl, orig, len(body)-16)
+		}
+		packet := body[16 : 16+incl]
+		body = body[16+incl:]
+
+		var ip, pseudo []byte
+		switch packet[0] >> 4 {
+		case 4:
+			ip = packet[:20]
+			if binary.BigEndian.Uint16(ip[2:]) != uint16(len(packet)) {
+				t.Fatalf("ipv4 total length %d, record %d", binary.BigEndian.Uint16(ip[2:]), len(packet))
+			}
+			if checksumFold(checksum(0, ip)) != 0 {
+				t.Fatalf("ipv4 header checksum invalid %x", ip)
+			}
+			pseudo = make([]byte, 12)
+			copy(pseudo[0:], ip[12:20])
+			pseudo[9] = 6
+			binary.BigEndian.PutUint16(pseudo[10:], uint16(len(packet)-20))
+		case 6:
+			ip = packet[:40]
+			if int(binary.BigEndian.Uint16(ip[4:])) != len(packet)-40 {
+				t.Fatalf("ipv6 payload length %d, record %d", binary.BigEndian.Uint16(ip[4:]), len(packet))
+			}
+			pseudo = make([]byte, 40)
+			copy(pseudo[0:], ip[8:40])
+			binary.BigEndian.PutUint32(pseudo[32:], uint32(len(packet)-40))
+			pseudo[39] = 6
+		default:
+			t.Fatalf("unknown ip version %x", packet[0])
+		}
+
+		tcp := packet[len(ip):]
+		if checksumFold(checksum(checksum(0, pseudo), tcp)) != 0 {
+			t.Fatalf("tcp checksum invalid, ip %x", ip)
+		}
+		output = append(output, pcapPacket{ip: ip, tcp: tcp, payload: tcp[20:]})
+	}
+	return output
+}
+
+func captureTest(t *testing.T, client, backend *net.TCPAddr, bodies ...[]byte) []pcapPacket {
+	dir, err := ioutil.TempDir("", "capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.pcap")
+
+	capture, err := NewCapture(&CaptureConfig{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tap := &captureTap{capture: capture, client: client, backend: backend, seqUp: 1000, seqDown: 5000}
+	for i, body := range bodies {
+		tap.Data(i%2 == 0, body)
+	}
+	tap.Close()
+	capture.writer.Close()
+
+	return decodePcap(t, path)
+}
+
+func TestCaptureIPv4(t *testing.T) {
+	client := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+	backend := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 80}
+
+	// 奇数长度验证校验和的补齐，超过captureSegment的数据拆分为多个报文
+	large := bytes.Repeat([]byte("abcdefg"), captureSegment/7+100)
+	packets := captureTest(t, client, backend, []byte("hello"), large)
+
+	// hello, 2段large, 三个结束报文
+	if len(packets) != 6 {
+		t.Fatalf("packets %d, want 6", len(packets))
+	}
+	if string(packets[0].payload) != "hello" {
+		t.Fatalf("first payload %q", packets[0].payload)
+	}
+	if len(packets[1].payload) != captureSegment || len(packets[2].payload) != len(large)-captureSegment {
+		t.Fatalf("split into %d and %d", len(packets[1].payload), len(packets[2].payload))
+	}
+	if !bytes.Equal(append(append([]byte(nil), packets[1].payload...), packets[2].payload...), large) {
+		t.Fatal("split payload mismatch")
+	}
+
+	// 上行报文从客户端发往后端，序号按数据长度递增
+	up, down := packets[0], packets[1]
+	if !net.IP(up.ip[12:16]).Equal(client.IP) || binary.BigEndian.Uint16(up.tcp[0:]) != 40000 ||
+		binary.BigEndian.Uint16(up.tcp[2:]) != 80 {
+		t.Fatalf("up packet address %v:%d", net.IP(up.ip[12:16]), binary.BigEndian.Uint16(up.tcp[0:]))
+	}
+	if !net.IP(down.ip[12:16]).Equal(backend.IP) || binary.BigEndian.Uint16(down.tcp[0:]) != 80 {
+		t.Fatalf("down packet address %v", net.IP(down.ip[12:16]))
+	}
+	if seq := binary.BigEndian.Uint32(packets[2].tcp[4:]); seq != 5000+captureSegment {
+		t.Fatalf("second segment seq %d", seq)
+	}
+	if ack := binary.BigEndian.Uint32(down.tcp[8:]); ack != 1000+5 {
+		t.Fatalf("down ack %d, want %d", ack, 1000+5)
+	}
+	for _, fin := range packets[3:5] {
+		if fin.tcp[13] != tcpFlagFin|tcpFlagAck {
+			t.Fatalf("close flags %x", fin.tcp[13])
+		}
+	}
+}
+
+func TestCaptureIPv6(t *testing.T) {
+	client := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 40000}
+	backend := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}
+
+	packets := captureTest(t, client, backend, []byte("ping"), []byte("pong!"))
+	if len(packets) != 5 {
+		t.Fatalf("packets %d, want 5", len(packets))
+	}
+	if !net.IP(packets[0].ip[8:24]).Equal(client.IP) || !net.IP(packets[0].ip[24:40]).Equal(backend.IP) {
+		t.Fatalf("up packet address %x", packets[0].ip)
+	}
+	if string(packets[0].payload) != "ping" || string(packets[1].payload) != "pong!" {
+		t.Fatalf("payload %q %q", packets[0].payload, packets[1].payload)
+	}
+
+	// IPv4客户端访问IPv6后端时按IPv6记录
+	mapped := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+	packets = captureTest(t, mapped, backend, []byte("mixed"))
+	if packets[0].ip[0]>>4 != 6 {
+		t.Fatalf("mixed family recorded as ip version %d", packets[0].ip[0]>>4)
+	}
+}
@@ -1,33 +1,79 @@
-package main
+package engine
 
 import (
-	"gopkg.in/yaml.v2"
+	"github.com/lixiangyun/tcpproxy/acl"
+	"github.com/lixiangyun/tcpproxy/ban"
+	"github.com/lixiangyun/tcpproxy/limit"
+	"github.com/lixiangyun/tcpproxy/sockopt"
 	"io/ioutil"
+	"time"
 )
 
+type CaptureConfig struct {
+	Path       string   `yaml:"path"`
+	CIDR       []string `yaml:"cidr"`
+	MaxSize    int64    `yaml:"maxsize"`
+	MaxBackups int      `yaml:"maxbackups"`
+}
+
+type RecordConfig struct {
+	Dir        string   `yaml:"dir"`
+	CIDR       []string `yaml:"cidr"`
+	MaxSize    int64    `yaml:"maxsize"`
+	MaxBackups int      `yaml:"maxbackups"`
+}
+
 type ListernerConfig struct {
-	Address string `yaml:"address"`
-	Cluster string `yaml:"cluster"`
-	Tlsname string `yaml:"tls"`
+	Address          string                 `yaml:"address"`
+	Cluster          string                 `yaml:"cluster"`
+	Tlsname          string                 `yaml:"tls"`
+	IdleTimeout      time.Duration          `yaml:"idletimeout"`
+	MaxDuration      time.Duration          `yaml:"maxduration"`
+	HandshakeTimeout time.Duration          `yaml:"handshaketimeout"`
+	SockOpt          *sockopt.Options       `yaml:"sockopt"`
+	Limit            *limit.Config          `yaml:"limit"`
+	Bandwidth        *limit.BandwidthConfig `yaml:"bandwidth"`
+	Acl              *acl.Config            `yaml:"acl"`
+	Ban              *ban.Config            `yaml:"ban"`
+	Capture          *CaptureConfig         `yaml:"capture"`
+	Record           *RecordConfig          `yaml:"record"`
+	Route            string                 `yaml:"route"`
 }
 
 type ClusterConfig struct {
-	Name     string   `yaml:"name"`
-	Endpoint []string `yaml:"endpoints"`
-	TlsName  string   `yaml:"tls"`
+	Name     string           `yaml:"name"`
+	Endpoint []string         `yaml:"endpoints"`
+	Resolve  time.Duration    `yaml:"resolve"`
+	LB       string           `yaml:"lb"`
+	TlsName  string           `yaml:"tls"`
+	SockOpt  *sockopt.Options `yaml:"sockopt"`
 }
 
 type TlsConfig struct {
-	Name string `yaml:"name"`
-	Cert string `yaml:"cert"`
-	Key  string `yaml:"key"`
-	CA   string `yaml:"ca"`
+	Name       string `yaml:"name"`
+	Cert       string `yaml:"cert"`
+	Key        string `yaml:"key"`
+	CA         string `yaml:"ca"`
+	Passphrase string `yaml:"passphrase"`
+}
+
+type AccessLogConfig struct {
+	Path       string        `yaml:"path"`
+	Format     string        `yaml:"format"`
+	Template   string        `yaml:"template"`
+	MaxSize    int64         `yaml:"maxsize"`
+	Rotate     time.Duration `yaml:"rotate"`
+	MaxBackups int           `yaml:"maxbackups"`
 }
 
 type GlobalConfig struct {
+	Version   int               `yaml:"version"`
+	Include   []string          `yaml:"include"`
 	Listeners []ListernerConfig `yaml:"listeners"`
 	TlsCfg    []TlsConfig       `yaml:"tls"`
 	Clusters  []ClusterConfig   `yaml:"clusters"`
+	AccessLog *AccessLogConfig  `yaml:"accesslog"`
+	BanFile   string            `yaml:"banfile"`
 }
 
 var globalconfig *GlobalConfig
@@ -39,14 +85,9 @@ func LoadConfig(filename string) error {
 		return err
 	}
 
-	config := new(GlobalConfig)
-	config.Listeners = make([]ListernerConfig, 0)
-	config.Clusters = make([]ClusterConfig, 0)
-	config.TlsCfg = make([]TlsConfig, 0)
-
-	err = yaml.Unmarshal(body, config)
-	if err != nil {
-		return err
+	config, problems := ValidateConfig(filename, body)
+	if problems != nil {
+		return problems
 	}
 
 	globalconfig = config
@@ -57,6 +98,18 @@ func listenerGetAll() []ListernerConfig {
 	return globalconfig.Listeners
 }
 
+func clusterGetAll() []ClusterConfig {
+	return globalconfig.Clusters
+}
+
+func AccessLogConfigGet() *AccessLogConfig {
+	return globalconfig.AccessLog
+}
+
+func BanFileGet() string {
+	return globalconfig.BanFile
+}
+
 func ClusterGet(name string) *ClusterConfig {
 	for _, v := range globalconfig.Clusters {
 		if v.Name == name {
@@ -0,0 +1,310 @@
+package engine
+
+import (
+	"flag"
+	"fmt"
+	"github.com/lixiangyun/tcpproxy/proxy"
+	"github.com/lixiangyun/tcpproxy/schema"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	LINK_MODE_DEFAULT    = "RoundRobin"
+	LINK_BACKEND_TIMEOUT = 60
+	LINK_BACKEND_WEIGHT  = 50
+)
+
+// 桌面版负载均衡方式对应的引擎方式，引擎中的后端没有权重
+var linkModes = map[string]string{
+	"":                 "",
+	"RoundRobin":       proxy.LB_ROUNDROBIN,
+	"WeightRoundRobin": proxy.LB_ROUNDROBIN,
+	"Random":           proxy.LB_RANDOM,
+	"AddressHash":      proxy.LB_HASH,
+	"LeastConn":        proxy.LB_LEASTCONN,
+}
+
+type converter struct {
+	warnings []string
+}
+
+func (c *converter) warn(format string, v ...interface{}) {
+	c.warnings = append(c.warnings, fmt.Sprintf(format, v...))
+}
+
+func seconds(value int) time.Duration {
+	return time.Duration(value) * time.Second
+}
+
+// 转换后每个监听只有自己的集群，路由到其它集群的表达式无法通过校验，去掉路由
+func (c *converter) route(owner string, route string) string {
+	if route == "" {
+		return ""
+	}
+	router, err := proxy.NewRouter(route, nil)
+	if err != nil {
+		c.warn("%s route invalid, dropped, %s", owner, err.Error())
+		return ""
+	}
+	if clusters := router.Clusters(); len(clusters) > 0 {
+		c.warn("%s route to clusters %s is not supported after conversion, dropped", owner, strings.Join(clusters, ", "))
+		return ""
+	}
+	return route
+}
+
+// 引擎配置转换为桌面版链路，每个监听和对应集群转换为一条链路
+func (c *converter) toLinks(config *GlobalConfig) []schema.Link {
+	if config.AccessLog != nil {
+		c.warn("accesslog is not supported by desktop, ignored")
+	}
+	var output []schema.Link
+	for _, v := range config.Listeners {
+		host, port, err := net.SplitHostPort(v.Address)
+		if err != nil {
+			c.warn("listener %q invalid address, skipped", v.Address)
+			continue
+		}
+		if host == "" {
+			host = "0.0.0.0"
+		}
+		link := schema.Link{
+			Iface:     host,
+			Mode:      LINK_MODE_DEFAULT,
+			Timeout:   int(v.IdleTimeout / time.Second),
+			MaxLife:   int(v.MaxDuration / time.Second),
+			SockOpt:   v.SockOpt,
+			Limit:     v.Limit,
+			Bandwidth: v.Bandwidth,
+			Acl:       v.Acl,
+			Ban:       v.Ban,
+		}
+		link.Port, _ = strconv.Atoi(port)
+
+		if v.Tlsname != "" {
+			c.warn("listener %q tls %q is not supported by desktop, ignored", v.Address, v.Tlsname)
+		}
+		if v.Capture != nil || v.Record != nil {
+			c.warn("listener %q capture and record are not supported by desktop, ignored", v.Address)
+		}
+		link.Route = c.route(fmt.Sprintf("listener %q", v.Address), v.Route)
+
+		var cluster *ClusterConfig
+		for i := range config.Clusters {
+			if config.Clusters[i].Name == v.Cluster {
+				cluster = &config.Clusters[i]
+				break
+			}
+		}
+		if cluster == nil {
+			c.warn("listener %q references unknown cluster %q, skipped", v.Address, v.Cluster)
+			continue
+		}
+		if cluster.TlsName != "" {
+			c.warn("cluster %q tls %q is not supported by desktop, ignored", cluster.Name, cluster.TlsName)
+		}
+		// 桌面版监听和连接后端使用同一套套接字选项
+		if link.SockOpt == nil {
+			link.SockOpt = cluster.SockOpt
+		} else if cluster.SockOpt != nil && !reflect.DeepEqual(link.SockOpt, cluster.SockOpt) {
+			c.warn("cluster %q sockopt differs from listener %q, using listener sockopt", cluster.Name, v.Address)
+		}
+		link.Resolve = int(cluster.Resolve / time.Second)
+		switch cluster.LB {
+		case proxy.LB_RANDOM:
+			link.Mode = "Random"
+		case proxy.LB_HASH:
+			link.Mode = "AddressHash"
+		case proxy.LB_LEASTCONN:
+			link.Mode = "LeastConn"
+		}
+		for _, ep := range cluster.Endpoint {
+			link.Backend = append(link.Backend, schema.Backend{
+				Address: ep, Timeout: LINK_BACKEND_TIMEOUT, Weight: LINK_BACKEND_WEIGHT,
+			})
+		}
+		output = append(output, link)
+	}
+	return output
+}
+
+// 桌面版链路转换为引擎配置，每条链路生成一个监听和一个集群
+func (c *converter) toConfig(links []schema.Link) *GlobalConfig {
+	config := &GlobalConfig{Version: schema.VERSION}
+	names := make(map[string]bool)
+
+	for _, v := range links {
+		address := net.JoinHostPort(v.Iface, strconv.Itoa(v.Port))
+		name := fmt.Sprintf("link-%d", v.Port)
+		for i := 2; names[name]; i++ {
+			name = fmt.Sprintf("link-%d-%d", v.Port, i)
+		}
+		names[name] = true
+
+		lb, ok := linkModes[v.Mode]
+		if !ok {
+			c.warn("link %s load balance %q is not supported by engine, using round robin", address, v.Mode)
+		} else if v.Mode == "WeightRoundRobin" {
+			c.warn("link %s backend weights are not supported by engine, using round robin", address)
+		}
+		if v.Impair.Enable() {
+			c.warn("link %s impairment is not supported by engine, ignored", address)
+		}
+
+		cluster := ClusterConfig{
+			Name:    name,
+			Resolve: seconds(v.Resolve),
+			LB:      lb,
+			SockOpt: v.SockOpt,
+		}
+		for _, b := range v.Backend {
+			if b.Standby {
+				c.warn("link %s standby backend %s is used as main by engine", address, b.Address)
+			}
+			cluster.Endpoint = append(cluster.Endpoint, b.Address)
+		}
+		config.Clusters = append(config.Clusters, cluster)
+
+		config.Listeners = append(config.Listeners, ListernerConfig{
+			Address:     address,
+			Cluster:     name,
+			IdleTimeout: seconds(v.Timeout),
+			MaxDuration: seconds(v.MaxLife),
+			SockOpt:     v.SockOpt,
+			Limit:       v.Limit,
+			Bandwidth:   v.Bandwidth,
+			Acl:         v.Acl,
+			Ban:         v.Ban,
+			Route:       c.route("link "+address, v.Route),
+		})
+	}
+	return config
+}
+
+// 去掉空值和零值，生成的配置只保留设置过的字段
+func yamlPrune(value interface{}) (interface{}, bool) {
+	switch v := value.(type) {
+	case nil:
+		return nil, false
+	case string:
+		return v, v != "" && v != "0s"
+	case int:
+		return v, v != 0
+	case float64:
+		return v, v != 0
+	case yaml.MapSlice:
+		var output yaml.MapSlice
+		for _, item := range v {
+			if pruned, ok := yamlPrune(item.Value); ok {
+				output = append(output, yaml.MapItem{Key: item.Key, Value: pruned})
+			}
+		}
+		return output, len(output) > 0
+	case []interface{}:
+		var output []interface{}
+		for _, item := range v {
+			if pruned, ok := yamlPrune(item); ok {
+				output = append(output, pruned)
+			}
+		}
+		return output, len(output) > 0
+	}
+	return value, true
+}
+
+func configMarshal(config *GlobalConfig) ([]byte, error) {
+	body, err := yaml.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	var doc yaml.MapSlice
+	err = yaml.Unmarshal(body, &doc)
+	if err != nil {
+		return nil, err
+	}
+	pruned, _ := yamlPrune(doc)
+	return yaml.Marshal(pruned)
+}
+
+func convertOutput(file string, body []byte, warnings []string) {
+	for _, v := range warnings {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", v)
+	}
+	if file == "" || file == "-" {
+		os.Stdout.Write(body)
+		return
+	}
+	err := ioutil.WriteFile(file, body, 0644)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+}
+
+// export子命令，引擎配置转换为桌面版link.json
+func ExportMain(args []string) {
+	var file, output string
+
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	flags.StringVar(&file, "config", "config.yaml", "configure file.")
+	flags.StringVar(&output, "out", "-", "output link.json file, - is stdout.")
+	flags.Parse(args)
+
+	body, err := ioutil.ReadFile(file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	config, problems := ValidateConfig(file, body)
+	if config == nil {
+		fmt.Fprintln(os.Stderr, problems.Error())
+		os.Exit(1)
+	}
+
+	c := new(converter)
+	for _, v := range problems {
+		c.warn("%s", v.String())
+	}
+	body, err = schema.EncodeLinks(c.toLinks(config))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	convertOutput(output, append(body, '\n'), c.warnings)
+}
+
+// import子命令，桌面版link.json转换为引擎配置
+func ImportMain(args []string) {
+	var file, output string
+
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	flags.StringVar(&file, "links", "link.json", "desktop link.json file.")
+	flags.StringVar(&output, "out", "-", "output configure file, - is stdout.")
+	flags.Parse(args)
+
+	body, err := ioutil.ReadFile(file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	links, _, err := schema.DecodeLinks(body)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", file, err.Error())
+		os.Exit(1)
+	}
+
+	c := new(converter)
+	body, err = configMarshal(c.toConfig(links))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	convertOutput(output, body, c.warnings)
+}
@@ -0,0 +1,152 @@
+package engine
+
+import (
+	"github.com/lixiangyun/tcpproxy/acl"
+	"github.com/lixiangyun/tcpproxy/impair"
+	"github.com/lixiangyun/tcpproxy/limit"
+	"github.com/lixiangyun/tcpproxy/proxy"
+	"github.com/lixiangyun/tcpproxy/schema"
+	"github.com/lixiangyun/tcpproxy/sockopt"
+	"gopkg.in/yaml.v2"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 链路转换为引擎配置再转换回来，双方都支持的字段不变
+func TestLinksRoundTrip(t *testing.T) {
+	links := []schema.Link{
+		{
+			Iface:     "0.0.0.0",
+			Port:      8080,
+			Timeout:   300,
+			MaxLife:   3600,
+			Resolve:   30,
+			Mode:      LINK_MODE_DEFAULT,
+			Backend:   []schema.Backend{{Address: "127.0.0.1:80", Timeout: LINK_BACKEND_TIMEOUT, Weight: LINK_BACKEND_WEIGHT}},
+			SockOpt:   &sockopt.Options{RecvBuf: 65536, ReusePort: true},
+			Limit:     &limit.Config{MaxConns: 100},
+			Bandwidth: &limit.BandwidthConfig{Up: 1024},
+			Acl:       &acl.Config{Allow: []string{"10.0.0.0/8"}},
+			Route:     "hour < 6",
+		},
+		{
+			Iface:   "::1",
+			Port:    8081,
+			Mode:    "LeastConn",
+			Backend: []schema.Backend{{Address: "[::1]:80", Timeout: LINK_BACKEND_TIMEOUT, Weight: LINK_BACKEND_WEIGHT}},
+		},
+	}
+
+	c := new(converter)
+	config := c.toConfig(links)
+	if len(c.warnings) != 0 {
+		t.Fatalf("warnings %v", c.warnings)
+	}
+	if config.Listeners[0].IdleTimeout != 5*time.Minute || config.Clusters[0].Resolve != 30*time.Second || config.Clusters[1].LB != proxy.LB_LEASTCONN {
+		t.Fatalf("config %+v", config)
+	}
+	if _, problems := ValidateConfig("import.yaml", mustMarshal(t, config)); problems != nil {
+		t.Fatalf("imported config invalid\n%s", problems.Error())
+	}
+
+	output := c.toLinks(config)
+	if len(c.warnings) != 0 {
+		t.Fatalf("warnings %v", c.warnings)
+	}
+	if !reflect.DeepEqual(output, links) {
+		t.Fatalf("round trip\n%+v\nwant\n%+v", output, links)
+	}
+}
+
+// 另一方不支持的设置给出警告，引擎配置转换为链路再转换回来，保留的字段不变
+func TestConfigRoundTrip(t *testing.T) {
+	config := &GlobalConfig{
+		Version: schema.VERSION,
+		Listeners: []ListernerConfig{
+			{Address: "127.0.0.1:8080", Cluster: "web", IdleTimeout: time.Minute, Tlsname: "site",
+				Capture: &CaptureConfig{Path: "a.pcap"}, Route: "sni == 'a' ? 'cluster:api' : ''"},
+			{Address: ":8081", Cluster: "missing"},
+			{Address: "bad", Cluster: "web"},
+		},
+		Clusters: []ClusterConfig{
+			{Name: "web", Endpoint: []string{"127.0.0.1:80", "127.0.0.1:81"}, LB: proxy.LB_HASH},
+		},
+	}
+	c := new(converter)
+	links := c.toLinks(config)
+	if len(links) != 1 || links[0].Mode != "AddressHash" || links[0].Route != "" || len(links[0].Backend) != 2 {
+		t.Fatalf("links %+v", links)
+	}
+	want := []string{"tls \"site\"", "capture", "route to clusters api", "unknown cluster \"missing\"", "\"bad\" invalid address"}
+	if len(c.warnings) != len(want) {
+		t.Fatalf("warnings %v", c.warnings)
+	}
+	for i, w := range want {
+		if !strings.Contains(c.warnings[i], w) {
+			t.Errorf("warning %q, want %q", c.warnings[i], w)
+		}
+	}
+
+	c = new(converter)
+	output := c.toConfig(links)
+	listener, cluster := output.Listeners[0], output.Clusters[0]
+	if listener.Address != "127.0.0.1:8080" || listener.IdleTimeout != time.Minute || listener.Cluster != cluster.Name ||
+		cluster.LB != proxy.LB_HASH || !reflect.DeepEqual(cluster.Endpoint, config.Clusters[0].Endpoint) {
+		t.Fatalf("round trip %+v %+v", listener, cluster)
+	}
+
+	// 引擎不支持的链路设置
+	c = new(converter)
+	c.toConfig([]schema.Link{{Iface: "0.0.0.0", Port: 8080, Mode: "WeightRoundRobin",
+		Backend: []schema.Backend{{Address: "127.0.0.1:80", Standby: true}}, Impair: &impair.Config{Latency: 10}}})
+	if len(c.warnings) != 3 {
+		t.Fatalf("warnings %v", c.warnings)
+	}
+}
+
+func mustMarshal(t *testing.T, config *GlobalConfig) []byte {
+	body, err := configMarshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestYamlPrune(t *testing.T) {
+	cases := []struct {
+		value interface{}
+		want  interface{}
+		keep  bool
+	}{
+		{nil, nil, false},
+		{"", "", false},
+		{"0s", "0s", false},
+		{"1s", "1s", true},
+		{0, 0, false},
+		{3, 3, true},
+		{0.0, 0.0, false},
+		{false, false, true},
+		{[]interface{}{"", 0}, []interface{}(nil), false},
+		{[]interface{}{"", "a"}, []interface{}{"a"}, true},
+		{yaml.MapSlice{{Key: "a", Value: ""}, {Key: "b", Value: yaml.MapSlice{{Key: "c", Value: 0}}}}, yaml.MapSlice(nil), false},
+		{yaml.MapSlice{{Key: "a", Value: 1}, {Key: "b", Value: ""}}, yaml.MapSlice{{Key: "a", Value: 1}}, true},
+	}
+	for _, c := range cases {
+		value, keep := yamlPrune(c.value)
+		if keep != c.keep || !reflect.DeepEqual(value, c.want) {
+			t.Errorf("%#v pruned to %#v %v", c.value, value, keep)
+		}
+	}
+
+	body := string(mustMarshal(t, &GlobalConfig{
+		Version:   schema.VERSION,
+		Listeners: []ListernerConfig{{Address: ":8080", Cluster: "web"}},
+		Clusters:  []ClusterConfig{{Name: "web", Endpoint: []string{"127.0.0.1:80"}}},
+	}))
+	want := "version: 2\nlisteners:\n- address: :8080\n  cluster: web\nclusters:\n- name: web\n  endpoints:\n  - 127.0.0.1:80\n"
+	if body != want {
+		t.Fatalf("marshal\n%s\nwant\n%s", body, want)
+	}
+}
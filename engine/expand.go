@@ -0,0 +1,257 @@
+package engine
+
+import (
+	"fmt"
+	"github.com/lixiangyun/tcpproxy/discovery"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// 从文件读取敏感值，例如 passphrase: ${file:secrets/key.pass}
+	SECRET_PREFIX = "file:"
+)
+
+var (
+	envRegexp     = regexp.MustCompile(`\$\$|\$\{([^{}]*)\}`)
+	envNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// 相对路径相对于引用它的配置文件所在目录
+func configPath(dir string, name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(dir, name)
+}
+
+// 解析一个引用：${NAME}、${NAME:-default} 或者 ${file:path}
+func envValue(dir string, ref string) (string, error) {
+	if strings.HasPrefix(ref, SECRET_PREFIX) {
+		name := configPath(dir, strings.TrimPrefix(ref, SECRET_PREFIX))
+		body, err := ioutil.ReadFile(name)
+		if err != nil {
+			return "", err
+		}
+		value := strings.TrimRight(string(body), "\r\n")
+		if strings.ContainsAny(value, "\r\n") {
+			return "", fmt.Errorf("secret file %s must be a single line", name)
+		}
+		return value, nil
+	}
+
+	name, def := ref, ""
+	idx := strings.Index(ref, ":-")
+	if idx >= 0 {
+		name, def = ref[:idx], ref[idx+2:]
+	}
+	if !envNameRegexp.MatchString(name) {
+		return "", fmt.Errorf("invalid reference ${%s}", ref)
+	}
+	value, ok := os.LookupEnv(name)
+	if idx >= 0 && value == "" {
+		return def, nil
+	}
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	return value, nil
+}
+
+// 解析后只替换值中字符串标量的引用，$$ 表示 $ 本身，键和注释不处理，
+// 值中的yaml语法字符不会影响文档结构。有引用时重新编码，之后的yaml错误按路径映射回原文件的行号
+func (c *configChecker) expand(body []byte) []byte {
+	if !envRegexp.Match(body) {
+		return body
+	}
+	var doc yaml.MapSlice
+	if yaml.Unmarshal(body, &doc) != nil {
+		// 语法错误由后续解析报告
+		return body
+	}
+	c.expandValue(filepath.Dir(c.file), "", doc)
+
+	output, err := yaml.Marshal(doc)
+	if err != nil {
+		return body
+	}
+	c.lines = make(map[int]int)
+	for path, line := range yamlPositions(output) {
+		c.lines[line] = yamlLine(c.positions, path)
+	}
+	return output
+}
+
+func (c *configChecker) expandValue(dir string, path string, value interface{}) interface{} {
+	switch v := value.(type) {
+	case yaml.MapSlice:
+		for i := range v {
+			v[i].Value = c.expandValue(dir, yamlPath(path, fmt.Sprint(v[i].Key)), v[i].Value)
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = c.expandValue(dir, yamlPath(path, strconv.Itoa(i)), v[i])
+		}
+	case string:
+		return c.expandString(dir, path, v)
+	}
+	return value
+}
+
+func yamlPath(parent string, key string) string {
+	if parent == "" {
+		return key
+	}
+	return parent + "." + key
+}
+
+// 替换字符串中的引用，结果按普通标量还原为整数、浮点数或者布尔值，例如 port: ${PORT}，
+// 只还原能原样写回的文本，字符串类型的字段得到的值不变
+func (c *configChecker) expandString(dir string, path string, text string) interface{} {
+	found := false
+	text = envRegexp.ReplaceAllStringFunc(text, func(ref string) string {
+		if ref == "$$" {
+			return "$"
+		}
+		found = true
+		value, err := envValue(dir, ref[2:len(ref)-1])
+		if err != nil {
+			c.add(path, "%s", err.Error())
+			return ""
+		}
+		return value
+	})
+	if !found {
+		return text
+	}
+	if value, err := strconv.Atoi(text); err == nil && strconv.Itoa(value) == text {
+		return value
+	}
+	if value, err := strconv.ParseFloat(text, 64); err == nil && strconv.FormatFloat(value, 'g', -1, 64) == text {
+		return value
+	}
+	if value, err := strconv.ParseBool(text); err == nil && strconv.FormatBool(value) == text {
+		return value
+	}
+	return text
+}
+
+// 合并include的配置片段，片段中的监听、集群和证书追加到主配置，
+// 记录合并后的位置对应的片段文件和路径，用于定位问题
+func (c *configChecker) include(root *configChecker, config *GlobalConfig, patterns []string, seen map[string]bool) {
+	dir := filepath.Dir(c.file)
+	for i, pattern := range patterns {
+		path := fmt.Sprintf("include.%d", i)
+		matches, err := filepath.Glob(configPath(dir, pattern))
+		if err != nil {
+			c.add(path, "include %q %s", pattern, err.Error())
+			continue
+		}
+		if len(matches) == 0 && !strings.ContainsAny(pattern, "*?[") {
+			c.add(path, "include %q no such file", pattern)
+		}
+		for _, name := range matches {
+			abs, _ := filepath.Abs(name)
+			if seen[abs] {
+				c.add(path, "include %q file %s already included", pattern, name)
+				continue
+			}
+			seen[abs] = true
+
+			body, err := ioutil.ReadFile(name)
+			if err != nil {
+				c.add(path, "%s", err.Error())
+				continue
+			}
+			fragment := &configChecker{file: name}
+			part, _ := fragment.decode(body)
+			root.problems = append(root.problems, fragment.problems...)
+			if part == nil {
+				continue
+			}
+			fragment.problems = nil
+			relocate(filepath.Dir(name), part)
+			root.merge(fragment, config, part)
+			fragment.include(root, config, part.Include, seen)
+			root.problems = append(root.problems, fragment.problems...)
+		}
+	}
+}
+
+// 片段中的相对路径相对于片段所在目录，合并前改写，主配置中的路径保持不变
+func relocate(dir string, part *GlobalConfig) {
+	local := func(name *string) {
+		if *name != "" {
+			*name = configPath(dir, *name)
+		}
+	}
+	for i := range part.TlsCfg {
+		local(&part.TlsCfg[i].Cert)
+		local(&part.TlsCfg[i].Key)
+		local(&part.TlsCfg[i].CA)
+	}
+	for _, v := range part.Listeners {
+		if v.Acl != nil {
+			local(&v.Acl.File)
+		}
+		if v.Capture != nil {
+			local(&v.Capture.Path)
+		}
+		if v.Record != nil {
+			local(&v.Record.Dir)
+		}
+	}
+	for _, v := range part.Clusters {
+		for i, entry := range v.Endpoint {
+			if strings.HasPrefix(entry, discovery.FILE_PREFIX) {
+				v.Endpoint[i] = discovery.FILE_PREFIX + configPath(dir, strings.TrimPrefix(entry, discovery.FILE_PREFIX))
+			}
+		}
+	}
+	if part.AccessLog != nil {
+		local(&part.AccessLog.Path)
+	}
+	local(&part.BanFile)
+}
+
+func (c *configChecker) origin(path string, fragment *configChecker, from string) {
+	if c.fragments == nil {
+		c.fragments = make(map[string]configOrigin)
+	}
+	c.fragments[path] = configOrigin{file: fragment.file, positions: fragment.positions, path: from}
+}
+
+func (c *configChecker) merge(fragment *configChecker, config *GlobalConfig, part *GlobalConfig) {
+	for i, v := range part.Listeners {
+		c.origin(fmt.Sprintf("listeners.%d", len(config.Listeners)), fragment, fmt.Sprintf("listeners.%d", i))
+		config.Listeners = append(config.Listeners, v)
+	}
+	for i, v := range part.Clusters {
+		c.origin(fmt.Sprintf("clusters.%d", len(config.Clusters)), fragment, fmt.Sprintf("clusters.%d", i))
+		config.Clusters = append(config.Clusters, v)
+	}
+	for i, v := range part.TlsCfg {
+		c.origin(fmt.Sprintf("tls.%d", len(config.TlsCfg)), fragment, fmt.Sprintf("tls.%d", i))
+		config.TlsCfg = append(config.TlsCfg, v)
+	}
+	if part.AccessLog != nil {
+		if config.AccessLog != nil {
+			fragment.add("accesslog", "accesslog already defined")
+		} else {
+			c.origin("accesslog", fragment, "accesslog")
+			config.AccessLog = part.AccessLog
+		}
+	}
+	if part.BanFile != "" {
+		if config.BanFile != "" {
+			fragment.add("banfile", "banfile already defined")
+		} else {
+			config.BanFile = part.BanFile
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package engine
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeFile(t *testing.T, path string, body string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(body), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExpandString(t *testing.T) {
+	os.Setenv("TCPPROXY_TEST_PORT", "8080")
+	os.Setenv("TCPPROXY_TEST_EMPTY", "")
+	os.Setenv("TCPPROXY_TEST_BOOL", "true")
+	os.Unsetenv("TCPPROXY_TEST_UNSET")
+	defer func() {
+		os.Unsetenv("TCPPROXY_TEST_PORT")
+		os.Unsetenv("TCPPROXY_TEST_EMPTY")
+		os.Unsetenv("TCPPROXY_TEST_BOOL")
+	}()
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	writeFile(t, filepath.Join(dir, "secret"), "s3cret\n")
+
+	cases := []struct {
+		text    string
+		value   interface{}
+		problem string
+	}{
+		{"plain", "plain", ""},
+		{"$$", "$", ""},
+		{"$${TCPPROXY_TEST_PORT}", "${TCPPROXY_TEST_PORT}", ""},
+		{"${TCPPROXY_TEST_PORT}", 8080, ""},
+		{"0${TCPPROXY_TEST_PORT}", "08080", ""},
+		{"${TCPPROXY_TEST_PORT}.5", 8080.5, ""},
+		{"${TCPPROXY_TEST_BOOL}", true, ""},
+		{"host:${TCPPROXY_TEST_PORT}", "host:8080", ""},
+		{"${TCPPROXY_TEST_UNSET:-80}", 80, ""},
+		{"${TCPPROXY_TEST_EMPTY:-def}", "def", ""},
+		{"${TCPPROXY_TEST_EMPTY}", "", ""},
+		{"${TCPPROXY_TEST_PORT:-1}", 8080, ""},
+		{"${file:secret}", "s3cret", ""},
+		{"${TCPPROXY_TEST_UNSET}", "", "environment variable TCPPROXY_TEST_UNSET is not set"},
+		{"${bad name}", "", "invalid reference ${bad name}"},
+		{"${file:missing}", "", "missing"},
+	}
+	for _, c := range cases {
+		checker := &configChecker{file: "test.yaml"}
+		value := checker.expandString(dir, "key", c.text)
+		if !reflect.DeepEqual(value, c.value) {
+			t.Errorf("%s got %#v, want %#v", c.text, value, c.value)
+		}
+		if c.problem == "" && len(checker.problems) > 0 {
+			t.Errorf("%s unexpected %v", c.text, checker.problems)
+		}
+		if c.problem != "" && (len(checker.problems) != 1 || !strings.Contains(checker.problems[0].Message, c.problem)) {
+			t.Errorf("%s problems %v, want %q", c.text, checker.problems, c.problem)
+		}
+	}
+}
+
+// 有引用时重新编码，之后的yaml错误和检查问题仍然对应原文件的行
+func TestExpandLines(t *testing.T) {
+	os.Setenv("TCPPROXY_TEST_PORT", "8080")
+	defer os.Unsetenv("TCPPROXY_TEST_PORT")
+
+	body := `version: 2
+# comment
+
+listeners:
+  - address: "127.0.0.1:${TCPPROXY_TEST_PORT}"
+    cluster: web
+    idletimeout: ${TCPPROXY_TEST_UNSET:-5m}
+    clustr: web
+clusters:
+  - name: web
+    endpoints:
+      - 127.0.0.1:${TCPPROXY_TEST_PORT}
+      - ${TCPPROXY_TEST_UNSET}
+`
+	config, problems := ValidateConfig("test.yaml", []byte(body))
+	want := []string{
+		"test.yaml:8: field clustr not found",
+		"test.yaml:13: environment variable TCPPROXY_TEST_UNSET is not set",
+	}
+	text := problems.Error()
+	for _, w := range want {
+		if !strings.Contains(text, w) {
+			t.Errorf("missing %q in\n%s", w, text)
+		}
+	}
+	if config == nil || config.Listeners[0].Address != "127.0.0.1:8080" || config.Listeners[0].IdleTimeout.String() != "5m0s" {
+		t.Fatalf("config %+v", config)
+	}
+}
+
+// 片段中的相对路径相对于片段所在目录
+func TestInclude(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	cert := selfSigned(t)
+	key, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(dir, "conf.d", "certs", "a.pem"),
+		string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})))
+	writeFile(t, filepath.Join(dir, "conf.d", "certs", "a.key"),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key})))
+	writeFile(t, filepath.Join(dir, "conf.d", "acl.txt"), "allow 10.0.0.0/8\n")
+	writeFile(t, filepath.Join(dir, "conf.d", "data", "members.yaml"), "- 127.0.0.1:80\n")
+
+	main := filepath.Join(dir, "main.yaml")
+	writeFile(t, main, `version: 2
+include:
+  - conf.d/*.yaml
+listeners:
+  - address: 127.0.0.1:8080
+    cluster: web
+clusters:
+  - name: web
+    endpoints: [127.0.0.1:80]
+`)
+	writeFile(t, filepath.Join(dir, "conf.d", "api.yaml"), `version: 2
+include:
+  - sub/*.yaml
+listeners:
+  - address: 127.0.0.1:8081
+    cluster: api
+    tls: api
+    acl:
+      file: acl.txt
+clusters:
+  - name: api
+    endpoints: [file:data/members.yaml]
+tls:
+  - name: api
+    cert: certs/a.pem
+    key: certs/a.key
+`)
+	// 片段之间循环包含
+	writeFile(t, filepath.Join(dir, "conf.d", "sub", "loop.yaml"), `version: 2
+include:
+  - ../api.yaml
+`)
+
+	config, problems := ValidateConfig(main, []byte(readFile(t, main)))
+	loop := filepath.Join(dir, "conf.d", "sub", "loop.yaml")
+	if len(problems) != 1 || problems[0].File != loop || problems[0].Line != 3 || !strings.Contains(problems[0].Message, "already included") {
+		t.Fatalf("problems %v", problems)
+	}
+
+	fragment := filepath.Join(dir, "conf.d")
+	if config.TlsCfg[0].Cert != filepath.Join(fragment, "certs", "a.pem") || config.TlsCfg[0].Key != filepath.Join(fragment, "certs", "a.key") {
+		t.Fatalf("tls %+v", config.TlsCfg[0])
+	}
+	if config.Listeners[1].Acl.File != filepath.Join(fragment, "acl.txt") {
+		t.Fatalf("acl file %s", config.Listeners[1].Acl.File)
+	}
+	if config.Clusters[1].Endpoint[0] != "file:"+filepath.Join(fragment, "data", "members.yaml") {
+		t.Fatalf("endpoints %v", config.Clusters[1].Endpoint)
+	}
+	// 主配置中的路径不变
+	if config.Clusters[0].Endpoint[0] != "127.0.0.1:80" {
+		t.Fatalf("main endpoints %v", config.Clusters[0].Endpoint)
+	}
+}
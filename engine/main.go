@@ -1,34 +1,73 @@
-package main
+// Package engine 是tcpproxy命令行程序的实现，按配置文件或者命令行参数启动代理，
+// 需要增加中间件时在自己的main中调用 engine.Main(engine.WithMiddleware(...))。
+package engine
 
 import (
 	"flag"
 	"log"
+	"os"
 )
 
-var (
-	config string
-	help   bool
-	debug  bool
-)
+// 解析命令行并运行，opts在加载配置之前生效
+func Main(opts ...Option) {
+	o := new(options)
+	for _, opt := range opts {
+		opt(o)
+	}
 
-func init() {
-	flag.BoolVar(&help, "h", false, "this help")
-	flag.BoolVar(&debug, "debug", false, "debug mode")
-	flag.StringVar(&config, "config", "config.yaml", "configure file.")
-}
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		ReplayMain(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		ValidateMain(os.Args[2:])
+		return
+	}
 
-func main() {
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		ExportMain(os.Args[2:])
+		return
+	}
 
-	flag.Parse()
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		ImportMain(os.Args[2:])
+		return
+	}
+
+	var config, admin string
+	var help bool
+
+	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	flags.BoolVar(&help, "h", false, "this help")
+	flags.StringVar(&config, "config", "config.yaml", "configure file.")
+	flags.StringVar(&admin, "admin", "", "admin api listen address, eg: 127.0.0.1:9000.")
+	quick := QuickFlags(flags)
+	flags.Parse(os.Args[1:])
 	if help {
-		flag.Usage()
+		flags.Usage()
 		return
 	}
 
-	err := LoadConfig(config)
+	var err error
+	if quick.Enable() {
+		err = LoadQuick(quick)
+	} else {
+		err = LoadConfig(config)
+	}
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	err = AccessLogInit(AccessLogConfigGet())
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	err = BanInit(BanFileGet())
 	if err != nil {
 		log.Fatalln(err.Error())
 	}
 
-	TcpProxyStart()
+	TcpProxyStart(admin, o.middlewares)
 }
@@ -0,0 +1,20 @@
+package engine
+
+import (
+	"github.com/lixiangyun/tcpproxy/proxy"
+)
+
+// Main的选项
+type options struct {
+	// 全部监听共用的中间件，用于增加认证、审计或者协议处理而不修改转发流程
+	middlewares proxy.Chain
+}
+
+type Option func(o *options)
+
+// 追加中间件，在路由表达式之后调用
+func WithMiddleware(m ...proxy.Middleware) Option {
+	return func(o *options) {
+		o.middlewares = append(o.middlewares, m...)
+	}
+}
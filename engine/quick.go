@@ -0,0 +1,113 @@
+package engine
+
+import (
+	"flag"
+	"github.com/lixiangyun/tcpproxy/proxy"
+	"github.com/lixiangyun/tcpproxy/schema"
+	"strings"
+	"time"
+)
+
+const (
+	QUICK_NAME       = "command line"
+	QUICK_CLUSTER    = "quick"
+	QUICK_LISTEN_TLS = "quick-listen"
+	QUICK_REMOTE_TLS = "quick-remote"
+)
+
+// 命令行快速代理模式的参数，不需要配置文件
+type QuickOptions struct {
+	listen    string
+	to        string
+	lb        string
+	cert      string
+	key       string
+	ca        string
+	toCert    string
+	toKey     string
+	toCA      string
+	idle      time.Duration
+	resolve   time.Duration
+	accesslog string
+}
+
+// 在flags中注册快速代理模式的参数
+func QuickFlags(flags *flag.FlagSet) *QuickOptions {
+	quick := new(QuickOptions)
+	flags.StringVar(&quick.listen, "listen", "", "quick proxy listen addresses, comma separated, eg: :8080. ignore -config.")
+	flags.StringVar(&quick.to, "to", "", "quick proxy backend endpoints, comma separated, eg: 10.0.0.1:80,10.0.0.2:80.")
+	flags.StringVar(&quick.lb, "lb", "", "quick proxy load balance, "+strings.Join(proxy.Modes, ", ")+".")
+	flags.StringVar(&quick.cert, "cert", "", "quick proxy listen tls certificate.")
+	flags.StringVar(&quick.key, "key", "", "quick proxy listen tls key.")
+	flags.StringVar(&quick.ca, "ca", "", "quick proxy listen tls ca, verify client certificates.")
+	flags.StringVar(&quick.toCert, "to-cert", "", "quick proxy backend tls client certificate.")
+	flags.StringVar(&quick.toKey, "to-key", "", "quick proxy backend tls client key.")
+	flags.StringVar(&quick.toCA, "to-ca", "", "quick proxy backend tls ca, verify backend certificates.")
+	flags.DurationVar(&quick.idle, "idletimeout", 0, "quick proxy idle timeout, eg: 5m.")
+	flags.DurationVar(&quick.resolve, "resolve", 0, "quick proxy backend re-resolve interval, eg: 30s.")
+	flags.StringVar(&quick.accesslog, "accesslog", "", "quick proxy json access log file.")
+	return quick
+}
+
+func quickList(value string) []string {
+	var output []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			output = append(output, v)
+		}
+	}
+	return output
+}
+
+// 按命令行参数生成配置，证书参数和配置文件中的tls含义一致
+func (quick *QuickOptions) Config() *GlobalConfig {
+	config := &GlobalConfig{Version: schema.VERSION}
+	cluster := ClusterConfig{
+		Name:     QUICK_CLUSTER,
+		Endpoint: quickList(quick.to),
+		Resolve:  quick.resolve,
+		LB:       quick.lb,
+	}
+	if quick.toCert != "" || quick.toKey != "" || quick.toCA != "" {
+		cluster.TlsName = QUICK_REMOTE_TLS
+		config.TlsCfg = append(config.TlsCfg, TlsConfig{
+			Name: QUICK_REMOTE_TLS, Cert: quick.toCert, Key: quick.toKey, CA: quick.toCA,
+		})
+	}
+	config.Clusters = append(config.Clusters, cluster)
+
+	var tlsname string
+	if quick.cert != "" || quick.key != "" || quick.ca != "" {
+		tlsname = QUICK_LISTEN_TLS
+		config.TlsCfg = append(config.TlsCfg, TlsConfig{
+			Name: QUICK_LISTEN_TLS, Cert: quick.cert, Key: quick.key, CA: quick.ca,
+		})
+	}
+	for _, v := range quickList(quick.listen) {
+		config.Listeners = append(config.Listeners, ListernerConfig{
+			Address:     v,
+			Cluster:     QUICK_CLUSTER,
+			Tlsname:     tlsname,
+			IdleTimeout: quick.idle,
+		})
+	}
+	if quick.accesslog != "" {
+		config.AccessLog = &AccessLogConfig{Path: quick.accesslog}
+	}
+	return config
+}
+
+func (quick *QuickOptions) Enable() bool {
+	return quick.listen != "" || quick.to != ""
+}
+
+// 快速代理模式和配置文件使用同样的校验和启动流程
+func LoadQuick(quick *QuickOptions) error {
+	config := quick.Config()
+	problems := CheckConfig(QUICK_NAME, config)
+	if problems != nil {
+		return problems
+	}
+	globalconfig = config
+	return nil
+}
@@ -0,0 +1,44 @@
+package engine
+
+import (
+	"flag"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// 快速代理的参数只注册在传入的flags中，不影响全局的flag.CommandLine
+func TestQuickFlags(t *testing.T) {
+	flags := flag.NewFlagSet("tcpproxy", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	quick := QuickFlags(flags)
+	if quick.Enable() {
+		t.Fatal("enabled without -listen or -to")
+	}
+	err := flags.Parse([]string{"-listen", ":8080, :8081", "-to", "10.0.0.1:80,10.0.0.2:80", "-lb", "leastconn",
+		"-idletimeout", "5m", "-to-ca", "ca.pem"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flag.Lookup("listen") != nil || flag.Lookup("config") != nil {
+		t.Fatal("flags registered on the global command line")
+	}
+	if !quick.Enable() {
+		t.Fatal("not enabled")
+	}
+
+	config := quick.Config()
+	if len(config.Listeners) != 2 || config.Listeners[1].Address != ":8081" {
+		t.Fatalf("listeners %+v", config.Listeners)
+	}
+	if config.Listeners[0].IdleTimeout != 5*time.Minute || config.Listeners[0].Tlsname != "" {
+		t.Fatalf("listener %+v", config.Listeners[0])
+	}
+	cluster := config.Clusters[0]
+	if len(cluster.Endpoint) != 2 || cluster.LB != "leastconn" || cluster.TlsName != QUICK_REMOTE_TLS {
+		t.Fatalf("cluster %+v", cluster)
+	}
+	if len(config.TlsCfg) != 1 || config.TlsCfg[0].CA != "ca.pem" {
+		t.Fatalf("tls %+v", config.TlsCfg)
+	}
+}
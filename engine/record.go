@@ -0,0 +1,336 @@
+package engine
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"github.com/lixiangyun/tcpproxy/proxy"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 录制文件格式：
+// 文件头 "TPRC" | 版本(1字节) | 开始时间(8字节,纳秒) | 客户端地址 | 后端地址 | 标志(1字节,bit0后端tls) | tls服务名
+// 数据块 方向(1字节,0上行/1下行) | 相对开始的微秒数(uvarint) | 长度(uvarint) | 数据
+// 字符串均以 长度(uvarint) | 内容 的方式保存，版本1的文件头没有标志和tls服务名
+const (
+	recordMagic   = "TPRC"
+	recordVersion = 2
+
+	recordFlagTls = 0x01
+)
+
+type RecordHeader struct {
+	Start   time.Time
+	Client  string
+	Backend string
+	// 后端连接使用tls，重放时同样使用tls
+	Tls        bool
+	ServerName string
+}
+
+type RecordChunk struct {
+	Up     bool
+	Offset time.Duration
+	Body   []byte
+}
+
+// 监听端口的会话录制配置
+type Recorder struct {
+	sync.Mutex
+
+	dir     string
+	nets    []*net.IPNet
+	maxSize int64
+	maxKeep int
+}
+
+func NewRecorder(cfg *RecordConfig) (*Recorder, error) {
+	nets, err := ParseCIDRs(cfg.CIDR)
+	if err != nil {
+		return nil, err
+	}
+
+	recorder := &Recorder{dir: cfg.Dir, nets: nets, maxSize: cfg.MaxSize * 1024 * 1024, maxKeep: cfg.MaxBackups}
+
+	err = os.MkdirAll(cfg.Dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return recorder, nil
+}
+
+// 为会话创建录制旁路，每个会话一个文件
+func (r *Recorder) NewTap(session *proxy.Session) proxy.Tap {
+	client, ok := session.ClientConn().RemoteAddr().(*net.TCPAddr)
+	if !ok || !MatchCIDRs(r.nets, client.IP) {
+		return nil
+	}
+	tap, err := r.open(session.Start, session.ID, session.Client, session.Backend, session.BackendConn())
+	if err != nil {
+		log.Println(err.Error())
+		return nil
+	}
+	return tap
+}
+
+// 创建录制文件，已存在同名文件时失败，不覆盖已有的录制
+func (r *Recorder) open(start time.Time, id uint64, client string, backend string, conn net.Conn) (*recordTap, error) {
+	name := fmt.Sprintf("%s-%d.tpr", start.Format("20060102-150405"), id)
+	file, err := os.OpenFile(filepath.Join(r.dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	r.clean()
+
+	tap := &recordTap{
+		file:    file,
+		writer:  bufio.NewWriter(file),
+		start:   start,
+		maxSize: r.maxSize,
+		header:  &RecordHeader{Start: start, Client: client, Backend: backend},
+		backend: conn,
+	}
+	return tap, nil
+}
+
+// 录制文件超过maxbackups时删除最早的文件，文件名以开始时间开头
+func (r *Recorder) clean() {
+	if r.maxKeep <= 0 {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+
+	list, err := filepath.Glob(filepath.Join(r.dir, "*.tpr"))
+	if err != nil {
+		return
+	}
+	sort.Strings(list)
+	for len(list) > r.maxKeep {
+		os.Remove(list[0])
+		list = list[1:]
+	}
+}
+
+type recordTap struct {
+	sync.Mutex
+
+	file    *os.File
+	writer  *bufio.Writer
+	start   time.Time
+	size    int64
+	maxSize int64
+	err     error
+
+	// 文件头在第一次写入时生成，此时后端tls已完成握手
+	header  *RecordHeader
+	backend net.Conn
+}
+
+// 写入文件头，后端为tls连接时记录服务名
+func (t *recordTap) writeHeader() {
+	header := t.header
+	t.header = nil
+	if tlsconn, ok := t.backend.(*tls.Conn); ok {
+		header.Tls = true
+		header.ServerName = tlsconn.ConnectionState().ServerName
+	}
+	t.err = writeRecordHeader(t.writer, header)
+}
+
+func (t *recordTap) Data(up bool, body []byte) {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.header != nil {
+		t.writeHeader()
+	}
+	if t.err != nil {
+		return
+	}
+	// 超过单个文件的大小限制后不再录制后续数据
+	if t.maxSize > 0 && t.size+int64(len(body)) > t.maxSize {
+		t.err = fmt.Errorf("record %s exceeds %d bytes, stop recording", t.file.Name(), t.maxSize)
+		log.Println(t.err.Error())
+		return
+	}
+	t.size += int64(len(body))
+	t.err = writeRecordChunk(t.writer, &RecordChunk{
+		Up: up, Offset: time.Since(t.start), Body: body,
+	})
+	if t.err != nil {
+		log.Println(t.err.Error())
+	}
+}
+
+func (t *recordTap) Close() {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.header != nil {
+		t.writeHeader()
+	}
+	err := t.writer.Flush()
+	if err != nil {
+		log.Println(err.Error())
+	}
+	t.file.Close()
+}
+
+func writeUvarint(w io.Writer, value uint64) error {
+	var buf [binary.MaxVarintLen64]byte
+	cnt := binary.PutUvarint(buf[:], value)
+	_, err := w.Write(buf[:cnt])
+	return err
+}
+
+func writeRecordString(w io.Writer, value string) error {
+	err := writeUvarint(w, uint64(len(value)))
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, value)
+	return err
+}
+
+func writeRecordHeader(w io.Writer, header *RecordHeader) error {
+	var buf [13]byte
+	copy(buf[:], recordMagic)
+	buf[4] = recordVersion
+	binary.BigEndian.PutUint64(buf[5:], uint64(header.Start.UnixNano()))
+
+	_, err := w.Write(buf[:])
+	if err != nil {
+		return err
+	}
+	err = writeRecordString(w, header.Client)
+	if err != nil {
+		return err
+	}
+	err = writeRecordString(w, header.Backend)
+	if err != nil {
+		return err
+	}
+
+	var flags [1]byte
+	if header.Tls {
+		flags[0] |= recordFlagTls
+	}
+	_, err = w.Write(flags[:])
+	if err != nil {
+		return err
+	}
+	return writeRecordString(w, header.ServerName)
+}
+
+func writeRecordChunk(w io.Writer, chunk *RecordChunk) error {
+	var dir [1]byte
+	if !chunk.Up {
+		dir[0] = 1
+	}
+	_, err := w.Write(dir[:])
+	if err != nil {
+		return err
+	}
+	err = writeUvarint(w, uint64(chunk.Offset/time.Microsecond))
+	if err != nil {
+		return err
+	}
+	err = writeUvarint(w, uint64(len(chunk.Body)))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(chunk.Body)
+	return err
+}
+
+func readRecordString(r *bufio.Reader) (string, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, size)
+	_, err = io.ReadFull(r, buf)
+	return string(buf), err
+}
+
+// 读取录制文件的全部内容
+func ReadRecordFile(filename string) (*RecordHeader, []RecordChunk, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+
+	var buf [13]byte
+	_, err = io.ReadFull(reader, buf[:])
+	if err != nil {
+		return nil, nil, err
+	}
+	if string(buf[:4]) != recordMagic {
+		return nil, nil, fmt.Errorf("%s is not a record file", filename)
+	}
+	if buf[4] != 1 && buf[4] != recordVersion {
+		return nil, nil, fmt.Errorf("record file version %d not support", buf[4])
+	}
+
+	header := &RecordHeader{Start: time.Unix(0, int64(binary.BigEndian.Uint64(buf[5:])))}
+	header.Client, err = readRecordString(reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	header.Backend, err = readRecordString(reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	if buf[4] >= 2 {
+		flags, err := reader.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		header.Tls = flags&recordFlagTls != 0
+		header.ServerName, err = readRecordString(reader)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var chunks []RecordChunk
+	for {
+		dir, err := reader.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		offset, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		size, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		body := make([]byte, size)
+		_, err = io.ReadFull(reader, body)
+		if err != nil {
+			return nil, nil, err
+		}
+		chunks = append(chunks, RecordChunk{
+			Up: dir == 0, Offset: time.Duration(offset) * time.Microsecond, Body: body,
+		})
+	}
+
+	return header, chunks, nil
+}
@@ -0,0 +1,239 @@
+package engine
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/lixiangyun/tcpproxy/proxy/proxytest"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "engine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// 把收到的数据转为大写后返回，客户端关闭写方向后关闭连接
+func upperHandle(conn net.Conn) {
+	buf := make([]byte, 1024)
+	for {
+		cnt, err := conn.Read(buf)
+		if cnt > 0 {
+			conn.Write(bytes.ToUpper(buf[:cnt]))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func selfSigned(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// 录制一段请求应答，返回录制文件
+func recordSession(t *testing.T, r *Recorder, backend net.Conn, id uint64) string {
+	tap, err := r.open(time.Now(), id, "127.0.0.1:40000", backend.RemoteAddr().String(), backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{"hello ", "world"} {
+		backend.Write([]byte(body))
+		tap.Data(true, []byte(body))
+		reply := make([]byte, len(body))
+		if _, err := io.ReadFull(backend, reply); err != nil {
+			t.Fatal(err)
+		}
+		tap.Data(false, reply)
+	}
+	tap.Close()
+	return tap.file.Name()
+}
+
+func replayCheck(t *testing.T, name string, address string, tlscfg *tls.Config) *RecordHeader {
+	header, chunks, err := ReadRecordFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 4 || !chunks[0].Up || chunks[1].Up || string(chunks[3].Body) != "WORLD" {
+		t.Fatalf("chunks %v", chunks)
+	}
+	if chunks[3].Offset < chunks[0].Offset {
+		t.Fatalf("offset not increasing %s %s", chunks[0].Offset, chunks[3].Offset)
+	}
+
+	// 发送完成后半关闭，后端关闭连接后立即结束，不需要等待wait
+	start := time.Now()
+	actual, err := replayRun(address, tlscfg, chunks, 0, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(actual) != "HELLO WORLD" {
+		t.Fatalf("replay response %q", actual)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("replay waited %s after backend closed", elapsed)
+	}
+	return header
+}
+
+func TestRecordReplay(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	backend, err := proxytest.NewBackend(upperHandle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	r, err := NewRecorder(&RecordConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", backend.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	header := replayCheck(t, recordSession(t, r, conn, 1), backend.Address, nil)
+	if header.Client != "127.0.0.1:40000" || header.Backend != backend.Address || header.Tls {
+		t.Fatalf("header %+v", header)
+	}
+}
+
+func TestRecordReplayTls(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	config := &tls.Config{Certificates: []tls.Certificate{selfSigned(t)}}
+	list, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer list.Close()
+	go func() {
+		for {
+			conn, err := list.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				upperHandle(conn)
+			}()
+		}
+	}()
+	address := list.Addr().String()
+
+	r, err := NewRecorder(&RecordConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := tls.Dial("tcp", address, &tls.Config{ServerName: "localhost", InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	name := recordSession(t, r, conn, 1)
+	header, _, err := ReadRecordFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !header.Tls || header.ServerName != "localhost" {
+		t.Fatalf("tls backend header %+v", header)
+	}
+	replayCheck(t, name, address, &tls.Config{ServerName: header.ServerName, InsecureSkipVerify: true})
+}
+
+func TestRecordLimit(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	backend, err := proxytest.NewBackend(upperHandle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	conn, err := net.Dial("tcp", backend.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	r, err := NewRecorder(&RecordConfig{Dir: dir, MaxBackups: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 同名文件已存在时不覆盖
+	start := time.Now()
+	tap, err := r.open(start, 1, "c", "b", conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tap.Close()
+	if _, err := r.open(start, 1, "c", "b", conn); !os.IsExist(err) {
+		t.Fatalf("open existing record got %v", err)
+	}
+
+	// 超过大小限制后不再录制
+	r.maxSize = 8
+	tap, err = r.open(start, 2, "c", "b", conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tap.Data(true, []byte("12345"))
+	tap.Data(false, []byte("67890"))
+	tap.Data(true, []byte("abc"))
+	tap.Close()
+	_, chunks, err := ReadRecordFile(tap.file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 1 || string(chunks[0].Body) != "12345" {
+		t.Fatalf("chunks after size limit %v", chunks)
+	}
+
+	// 只保留最近的maxbackups个文件
+	tap, err = r.open(start.Add(time.Second), 3, "c", "b", conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tap.Close()
+	list, _ := filepath.Glob(filepath.Join(dir, "*.tpr"))
+	if len(list) != 2 || filepath.Base(list[1]) != filepath.Base(tap.file.Name()) {
+		t.Fatalf("records left %v", list)
+	}
+}
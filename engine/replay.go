@@ -0,0 +1,203 @@
+package engine
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"github.com/lixiangyun/tcpproxy/proxy"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 打印录制文件的十六进制/ASCII内容
+func replayDump(header *RecordHeader, chunks []RecordChunk) {
+	fmt.Printf("session %s -> %s start %s\n",
+		header.Client, header.Backend, header.Start.Format(time.RFC3339Nano))
+	for _, v := range chunks {
+		dir := "->"
+		if !v.Up {
+			dir = "<-"
+		}
+		fmt.Printf("+%s %s %d bytes\n%s", v.Offset, dir, len(v.Body), hex.Dump(v.Body))
+	}
+}
+
+// 比较期望响应和实际响应，返回第一个差异的位置，一致返回-1
+func replayDiff(expect []byte, actual []byte) int {
+	for i := 0; i < len(expect) && i < len(actual); i++ {
+		if expect[i] != actual[i] {
+			return i
+		}
+	}
+	if len(expect) != len(actual) {
+		if len(expect) < len(actual) {
+			return len(expect)
+		}
+		return len(actual)
+	}
+	return -1
+}
+
+func replayContext(body []byte, offset int) []byte {
+	begin := offset - offset%16 - 32
+	if begin < 0 {
+		begin = 0
+	}
+	end := begin + 96
+	if end > len(body) {
+		end = len(body)
+	}
+	if begin > end {
+		return nil
+	}
+	return body[begin:end]
+}
+
+// 按录制的客户端数据重放到后端，收集后端响应，tlscfg不为nil时使用tls连接后端
+func replayRun(address string, tlscfg *tls.Config, chunks []RecordChunk, speed float64, wait time.Duration) ([]byte, error) {
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if tlscfg != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, tlscfg)
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var actual bytes.Buffer
+	var lock sync.Mutex
+	var sent int32
+	done := make(chan struct{})
+
+	// 数据发送完成后关闭写方向，后端关闭连接或者超过wait时间没有响应则结束接收
+	go func() {
+		defer close(done)
+		buf := make([]byte, 65535)
+		for {
+			conn.SetReadDeadline(time.Now().Add(wait))
+			cnt, err := conn.Read(buf)
+			if cnt > 0 {
+				lock.Lock()
+				actual.Write(buf[:cnt])
+				lock.Unlock()
+			}
+			if err == nil {
+				continue
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && atomic.LoadInt32(&sent) == 0 {
+				continue
+			}
+			return
+		}
+	}()
+
+	start := time.Now()
+	for _, v := range chunks {
+		if !v.Up {
+			continue
+		}
+		if speed > 0 {
+			delay := time.Duration(float64(v.Offset)/speed) - time.Since(start)
+			if delay > 0 {
+				time.Sleep(delay)
+			}
+		}
+		_, err = conn.Write(v.Body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	atomic.StoreInt32(&sent, 1)
+	proxy.CloseWrite(conn)
+	<-done
+
+	lock.Lock()
+	defer lock.Unlock()
+	return actual.Bytes(), nil
+}
+
+// replay 子命令入口
+func ReplayMain(args []string) {
+	var (
+		file  string
+		to    string
+		speed float64
+		wait  time.Duration
+		dump  bool
+
+		servername string
+		insecure   bool
+	)
+
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	flags.StringVar(&file, "file", "", "record file.")
+	flags.StringVar(&to, "to", "", "backend address, default use the recorded backend.")
+	flags.Float64Var(&speed, "speed", 1, "replay speed multiple, 0 means no delay.")
+	flags.DurationVar(&wait, "wait", 2*time.Second, "idle time to wait for backend response.")
+	flags.BoolVar(&dump, "dump", false, "print record content as hex/ascii and exit.")
+	flags.StringVar(&servername, "servername", "", "tls server name when the recorded backend used tls, default use the recorded one.")
+	flags.BoolVar(&insecure, "insecure", false, "skip backend certificate verification when replay over tls.")
+	flags.Parse(args)
+
+	if file == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	header, chunks, err := ReadRecordFile(file)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	if dump {
+		replayDump(header, chunks)
+		return
+	}
+
+	if to == "" {
+		to = header.Backend
+	}
+
+	var expect bytes.Buffer
+	for _, v := range chunks {
+		if !v.Up {
+			expect.Write(v.Body)
+		}
+	}
+
+	var tlscfg *tls.Config
+	if header.Tls {
+		if servername == "" {
+			servername = header.ServerName
+		}
+		tlscfg = &tls.Config{ServerName: servername, InsecureSkipVerify: insecure}
+	}
+
+	actual, err := replayRun(to, tlscfg, chunks, speed, wait)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	offset := replayDiff(expect.Bytes(), actual)
+	if offset == -1 {
+		fmt.Printf("replay %s to %s: response identical, %d bytes\n", file, to, len(actual))
+		return
+	}
+
+	fmt.Printf("replay %s to %s: response differ at offset %d, expect %d bytes, actual %d bytes\n",
+		file, to, offset, expect.Len(), len(actual))
+	fmt.Printf("expect:\n%s", hex.Dump(replayContext(expect.Bytes(), offset)))
+	fmt.Printf("actual:\n%s", hex.Dump(replayContext(actual, offset)))
+	os.Exit(1)
+}
@@ -0,0 +1,125 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 按大小和时间切分的日志文件
+type RotateWriter struct {
+	sync.Mutex
+
+	path       string
+	maxSize    int64
+	interval   time.Duration
+	maxBackups int
+
+	header  []byte
+	file    *os.File
+	size    int64
+	created time.Time
+}
+
+func NewRotateWriter(path string, maxSize int64, interval time.Duration, maxBackups int) (*RotateWriter, error) {
+	w := &RotateWriter{
+		path:       path,
+		maxSize:    maxSize,
+		interval:   interval,
+		maxBackups: maxBackups,
+	}
+	err := w.open()
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *RotateWriter) open() error {
+	file, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	w.file = file
+	w.size = info.Size()
+	w.created = time.Now()
+
+	if w.size == 0 && len(w.header) > 0 {
+		cnt, err := w.file.Write(w.header)
+		w.size += int64(cnt)
+		return err
+	}
+	return nil
+}
+
+// 设置文件头，每个新文件创建时先写入文件头
+func (w *RotateWriter) Header(header []byte) error {
+	w.Lock()
+	defer w.Unlock()
+
+	w.header = header
+	if w.size == 0 {
+		cnt, err := w.file.Write(header)
+		w.size += int64(cnt)
+		return err
+	}
+	return nil
+}
+
+// 当前文件改名为备份文件后重新创建，改名失败时重新打开原文件继续写入，下次写入时再次尝试
+func (w *RotateWriter) rotate() error {
+	w.file.Close()
+
+	backup := fmt.Sprintf("%s.%s", w.path, time.Now().Format("20060102-150405.000"))
+	err := os.Rename(w.path, backup)
+	if err != nil {
+		if oerr := w.open(); oerr != nil {
+			return oerr
+		}
+		return err
+	}
+
+	if w.maxBackups > 0 {
+		list, _ := filepath.Glob(w.path + ".*")
+		sort.Strings(list)
+		for len(list) > w.maxBackups {
+			os.Remove(list[0])
+			list = list[1:]
+		}
+	}
+
+	return w.open()
+}
+
+func (w *RotateWriter) Write(body []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+
+	full := w.maxSize > 0 && w.size+int64(len(body)) > w.maxSize
+	expire := w.interval > 0 && time.Since(w.created) >= w.interval
+	if (full && w.size > int64(len(w.header))) || expire {
+		err := w.rotate()
+		if err != nil {
+			log.Println(err.Error())
+		}
+	}
+
+	cnt, err := w.file.Write(body)
+	w.size += int64(cnt)
+	return cnt, err
+}
+
+func (w *RotateWriter) Close() error {
+	w.Lock()
+	defer w.Unlock()
+	return w.file.Close()
+}
@@ -0,0 +1,191 @@
+package engine
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readFile(t *testing.T, path string) string {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestRotateSize(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.log")
+
+	w, err := NewRotateWriter(path, 20, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if err := w.Header([]byte("HDR\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		// 备份文件名精确到毫秒
+		time.Sleep(2 * time.Millisecond)
+		if _, err := w.Write([]byte("0123456789\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 每个文件只能容纳一行，最多保留两个备份
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 2 {
+		t.Fatalf("backups %v, want 2", backups)
+	}
+	sort.Strings(backups)
+	backups = append(backups, path)
+	for _, v := range backups {
+		if body := readFile(t, v); body != "HDR\n0123456789\n" {
+			t.Fatalf("%s content %q", v, body)
+		}
+	}
+
+	// 单条记录超过大小限制时不切分空文件
+	if _, err := w.Write([]byte(strings.Repeat("x", 30))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte(strings.Repeat("y", 30))); err != nil {
+		t.Fatal(err)
+	}
+	if body := readFile(t, path); body != "HDR\n"+strings.Repeat("y", 30) {
+		t.Fatalf("oversize content %q", body)
+	}
+}
+
+func TestRotateInterval(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.log")
+
+	w, err := NewRotateWriter(path, 0, 50*time.Millisecond, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	w.Write([]byte("first\n"))
+	time.Sleep(60 * time.Millisecond)
+	w.Write([]byte("second\n"))
+
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 1 || readFile(t, backups[0]) != "first\n" || readFile(t, path) != "second\n" {
+		t.Fatalf("backups %v, current %q", backups, readFile(t, path))
+	}
+}
+
+// 切分时改名失败，继续写入原路径，不丢失数据
+func TestRotateRenameFailed(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.log")
+
+	w, err := NewRotateWriter(path, 10, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	w.Write([]byte("0123456789"))
+
+	// 文件被外部删除，改名失败
+	os.Remove(path)
+	if _, err := w.Write([]byte("after\n")); err != nil {
+		t.Fatalf("write after rename failed got %v", err)
+	}
+	if body := readFile(t, path); body != "after\n" {
+		t.Fatalf("content %q", body)
+	}
+	if backups, _ := filepath.Glob(path + ".*"); len(backups) != 0 {
+		t.Fatalf("unexpected backups %v", backups)
+	}
+}
+
+func TestAccessLogFormat(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	defer func() { accessLog = nil }()
+
+	record := &AccessRecord{
+		Time:     time.Date(2020, 1, 1, 12, 0, 1, 0, time.UTC),
+		Start:    time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC),
+		Listener: ":8080",
+		Client:   "10.0.0.1:40000",
+		Backend:  "10.0.0.2:80",
+		Up:       10,
+		Down:     20,
+		Duration: 1,
+		Reason:   "client_close",
+		Tags:     map[string]string{"route": "api"},
+	}
+
+	path := filepath.Join(dir, "access.log")
+	if err := AccessLogInit(&AccessLogConfig{Path: path}); err != nil {
+		t.Fatal(err)
+	}
+	accessLog.Write(record)
+	record.Tags = nil
+	record.Reason = "dial tcp: refused\nagain"
+	accessLog.Write(record)
+
+	// 每条记录一行，可以逐行解析
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	var lines []map[string]interface{}
+	for scanner.Scan() {
+		var line map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("line %q is not json, %s", scanner.Text(), err.Error())
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) != 2 {
+		t.Fatalf("lines %d, want 2", len(lines))
+	}
+	first := lines[0]
+	if first["client"] != "10.0.0.1:40000" || first["up"] != float64(10) || first["reason"] != "client_close" ||
+		first["time"] != "2020-01-01T12:00:01Z" || first["tags"].(map[string]interface{})["route"] != "api" {
+		t.Fatalf("first line %v", first)
+	}
+	if _, ok := first["tls_version"]; ok {
+		t.Fatal("empty tls fields must be omitted")
+	}
+	if _, ok := lines[1]["tags"]; ok || lines[1]["reason"] != "dial tcp: refused\nagain" {
+		t.Fatalf("second line %v", lines[1])
+	}
+
+	accessLog.writer.Close()
+
+	// 模板格式自动补充换行
+	path = filepath.Join(dir, "template.log")
+	err = AccessLogInit(&AccessLogConfig{Path: path, Format: "template", Template: "{{.Client}} {{.Backend}} {{.Reason}}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	record.Reason = "idle_timeout"
+	accessLog.Write(record)
+	accessLog.writer.Close()
+	if body := readFile(t, path); body != "10.0.0.1:40000 10.0.0.2:80 idle_timeout\n" {
+		t.Fatalf("template line %q", body)
+	}
+
+	if err := AccessLogInit(&AccessLogConfig{Path: path, Format: "xml"}); err == nil {
+		t.Fatal("unknown format must fail")
+	}
+}
@@ -0,0 +1,73 @@
+package engine
+
+import (
+	"fmt"
+	"github.com/lixiangyun/tcpproxy/proxy"
+	"time"
+)
+
+// 会话结束原因
+const (
+	REASON_CLIENT_CLOSE  = proxy.REASON_CLIENT_CLOSE
+	REASON_BACKEND_CLOSE = proxy.REASON_BACKEND_CLOSE
+	REASON_CLIENT_ERROR  = proxy.REASON_CLIENT_ERROR
+	REASON_BACKEND_ERROR = proxy.REASON_BACKEND_ERROR
+	REASON_TERMINATE     = proxy.REASON_TERMINATE
+
+	REASON_IDLE_TIMEOUT      = proxy.REASON_IDLE_TIMEOUT
+	REASON_MAX_DURATION      = proxy.REASON_MAX_DURATION
+	REASON_HANDSHAKE_TIMEOUT = proxy.REASON_HANDSHAKE_TIMEOUT
+	REASON_HANDSHAKE_ERROR   = proxy.REASON_HANDSHAKE_ERROR
+
+	// 没有建立会话的连接
+	REASON_DENIED        = "denied"
+	REASON_REJECTED      = "rejected"
+	REASON_CONNECT_ERROR = "connect_error"
+)
+
+// 会话对外展示的信息
+type SessionInfo struct {
+	ID        uint64    `json:"id"`
+	Listener  string    `json:"listener"`
+	Client    string    `json:"client"`
+	Backend   string    `json:"backend"`
+	Start     time.Time `json:"start"`
+	Up        int64     `json:"up"`
+	Down      int64     `json:"down"`
+	UpSpeed   int64     `json:"up_speed"`
+	DownSpeed int64     `json:"down_speed"`
+	Idle      float64   `json:"idle"`
+}
+
+// 获取会话列表，速率按最近一个采样间隔计算，多个查询者互不影响
+func SessionList(p *proxy.Proxy) []SessionInfo {
+	list := p.Sessions()
+	output := make([]SessionInfo, 0, len(list))
+	for _, s := range list {
+		up, down := s.Flows()
+		info := SessionInfo{
+			ID:       s.ID,
+			Listener: s.Listener,
+			Client:   s.Client,
+			Backend:  s.Backend,
+			Start:    s.Start,
+			Up:       up,
+			Down:     down,
+			Idle:     s.Idle().Seconds(),
+		}
+		info.UpSpeed, info.DownSpeed = s.Speed()
+		output = append(output, info)
+	}
+	return output
+}
+
+// 强制关闭指定会话
+func SessionClose(p *proxy.Proxy, id uint64) error {
+	for _, s := range p.Sessions() {
+		if s.ID == id {
+			s.Close()
+			return nil
+		}
+	}
+	return fmt.Errorf("session %d not found", id)
+}
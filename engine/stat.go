@@ -1,14 +1,13 @@
-package main
+package engine
 
 import (
 	"fmt"
+	"github.com/lixiangyun/tcpproxy/proxy"
 	"log"
-	"sync/atomic"
 	"time"
 )
 
-var gtotalUpSize uint64
-var gtotalDownSize uint64
+var gtotal = proxy.NewStats()
 
 func init() {
 	ticker := time.NewTicker(10 * time.Second)
@@ -21,13 +20,12 @@ func init() {
 }
 
 func Add(up int, down int) {
-	atomic.AddUint64(&gtotalUpSize, uint64(up))
-	atomic.AddUint64(&gtotalDownSize, uint64(down))
+	gtotal.Add(up, down)
 }
 
 func display() {
-	log.Printf("↑%s ↓%s\n",
-		calcUnit(gtotalUpSize), calcUnit(gtotalDownSize))
+	up, down := gtotal.Flows()
+	log.Printf("↑%s ↓%s\n", calcUnit(uint64(up)), calcUnit(uint64(down)))
 }
 
 func calcUnit(cnt uint64) string {
@@ -1,194 +1,206 @@
-package main
+package engine
 
 import (
-	"crypto/tls"
+	"context"
 	"fmt"
-
-	//"io"
+	"github.com/lixiangyun/tcpproxy/acl"
+	"github.com/lixiangyun/tcpproxy/ban"
+	"github.com/lixiangyun/tcpproxy/discovery"
+	"github.com/lixiangyun/tcpproxy/limit"
+	"github.com/lixiangyun/tcpproxy/proxy"
+	"github.com/lixiangyun/tcpproxy/sockopt"
 	"log"
-	"net"
-	"sync"
 	"time"
 )
 
+// 按配置生成的代理，全部监听共用一个proxy.Proxy，每个集群只有一个实例和一个成员发现
 type TcpProxy struct {
-	ListenTls  *tls.Config
-	ListenAddr string
-	RemoteTls  *tls.Config
-	RemoteAddr []string
-}
+	Proxy *proxy.Proxy
 
-func NewTcpProxy(local string, localtls *tls.Config, remote []string, remotetls *tls.Config) *TcpProxy {
-	return &TcpProxy{ListenTls: localtls, ListenAddr: local, RemoteTls: remotetls, RemoteAddr: remote}
+	pools []*discovery.Pool
+	acls  []*acl.List
 }
 
-func writeFull(conn net.Conn, buf []byte) error {
-	totallen := len(buf)
-	sendcnt := 0
+// 按当前配置创建代理，chain为全部监听共用的中间件，在路由表达式之后调用
+func NewTcpProxy(chain proxy.Chain) (*TcpProxy, error) {
+	listeners := listenerGetAll()
+	if 0 == len(listeners) {
+		return nil, fmt.Errorf("no listenner")
+	}
 
-	for {
-		cnt, err := conn.Write(buf[sendcnt:])
-		if err != nil {
-			return err
-		}
-		if cnt+sendcnt >= totallen {
-			return nil
-		}
-		sendcnt += cnt
+	t := new(TcpProxy)
+	opts := []proxy.Option{
+		proxy.WithStats(gtotal),
+		proxy.WithMiddleware(chain...),
+		proxy.WithHooks(proxy.Hooks{OnError: tcpProxyError, OnConnect: tcpProxyConnect, OnClose: tcpProxyClose}),
 	}
-}
 
-// tcp通道互通
-func tcpChannel(up bool, prefix string, localconn net.Conn, remoteconn net.Conn, wait *sync.WaitGroup) {
-	defer wait.Done()
-	defer localconn.Close()
-	defer remoteconn.Close()
-	buf := make([]byte, 65535)
-	for {
-		cnt, err := localconn.Read(buf[0:])
-		if err != nil {
-			if cnt != 0 {
-				writeFull(remoteconn, buf[0:cnt])
-			}
-			break
+	for _, v := range clusterGetAll() {
+		opts = append(opts, proxy.WithCluster(t.cluster(v)))
+	}
+
+	for _, v := range listeners {
+		cluster := ClusterGet(v.Cluster)
+		if cluster == nil {
+			t.Close()
+			return nil, fmt.Errorf("not found %s cluster", v.Cluster)
 		}
-		if up {
-			Add(cnt, 0)
-		} else {
-			Add(0, cnt)
+		if len(cluster.Endpoint) == 0 {
+			t.Close()
+			return nil, fmt.Errorf("not found %s cluster endpoint", v.Cluster)
 		}
 
-		if debug {
-			log.Printf("%s body:[%v]\r\n", prefix, buf[0:cnt])
-		}
-		err = writeFull(remoteconn, buf[0:cnt])
+		listen, err := t.listener(v)
 		if err != nil {
-			break
+			t.Close()
+			return nil, fmt.Errorf("listener %s %s", v.Address, err.Error())
 		}
+		opts = append(opts, proxy.WithListener(v.Address, v.Cluster, listen...))
 	}
-}
-
-// tcp代理处理
-func tcpProxyProcess(localconn net.Conn, remoteconn net.Conn) {
-
-	localremote := fmt.Sprintf("%s->%s",
-		localconn.RemoteAddr().String(),
-		remoteconn.RemoteAddr().String())
-
-	remotelocal := fmt.Sprintf("%s->%s",
-		remoteconn.RemoteAddr().String(),
-		localconn.RemoteAddr().String())
-
-	log.Println("new connect. ", localremote)
 
-	syncSem := new(sync.WaitGroup)
-	syncSem.Add(2)
-	go tcpChannel(true, localremote, localconn, remoteconn, syncSem)
-	go tcpChannel(false, remotelocal, remoteconn, localconn, syncSem)
-	syncSem.Wait()
-
-	log.Println("close connect. ", localremote)
+	t.Proxy = proxy.New(opts...)
+	return t, nil
 }
 
-// 正向tcp代理启动和处理入口
-func (t *TcpProxy) Start() error {
-	var times int
-
-	listen, err := net.Listen("tcp", t.ListenAddr)
-	if err != nil {
-		return err
+// 集群及其成员发现，没有成员的集群只用于配置检查
+func (t *TcpProxy) cluster(cfg ClusterConfig) *proxy.Cluster {
+	cluster := proxy.NewCluster(cfg.Name, proxy.NewBalancer(cfg.LB),
+		proxy.ClusterDialer(sockopt.NewDialer(0, cfg.SockOpt)))
+	if tls := TlsGet(cfg.TlsName); tls != nil {
+		cluster.TLS = TlsClientConfig(tls)
+	}
+	if len(cfg.Endpoint) == 0 {
+		return cluster
 	}
 
+	pool := discovery.NewPool(cfg.Endpoint, cfg.Resolve)
+	cluster.UpdateEndpoints(pool.Endpoints())
+	pool.OnUpdate = cluster.UpdateEndpoints
+	pool.Start()
+	t.pools = append(t.pools, pool)
+
 	var remoteaddr string
-	for _, v := range t.RemoteAddr {
-		remoteaddr += v + " "
+	for _, v := range cluster.Endpoints() {
+		remoteaddr += v.Address + " "
 	}
+	log.Printf("cluster : %s -> %s", cfg.Name, remoteaddr)
+	return cluster
+}
 
-	log.Printf("listen : %s -> %s", t.ListenAddr, remoteaddr)
+// 监听的接入检查、限速、超时、路由和旁路配置
+func (t *TcpProxy) listener(v ListernerConfig) ([]proxy.ListenerOption, error) {
+	opts := []proxy.ListenerOption{
+		proxy.ListenSockOpt(v.SockOpt),
+		proxy.ListenLimit(limit.New(v.Limit)),
+		proxy.ListenThrottle(limit.NewThrottle(v.Bandwidth)),
+		proxy.ListenIdleTimeout(v.IdleTimeout),
+		proxy.ListenMaxDuration(v.MaxDuration),
+		proxy.ListenHandshakeTimeout(v.HandshakeTimeout),
+	}
 
-	for {
-		var localconn net.Conn
-		var remoteconn net.Conn
+	if tls := TlsGet(v.Tlsname); tls != nil {
+		opts = append(opts, proxy.ListenTLS(TlsServerConfig(tls)))
+	}
 
-		localconn, err = listen.Accept()
+	if v.Route != "" {
+		router, err := proxy.NewRouter(v.Route, nil)
 		if err != nil {
-			log.Println(err.Error())
-			continue
+			return nil, fmt.Errorf("route init failed %s", err.Error())
 		}
+		router.Timeout = v.HandshakeTimeout
+		opts = append(opts, proxy.ListenRouter(router))
+	}
 
-		if t.ListenTls != nil {
-			localconn = tls.Server(localconn, t.ListenTls)
-		}
-
-		for i := 0; i < len(t.RemoteAddr); i++ {
-			remoteaddr := t.RemoteAddr[times]
-			times = (times + 1) % len(t.RemoteAddr)
-
-			remoteconn, err = net.Dial("tcp", remoteaddr)
-			if err != nil {
-				log.Println(err.Error())
-				continue
-			}
+	list, err := acl.New(v.Acl)
+	if err != nil {
+		return nil, fmt.Errorf("acl init failed %s", err.Error())
+	}
+	t.acls = append(t.acls, list)
+	opts = append(opts, proxy.ListenACL(list))
 
-			log.Println("proxy connect to ", remoteaddr)
-			break
-		}
+	detector := ban.NewDetector(v.Ban, v.Address, banTable)
+	if detector != nil {
+		detector.OnBan = banLog
+		opts = append(opts, proxy.ListenBan(detector))
+	}
 
-		if remoteconn == nil {
-			localconn.Close()
-			continue
+	if v.Capture != nil {
+		capture, err := NewCapture(v.Capture)
+		if err != nil {
+			return nil, fmt.Errorf("capture init failed %s", err.Error())
 		}
+		opts = append(opts, proxy.ListenTap(capture.NewTap))
+	}
 
-		if t.RemoteTls != nil {
-			remoteconn = tls.Client(remoteconn, t.RemoteTls)
+	if v.Record != nil {
+		recorder, err := NewRecorder(v.Record)
+		if err != nil {
+			return nil, fmt.Errorf("record init failed %s", err.Error())
 		}
-
-		go tcpProxyProcess(localconn, remoteconn)
+		opts = append(opts, proxy.ListenTap(recorder.NewTap))
 	}
+	return opts, nil
+}
 
+// 启动全部监听
+func (t *TcpProxy) Start(ctx context.Context) error {
+	err := t.Proxy.Start(ctx)
+	if err != nil {
+		return err
+	}
+	for _, addr := range t.Proxy.Addrs() {
+		log.Printf("listen : %s", addr.String())
+	}
 	return nil
 }
 
-func TcpProxyStart() {
-
-	listeners := listenerGetAll()
-	if 0 == len(listeners) {
-		log.Fatalln("no listenner.")
+// 立即关闭代理，停止成员发现和访问控制规则的重新加载
+func (t *TcpProxy) Close() {
+	if t.Proxy != nil {
+		t.Proxy.Close()
 	}
+	for _, pool := range t.pools {
+		pool.Close()
+	}
+	for _, list := range t.acls {
+		list.Close()
+	}
+}
 
-	for _, v := range listeners {
-
-		var localtls *tls.Config
-		var remotetls *tls.Config
-
-		tls := TlsGet(v.Tlsname)
-		if tls != nil {
-			localtls = TlsServerConfig(tls)
-		}
-
-		cluster := ClusterGet(v.Cluster)
-		if cluster == nil {
-			log.Fatalf("not found %s cluster.", v.Cluster)
-		}
+func sessionPeer(s *proxy.Session) string {
+	return fmt.Sprintf("%s->%s", s.Client, s.Backend)
+}
 
-		if len(cluster.Endpoint) == 0 {
-			log.Fatalf("not found %s cluster endpoint.", v.Cluster)
-		}
+// 连接被拒绝或者后端连接失败
+func tcpProxyError(info *proxy.ConnInfo, err error) {
+	AccessLogReject(info, err)
+	if ae, ok := err.(*proxy.AdmitError); ok && ae.Deny {
+		log.Printf("deny connect %s, %s", info.Conn.RemoteAddr().String(), err.Error())
+	} else {
+		log.Printf("reject connect %s, %s", info.Conn.RemoteAddr().String(), err.Error())
+	}
+}
 
-		tls = TlsGet(cluster.TlsName)
-		if tls != nil {
-			remotetls = TlsClientConfig(tls, cluster.Endpoint[0])
-		}
+func tcpProxyConnect(s *proxy.Session) {
+	log.Println("new connect. ", sessionPeer(s))
+}
 
-		tcoporxy := NewTcpProxy(v.Address, localtls, cluster.Endpoint, remotetls)
+func tcpProxyClose(s *proxy.Session) {
+	AccessLogWrite(s)
+	log.Println("close connect. ", sessionPeer(s), s.Reason())
+}
 
-		go func() {
-			err := tcoporxy.Start()
-			if err != nil {
-				log.Fatalf("tcp proxy start failed %v.", v)
-			}
-		}()
+// 按已加载的配置启动代理，admin为空时不启动管理接口
+func TcpProxyStart(admin string, chain proxy.Chain) {
+	t, err := NewTcpProxy(chain)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	err = t.Start(context.Background())
+	if err != nil {
+		log.Fatalf("tcp proxy start failed %s.", err.Error())
 	}
+	AdminStart(admin, t.Proxy)
 
 	for {
 		time.Sleep(time.Second * 100)
@@ -0,0 +1,198 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/lixiangyun/tcpproxy/acl"
+	"github.com/lixiangyun/tcpproxy/proxy/proxytest"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 按配置启动代理，两个监听共用集群，路由表达式转发到另一个集群
+func TestTcpProxy(t *testing.T) {
+	upper, err := proxytest.NewBackend(upperHandle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upper.Close()
+	echo, err := proxytest.NewEchoBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	globalconfig = &GlobalConfig{
+		Listeners: []ListernerConfig{
+			{Address: "127.0.0.1:0", Cluster: "web", Record: &RecordConfig{Dir: dir}},
+			{Address: "127.0.0.1:0", Cluster: "web", Route: "port > 0 ? 'cluster:api tag:route=api' : ''"},
+		},
+		Clusters: []ClusterConfig{
+			{Name: "web", Endpoint: []string{upper.Address}},
+			{Name: "api", Endpoint: []string{echo.Address}},
+			{Name: "empty"},
+		},
+	}
+	defer func() { globalconfig = nil }()
+
+	tcp, err := NewTcpProxy(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	if len(tcp.pools) != 2 {
+		t.Fatalf("pools %d, want one per cluster with endpoints", len(tcp.pools))
+	}
+	if err := tcp.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	addrs := tcp.Proxy.Addrs()
+
+	reply, err := proxytest.Roundtrip(addrs[0].String(), []byte("hello"))
+	if err != nil || string(reply) != "HELLO" {
+		t.Fatalf("default cluster reply %q, %v", reply, err)
+	}
+	reply, err = proxytest.Roundtrip(addrs[1].String(), []byte("hello"))
+	if err != nil || string(reply) != "hello" {
+		t.Fatalf("routed cluster reply %q, %v", reply, err)
+	}
+
+	// 录制文件在会话结束后写入
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		list, _ := filepath.Glob(filepath.Join(dir, "*.tpr"))
+		if len(list) == 1 {
+			break
+		}
+		if time.Since(start) > 2*time.Second {
+			t.Fatalf("records %v, want 1", list)
+		}
+	}
+	up, down := gtotal.Flows()
+	if up < 10 || down < 10 {
+		t.Fatalf("total up %d down %d", up, down)
+	}
+}
+
+func TestSessionListClose(t *testing.T) {
+	upper, err := proxytest.NewBackend(upperHandle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upper.Close()
+
+	globalconfig = &GlobalConfig{
+		Listeners: []ListernerConfig{{Address: "127.0.0.1:0", Cluster: "web"}},
+		Clusters:  []ClusterConfig{{Name: "web", Endpoint: []string{upper.Address}}},
+	}
+	defer func() { globalconfig = nil }()
+
+	tcp, err := NewTcpProxy(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	if err := tcp.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.DialTimeout("tcp", tcp.Proxy.Addrs()[0].String(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("ping"))
+	reply := make([]byte, 4)
+	if _, err := conn.Read(reply); err != nil || string(reply) != "PING" {
+		t.Fatalf("reply %q, %v", reply, err)
+	}
+
+	list := SessionList(tcp.Proxy)
+	// 零拷贝转发的流量按间隔统计，这里只检查会话本身
+	if len(list) != 1 || list[0].Client != conn.LocalAddr().String() {
+		t.Fatalf("sessions %+v", list)
+	}
+	if err := SessionClose(tcp.Proxy, list[0].ID+1); err == nil {
+		t.Fatal("close unknown session succeeded")
+	}
+	if err := SessionClose(tcp.Proxy, list[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Read(reply); err == nil {
+		t.Fatal("session not closed")
+	}
+}
+
+// 拒绝、封禁和后端连接失败的连接同样写入访问日志
+func TestAccessLogReject(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	defer func() { accessLog = nil }()
+	path := filepath.Join(dir, "access.log")
+	if err := AccessLogInit(&AccessLogConfig{Path: path}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 已关闭的端口
+	list, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := list.Addr().String()
+	list.Close()
+
+	globalconfig = &GlobalConfig{
+		Listeners: []ListernerConfig{
+			{Address: "127.0.0.1:0", Cluster: "down", Acl: &acl.Config{Deny: []string{"127.0.0.0/8"}}},
+			{Address: "127.0.0.1:0", Cluster: "down"},
+			{Address: "127.0.0.1:0", Cluster: "down", Route: "'tag:route=none reject'"},
+		},
+		Clusters: []ClusterConfig{{Name: "down", Endpoint: []string{closed}}},
+	}
+	defer func() { globalconfig = nil }()
+
+	tcp, err := NewTcpProxy(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	if err := tcp.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{REASON_DENIED, REASON_CONNECT_ERROR, REASON_REJECTED}
+	for i, addr := range tcp.Proxy.Addrs() {
+		proxytest.Roundtrip(addr.String(), []byte("hello"))
+
+		var records []AccessRecord
+		for start := time.Now(); len(records) <= i; time.Sleep(10 * time.Millisecond) {
+			if time.Since(start) > 2*time.Second {
+				t.Fatalf("access log %d records, want %d", len(records), i+1)
+			}
+			records = nil
+			for _, line := range strings.Split(strings.TrimSpace(readFile(t, path)), "\n") {
+				var record AccessRecord
+				if json.Unmarshal([]byte(line), &record) == nil {
+					records = append(records, record)
+				}
+			}
+		}
+		record := records[i]
+		if record.Reason != want[i] || record.Error == "" || record.Client == "" {
+			t.Fatalf("record %d %+v, want reason %s", i, record, want[i])
+		}
+		if want[i] == REASON_CONNECT_ERROR && record.Backend != closed {
+			t.Fatalf("connect error backend %s, want %s", record.Backend, closed)
+		}
+		if want[i] == REASON_REJECTED && record.Tags["route"] != "none" {
+			t.Fatalf("rejected record tags %v", record.Tags)
+		}
+	}
+}
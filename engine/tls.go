@@ -1,13 +1,43 @@
-package main
+package engine
 
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/pem"
+	"fmt"
 	"io/ioutil"
 	"log"
 )
 
-func TlsClientConfig(cfg *TlsConfig, addr string) *tls.Config {
+// 加载证书和私钥，私钥加密时使用passphrase解密
+func TlsKeyPair(cfg *TlsConfig) (tls.Certificate, error) {
+	if cfg.Passphrase == "" {
+		return tls.LoadX509KeyPair(cfg.Cert, cfg.Key)
+	}
+	certPEM, err := ioutil.ReadFile(cfg.Cert)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err := ioutil.ReadFile(cfg.Key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return tls.Certificate{}, fmt.Errorf("no pem block found in %s", cfg.Key)
+	}
+	if x509.IsEncryptedPEMBlock(block) {
+		der, err := x509.DecryptPEMBlock(block, []byte(cfg.Passphrase))
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("decrypt key %s failed, %s", cfg.Key, err.Error())
+		}
+		keyPEM = pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: der})
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// ServerName为空，连接时由集群按选中的后端设置
+func TlsClientConfig(cfg *TlsConfig) *tls.Config {
 	var pool *x509.CertPool
 
 	if cfg.CA != "" {
@@ -20,7 +50,7 @@ func TlsClientConfig(cfg *TlsConfig, addr string) *tls.Config {
 		pool.AppendCertsFromPEM(buf)
 	}
 
-	cert, err := tls.LoadX509KeyPair(cfg.Cert, cfg.Key)
+	cert, err := TlsKeyPair(cfg)
 	if err != nil {
 		log.Fatal(err.Error())
 		return nil
@@ -34,7 +64,6 @@ func TlsClientConfig(cfg *TlsConfig, addr string) *tls.Config {
 	}
 
 	return &tls.Config{
-		ServerName:         addr,
 		InsecureSkipVerify: bSkipVerify,
 		RootCAs:            pool,
 		Certificates:       []tls.Certificate{cert},
@@ -56,7 +85,7 @@ func TlsServerConfig(cfg *TlsConfig) *tls.Config {
 	}
 
 	//加载服务端证书
-	crt, err := tls.LoadX509KeyPair(cfg.Cert, cfg.Key)
+	crt, err := TlsKeyPair(cfg)
 	if err != nil {
 		log.Fatal(err.Error())
 		return nil
@@ -0,0 +1,584 @@
+package engine
+
+import (
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"github.com/lixiangyun/tcpproxy/acl"
+	"github.com/lixiangyun/tcpproxy/ban"
+	"github.com/lixiangyun/tcpproxy/discovery"
+	"github.com/lixiangyun/tcpproxy/limit"
+	"github.com/lixiangyun/tcpproxy/proxy"
+	"github.com/lixiangyun/tcpproxy/schema"
+	"github.com/lixiangyun/tcpproxy/sockopt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// 配置问题，Line为0表示无法定位到具体行
+type ConfigProblem struct {
+	File    string
+	Line    int
+	Message string
+}
+
+func (p ConfigProblem) String() string {
+	if p.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s", p.File, p.Line, p.Message)
+	}
+	return fmt.Sprintf("%s: %s", p.File, p.Message)
+}
+
+// 全部配置问题，作为LoadConfig的错误返回
+type ConfigError []ConfigProblem
+
+func (e ConfigError) Error() string {
+	var output []string
+	for _, v := range e {
+		output = append(output, v.String())
+	}
+	return strings.Join(output, "\n")
+}
+
+var (
+	yamlKeyRegexp  = regexp.MustCompile(`^("[^"]*"|'[^']*'|[A-Za-z0-9_\-]+)\s*:(\s|$)`)
+	yamlLineRegexp = regexp.MustCompile(`line (\d+): (.*)`)
+)
+
+type yamlFrame struct {
+	indent int
+	path   string
+	item   bool
+}
+
+// 按缩进扫描块格式的yaml，记录每个键和列表项所在的行，路径格式为 listeners.0.cluster，
+// 流格式([a, b])内部的元素无法定位，使用所在键的行
+func yamlPositions(body []byte) map[string]int {
+	positions := make(map[string]int)
+	counters := make(map[string]int)
+	var stack []yamlFrame
+
+	top := func() yamlFrame {
+		if len(stack) == 0 {
+			return yamlFrame{indent: -1}
+		}
+		return stack[len(stack)-1]
+	}
+	key := func(indent int, text string, line int) {
+		match := yamlKeyRegexp.FindStringSubmatch(text)
+		if match == nil {
+			return
+		}
+		for len(stack) > 0 && top().indent >= indent {
+			stack = stack[:len(stack)-1]
+		}
+		path := strings.Trim(match[1], `"'`)
+		if parent := top().path; parent != "" {
+			path = parent + "." + path
+		}
+		stack = append(stack, yamlFrame{indent: indent, path: path})
+		positions[path] = line
+	}
+
+	for idx, raw := range strings.Split(string(body), "\n") {
+		line := idx + 1
+		text := strings.TrimRight(raw, " \t\r")
+		content := strings.TrimLeft(text, " ")
+		if content == "" || strings.HasPrefix(content, "#") || content == "---" {
+			continue
+		}
+		indent := len(text) - len(content)
+
+		if content != "-" && !strings.HasPrefix(content, "- ") {
+			key(indent, content, line)
+			continue
+		}
+
+		// 列表项可以和父键同一缩进
+		for len(stack) > 0 && (top().indent > indent || top().indent == indent && top().item) {
+			stack = stack[:len(stack)-1]
+		}
+		parent := top().path
+		path := fmt.Sprintf("%s.%d", parent, counters[parent])
+		counters[parent]++
+		stack = append(stack, yamlFrame{indent: indent, path: path, item: true})
+		positions[path] = line
+
+		rest := strings.TrimLeft(strings.TrimPrefix(content, "-"), " ")
+		if rest != "" {
+			key(len(text)-len(rest), rest, line)
+		}
+	}
+	return positions
+}
+
+// include的片段中的配置在合并后的位置
+type configOrigin struct {
+	file      string
+	positions map[string]int
+	path      string
+}
+
+type configChecker struct {
+	file      string
+	positions map[string]int
+	// 替换引用后重新编码的文本的行号对应原文件的行号
+	lines     map[int]int
+	fragments map[string]configOrigin
+	problems  ConfigError
+}
+
+// 找不到路径时逐级使用上层路径的行
+func yamlLine(positions map[string]int, path string) int {
+	for path != "" {
+		if line, ok := positions[path]; ok {
+			return line
+		}
+		idx := strings.LastIndex(path, ".")
+		if idx < 0 {
+			break
+		}
+		path = path[:idx]
+	}
+	return 0
+}
+
+// 定位路径所在的文件和行，合并进来的片段使用片段文件中的位置
+func (c *configChecker) locate(path string) (string, int) {
+	for prefix := path; prefix != ""; {
+		if v, ok := c.fragments[prefix]; ok {
+			return v.file, yamlLine(v.positions, v.path+strings.TrimPrefix(path, prefix))
+		}
+		idx := strings.LastIndex(prefix, ".")
+		if idx < 0 {
+			break
+		}
+		prefix = prefix[:idx]
+	}
+	return c.file, yamlLine(c.positions, path)
+}
+
+func (c *configChecker) add(path string, format string, v ...interface{}) {
+	file, line := c.locate(path)
+	c.problems = append(c.problems, ConfigProblem{File: file, Line: line, Message: fmt.Sprintf(format, v...)})
+}
+
+// yaml库的错误信息中带有 line N，提取为行号
+func (c *configChecker) yamlError(err error) {
+	var messages []string
+	if terr, ok := err.(*yaml.TypeError); ok {
+		messages = terr.Errors
+	} else {
+		messages = []string{strings.TrimPrefix(err.Error(), "yaml: ")}
+	}
+	for _, v := range messages {
+		problem := ConfigProblem{File: c.file, Message: v}
+		if match := yamlLineRegexp.FindStringSubmatch(v); match != nil {
+			problem.Line, _ = strconv.Atoi(match[1])
+			problem.Message = match[2]
+			if c.lines != nil {
+				problem.Line = c.lines[problem.Line]
+			}
+		}
+		c.problems = append(c.problems, problem)
+	}
+}
+
+func (c *configChecker) address(path string, value string) {
+	host, port, err := net.SplitHostPort(value)
+	if err != nil {
+		c.add(path, "invalid address %q, %s", value, err.Error())
+		return
+	}
+	cnt, err := strconv.Atoi(port)
+	if err != nil || cnt < 0 || cnt > 65535 {
+		c.add(path, "invalid port in address %q", value)
+	}
+	if host != "" && net.ParseIP(host) == nil && strings.ContainsAny(host, " /\\") {
+		c.add(path, "invalid host in address %q", value)
+	}
+}
+
+func (c *configChecker) readable(path string, name string) bool {
+	if name == "" {
+		return false
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		c.add(path, "%s", err.Error())
+		return false
+	}
+	file.Close()
+	return true
+}
+
+func (c *configChecker) endpoint(path string, value string) {
+	switch {
+	case strings.HasPrefix(value, discovery.SRV_PREFIX):
+		if strings.TrimPrefix(value, discovery.SRV_PREFIX) == "" {
+			c.add(path, "empty srv name in %q", value)
+		}
+	case strings.HasPrefix(value, discovery.FILE_PREFIX):
+		c.readable(path, strings.TrimPrefix(value, discovery.FILE_PREFIX))
+	case strings.HasPrefix(value, discovery.CONSUL_PREFIX), strings.HasPrefix(value, discovery.ETCD_PREFIX):
+		if _, err := discovery.NewWatcher(value); err != nil {
+			c.add(path, "%s", err.Error())
+		}
+	case discovery.IsProvider(value):
+		if u, err := url.Parse(value); err != nil || u.Host == "" {
+			c.add(path, "invalid url %q", value)
+		}
+	default:
+		c.address(path, value)
+	}
+}
+
+func (c *configChecker) cidrs(path string, list []string) {
+	for i, v := range list {
+		if _, err := acl.ParseNet(v); err != nil {
+			c.add(fmt.Sprintf("%s.%d", path, i), "%s", err.Error())
+		}
+	}
+}
+
+type configValue struct {
+	key   string
+	value float64
+}
+
+// 逐项检查数值不能为负数
+func (c *configChecker) positive(path string, values ...configValue) {
+	for _, v := range values {
+		if v.value < 0 {
+			c.add(path+"."+v.key, "%s must not be negative", v.key)
+		}
+	}
+}
+
+// keepalive为负数表示关闭，不检查
+func (c *configChecker) sockopt(path string, opt *sockopt.Options) {
+	if opt == nil {
+		return
+	}
+	c.positive(path,
+		configValue{"keepaliveinterval", float64(opt.KeepAliveInterval)},
+		configValue{"keepalivecount", float64(opt.KeepAliveCount)},
+		configValue{"rcvbuf", float64(opt.RecvBuf)},
+		configValue{"sndbuf", float64(opt.SendBuf)},
+		configValue{"usertimeout", float64(opt.UserTimeout)},
+		configValue{"tos", float64(opt.TOS)},
+		configValue{"dscp", float64(opt.DSCP)})
+	if opt.TOS > 255 {
+		c.add(path+".tos", "tos %d out of range 0-255", opt.TOS)
+	}
+	if opt.DSCP > 63 {
+		c.add(path+".dscp", "dscp %d out of range 0-63", opt.DSCP)
+	}
+	if opt.TOS > 0 && opt.DSCP > 0 {
+		c.add(path+".tos", "set only one of tos and dscp")
+	}
+}
+
+func (c *configChecker) limit(path string, cfg *limit.Config) {
+	if cfg == nil {
+		return
+	}
+	c.positive(path,
+		configValue{"maxconns", float64(cfg.MaxConns)},
+		configValue{"maxperbackend", float64(cfg.MaxPerBackend)},
+		configValue{"maxperclient", float64(cfg.MaxPerClient)},
+		configValue{"queue", float64(cfg.Queue)},
+		configValue{"queuetimeout", float64(cfg.QueueTimeout)},
+		configValue{"acceptrate", cfg.AcceptRate},
+		configValue{"acceptburst", float64(cfg.AcceptBurst)})
+	if cfg.Queue > 0 && cfg.MaxConns == 0 {
+		c.add(path+".queue", "queue requires maxconns")
+	}
+}
+
+func (c *configChecker) bandwidth(path string, cfg *limit.BandwidthConfig) {
+	if cfg == nil {
+		return
+	}
+	c.positive(path,
+		configValue{"up", float64(cfg.Up)},
+		configValue{"down", float64(cfg.Down)},
+		configValue{"clientup", float64(cfg.ClientUp)},
+		configValue{"clientdown", float64(cfg.ClientDown)},
+		configValue{"sessionup", float64(cfg.SessionUp)},
+		configValue{"sessiondown", float64(cfg.SessionDown)})
+}
+
+func (c *configChecker) ban(path string, cfg *ban.Config) {
+	if cfg == nil {
+		return
+	}
+	c.positive(path,
+		configValue{"maxconns", float64(cfg.MaxConns)},
+		configValue{"maxhandshakefails", float64(cfg.MaxHandshakeFails)},
+		configValue{"maxquickcloses", float64(cfg.MaxQuickCloses)},
+		configValue{"quickclose", float64(cfg.QuickClose)},
+		configValue{"window", float64(cfg.Window)},
+		configValue{"bantime", float64(cfg.BanTime)})
+}
+
+func (c *configChecker) check(config *GlobalConfig) {
+	tlsNames := make(map[string]bool)
+	for i, v := range config.TlsCfg {
+		path := fmt.Sprintf("tls.%d", i)
+		if v.Name == "" {
+			c.add(path, "tls name is empty")
+		} else if tlsNames[v.Name] {
+			c.add(path+".name", "duplicate tls name %q", v.Name)
+		}
+		tlsNames[v.Name] = true
+
+		cert := c.readable(path+".cert", v.Cert)
+		key := c.readable(path+".key", v.Key)
+		if v.Cert == "" || v.Key == "" {
+			c.add(path, "tls %q requires cert and key", v.Name)
+		} else if cert && key {
+			if _, err := TlsKeyPair(&v); err != nil {
+				c.add(path+".cert", "tls %q load certificate failed, %s", v.Name, err.Error())
+			}
+		}
+		if v.CA != "" && c.readable(path+".ca", v.CA) {
+			body, _ := ioutil.ReadFile(v.CA)
+			if !x509.NewCertPool().AppendCertsFromPEM(body) {
+				c.add(path+".ca", "tls %q no certificate found in ca %s", v.Name, v.CA)
+			}
+		}
+	}
+
+	clusterNames := make(map[string]bool)
+	for i, v := range config.Clusters {
+		path := fmt.Sprintf("clusters.%d", i)
+		if v.Name == "" {
+			c.add(path, "cluster name is empty")
+		} else if clusterNames[v.Name] {
+			c.add(path+".name", "duplicate cluster name %q", v.Name)
+		}
+		clusterNames[v.Name] = true
+
+		if len(v.Endpoint) == 0 {
+			c.add(path, "cluster %q has no endpoints", v.Name)
+		}
+		exist := make(map[string]bool)
+		for j, ep := range v.Endpoint {
+			epath := fmt.Sprintf("%s.endpoints.%d", path, j)
+			if exist[ep] {
+				c.add(epath, "duplicate endpoint %q in cluster %q", ep, v.Name)
+			}
+			exist[ep] = true
+			c.endpoint(epath, ep)
+		}
+		if !proxy.ValidMode(v.LB) {
+			c.add(path+".lb", "cluster %q load balance %q not support, use one of %s", v.Name, v.LB, strings.Join(proxy.Modes, ", "))
+		}
+		if v.TlsName != "" && !tlsNames[v.TlsName] {
+			c.add(path+".tls", "cluster %q references unknown tls %q", v.Name, v.TlsName)
+		}
+		c.sockopt(path+".sockopt", v.SockOpt)
+	}
+
+	if len(config.Listeners) == 0 {
+		c.add("listeners", "no listeners")
+	}
+	addresses := make(map[string]bool)
+	for i, v := range config.Listeners {
+		path := fmt.Sprintf("listeners.%d", i)
+		if v.Address == "" {
+			c.add(path, "listener address is empty")
+		} else {
+			if addresses[v.Address] {
+				c.add(path+".address", "duplicate listener address %q", v.Address)
+			}
+			addresses[v.Address] = true
+			c.address(path+".address", v.Address)
+		}
+
+		if v.Cluster == "" {
+			c.add(path, "listener %q has no cluster", v.Address)
+		} else if !clusterNames[v.Cluster] {
+			c.add(path+".cluster", "listener %q references unknown cluster %q", v.Address, v.Cluster)
+		}
+		if v.Tlsname != "" && !tlsNames[v.Tlsname] {
+			c.add(path+".tls", "listener %q references unknown tls %q", v.Address, v.Tlsname)
+		}
+		c.positive(path,
+			configValue{"idletimeout", float64(v.IdleTimeout)},
+			configValue{"maxduration", float64(v.MaxDuration)},
+			configValue{"handshaketimeout", float64(v.HandshakeTimeout)})
+		c.sockopt(path+".sockopt", v.SockOpt)
+		c.limit(path+".limit", v.Limit)
+		c.bandwidth(path+".bandwidth", v.Bandwidth)
+		c.ban(path+".ban", v.Ban)
+
+		if v.Capture != nil {
+			if v.Capture.Path == "" {
+				c.add(path+".capture", "capture path is empty")
+			}
+			c.cidrs(path+".capture.cidr", v.Capture.CIDR)
+			c.positive(path+".capture",
+				configValue{"maxsize", float64(v.Capture.MaxSize)},
+				configValue{"maxbackups", float64(v.Capture.MaxBackups)})
+		}
+		if v.Record != nil {
+			if v.Record.Dir == "" {
+				c.add(path+".record", "record dir is empty")
+			}
+			c.cidrs(path+".record.cidr", v.Record.CIDR)
+			c.positive(path+".record",
+				configValue{"maxsize", float64(v.Record.MaxSize)},
+				configValue{"maxbackups", float64(v.Record.MaxBackups)})
+		}
+		if v.Route != "" {
+			router, err := proxy.NewRouter(v.Route, nil)
+			if err != nil {
+				c.add(path+".route", "%s", err.Error())
+			} else {
+				for _, name := range router.Clusters() {
+					if !clusterNames[name] {
+						c.add(path+".route", "listener %q route references unknown cluster %q", v.Address, name)
+					}
+				}
+			}
+		}
+		if v.Acl != nil {
+			c.cidrs(path+".acl.allow", v.Acl.Allow)
+			c.cidrs(path+".acl.deny", v.Acl.Deny)
+			c.positive(path+".acl", configValue{"reload", float64(v.Acl.Reload)})
+			if v.Acl.File != "" {
+				list, err := acl.New(&acl.Config{File: v.Acl.File})
+				if err != nil {
+					c.add(path+".acl.file", "%s", err.Error())
+				} else {
+					list.Close()
+				}
+			}
+		}
+	}
+
+	if v := config.AccessLog; v != nil {
+		switch v.Format {
+		case "", "json":
+		case "template":
+			if _, err := template.New("accesslog").Parse(v.Template); err != nil {
+				c.add("accesslog.template", "%s", err.Error())
+			}
+		default:
+			c.add("accesslog.format", "access log format %q not support", v.Format)
+		}
+		c.positive("accesslog",
+			configValue{"maxsize", float64(v.MaxSize)},
+			configValue{"rotate", float64(v.Rotate)},
+			configValue{"maxbackups", float64(v.MaxBackups)})
+	}
+}
+
+// 替换环境变量引用并检查版本后解析，未知字段单独报告，不影响其他检查
+func (c *configChecker) decode(body []byte) (*GlobalConfig, int) {
+	c.positions = yamlPositions(body)
+	body = c.expand(body)
+
+	body, version, err := schema.MigrateYAML(body)
+	if err != nil {
+		if _, ok := err.(*schema.VersionError); ok {
+			c.add("version", "%s", err.Error())
+		} else {
+			c.yamlError(err)
+		}
+		return nil, version
+	}
+
+	config := new(GlobalConfig)
+	err = yaml.Unmarshal(body, config)
+	if err != nil {
+		c.yamlError(err)
+		return nil, version
+	}
+	err = yaml.UnmarshalStrict(body, new(GlobalConfig))
+	if err != nil {
+		c.yamlError(err)
+	}
+	return config, version
+}
+
+// 严格校验配置，一次返回全部问题，include的片段合并后一起校验
+func ValidateConfig(filename string, body []byte) (*GlobalConfig, ConfigError) {
+	checker := &configChecker{file: filename}
+
+	config, version := checker.decode(body)
+	if config == nil {
+		return nil, checker.problems
+	}
+	if version < schema.VERSION {
+		log.Printf("config %s version %d migrated to %d\n", filename, version, schema.VERSION)
+	}
+	config.Version = schema.VERSION
+
+	if len(config.Include) > 0 {
+		abs, _ := filepath.Abs(filename)
+		checker.include(checker, config, config.Include, map[string]bool{abs: true})
+	}
+
+	checker.check(config)
+	return config, checker.result()
+}
+
+// 主配置文件的问题在前，片段文件按名称排列
+func (c *configChecker) result() ConfigError {
+	sort.SliceStable(c.problems, func(i, j int) bool {
+		a, b := c.problems[i], c.problems[j]
+		if a.File != b.File {
+			return a.File == c.file || b.File != c.file && a.File < b.File
+		}
+		return a.Line < b.Line
+	})
+	if len(c.problems) > 0 {
+		return c.problems
+	}
+	return nil
+}
+
+// 校验内存中生成的配置，name用于问题的显示
+func CheckConfig(name string, config *GlobalConfig) ConfigError {
+	checker := &configChecker{file: name}
+	checker.check(config)
+	return checker.result()
+}
+
+// validate子命令，校验配置文件并输出全部问题
+func ValidateMain(args []string) {
+	var file string
+
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	flags.StringVar(&file, "config", "config.yaml", "configure file.")
+	flags.Parse(args)
+
+	body, err := ioutil.ReadFile(file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	_, problems := ValidateConfig(file, body)
+	if len(problems) > 0 {
+		for _, v := range problems {
+			fmt.Fprintln(os.Stderr, v.String())
+		}
+		fmt.Fprintf(os.Stderr, "%d problems found\n", len(problems))
+		os.Exit(1)
+	}
+	fmt.Printf("%s: ok\n", file)
+}
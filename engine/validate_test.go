@@ -0,0 +1,179 @@
+package engine
+
+import (
+	"strings"
+	"testing"
+)
+
+// 每个用例的问题按 文件:行: 信息 输出，want为其中应包含的片段
+func TestValidateConfig(t *testing.T) {
+	cases := []struct {
+		name string
+		body string
+		want []string
+	}{
+		{"valid", `version: 2
+listeners:
+  - address: 127.0.0.1:8080
+    cluster: web
+clusters:
+  - name: web
+    endpoints: [127.0.0.1:80]
+`, nil},
+		{"unknown field", `version: 2
+listeners:
+  - address: 127.0.0.1:8080
+    cluster: web
+    clustr: web
+clusters:
+  - name: web
+    endpoints: [127.0.0.1:80]
+`, []string{"test.yaml:5: field clustr not found"}},
+		{"dangling references", `version: 2
+listeners:
+  - address: 127.0.0.1:8080
+    cluster: nope
+    tls: missing
+clusters:
+  - name: web
+    endpoints: [127.0.0.1:80]
+    tls: other
+`, []string{
+			`test.yaml:4: listener "127.0.0.1:8080" references unknown cluster "nope"`,
+			`test.yaml:5: listener "127.0.0.1:8080" references unknown tls "missing"`,
+			`test.yaml:9: cluster "web" references unknown tls "other"`,
+		}},
+		{"bad duration", `version: 2
+listeners:
+  - address: 127.0.0.1:8080
+    cluster: web
+    idletimeout: 5x
+clusters:
+  - name: web
+    endpoints: [127.0.0.1:80]
+`, []string{"test.yaml:5: cannot unmarshal !!str `5x` into time.Duration"}},
+		{"flow sequence", `version: 2
+listeners:
+  - {address: 127.0.0.1:8080, cluster: web}
+clusters:
+  - name: web
+    endpoints: [127.0.0.1:80, "bad address", 127.0.0.1:80]
+`, []string{
+			`test.yaml:6: invalid address "bad address"`,
+			`test.yaml:6: duplicate endpoint "127.0.0.1:80"`,
+		}},
+		{"multi-line scalar", `version: 2
+listeners:
+  - address: 127.0.0.1:8080
+    route: >-
+      cidr(client, '10.0.0.0/8')
+        ? 'cluster:api'
+        : ''
+    cluster: web
+    tls: missing
+clusters:
+  - name: web
+    endpoints:
+      - 127.0.0.1:80
+`, []string{
+			`test.yaml:4: listener "127.0.0.1:8080" route references unknown cluster "api"`,
+			`test.yaml:9: listener "127.0.0.1:8080" references unknown tls "missing"`,
+		}},
+		{"negative values", `version: 2
+listeners:
+  - address: 127.0.0.1:8080
+    cluster: web
+    idletimeout: -1s
+    limit:
+      maxperclient: -1
+      queue: 10
+    sockopt:
+      keepalive: -1s
+      dscp: 70
+    bandwidth:
+      up: -100
+    ban:
+      window: -1m
+clusters:
+  - name: web
+    endpoints: [127.0.0.1:80]
+    sockopt:
+      rcvbuf: -1
+`, []string{
+			"test.yaml:5: idletimeout must not be negative",
+			"test.yaml:7: maxperclient must not be negative",
+			"test.yaml:8: queue requires maxconns",
+			"test.yaml:11: dscp 70 out of range 0-63",
+			"test.yaml:13: up must not be negative",
+			"test.yaml:15: window must not be negative",
+			"test.yaml:20: rcvbuf must not be negative",
+		}},
+	}
+
+	for _, c := range cases {
+		_, problems := ValidateConfig("test.yaml", []byte(c.body))
+		text := problems.Error()
+		if len(c.want) == 0 && len(problems) > 0 {
+			t.Errorf("%s: unexpected problems\n%s", c.name, text)
+			continue
+		}
+		if len(problems) != len(c.want) {
+			t.Errorf("%s: %d problems, want %d\n%s", c.name, len(problems), len(c.want), text)
+		}
+		for _, want := range c.want {
+			if !strings.Contains(text, want) {
+				t.Errorf("%s: missing %q in\n%s", c.name, want, text)
+			}
+		}
+	}
+}
+
+func TestYamlPositions(t *testing.T) {
+	body := `version: 2
+# comment
+listeners:
+  - address: :8080
+    acl:
+      allow: [10.0.0.0/8]
+      deny:
+        - 10.0.0.1
+        - 10.0.0.2
+  -
+    address: :8081
+    route: |
+      sni == 'a'
+        ? 'tag:a=1'
+        : ''
+    cluster: web
+clusters:
+- name: web
+  "lb": leastconn
+`
+	want := map[string]int{
+		"version":                  1,
+		"listeners":                3,
+		"listeners.0":              4,
+		"listeners.0.address":      4,
+		"listeners.0.acl.allow":    6,
+		"listeners.0.acl.deny.0":   8,
+		"listeners.0.acl.deny.1":   9,
+		"listeners.1":              10,
+		"listeners.1.address":      11,
+		"listeners.1.route":        12,
+		"listeners.1.cluster":      16,
+		"clusters.0.name":          18,
+		"clusters.0.lb":            19,
+		"listeners.0.acl.allow.0":  0,
+		"listeners.1.route.line.3": 0,
+	}
+	positions := yamlPositions([]byte(body))
+	for path, line := range want {
+		if positions[path] != line {
+			t.Errorf("%s at line %d, want %d", path, positions[path], line)
+		}
+	}
+	// 流格式内的元素使用所在键的行
+	if line := yamlLine(positions, "listeners.0.acl.allow.0"); line != 6 {
+		t.Errorf("flow element at line %d, want 6", line)
+	}
+}
@@ -0,0 +1,89 @@
+// 在自己的程序中嵌入tcp代理：监听一个端口，按负载均衡转发到多个后端，
+// 通过钩子打印连接事件，收到退出信号后平滑关闭。
+//
+//	go run ./examples/embed -listen :8080 -to 127.0.0.1:80,127.0.0.1:81 -lb leastconn
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"github.com/lixiangyun/tcpproxy/proxy"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+func main() {
+	listen := flag.String("listen", ":8080", "listen address.")
+	to := flag.String("to", "", "backend endpoints, comma separated.")
+	lb := flag.String("lb", proxy.LB_ROUNDROBIN, "load balance, "+strings.Join(proxy.Modes, ", ")+".")
+	deny := flag.String("deny", "", "reject clients from this ip.")
+	flag.Parse()
+
+	if *to == "" || !proxy.ValidMode(*lb) {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	cluster := proxy.NewCluster("backend", proxy.NewBalancer(*lb),
+		proxy.ClusterEndpoints(proxy.Endpoints(strings.Split(*to, ",")...)),
+		proxy.ClusterDialer(&net.Dialer{Timeout: 5 * time.Second}))
+
+	hooks := proxy.Hooks{
+		OnAccept: func(conn net.Conn) error {
+			if *deny != "" && proxy.ClientIP(conn.RemoteAddr()) == *deny {
+				return errors.New("client denied")
+			}
+			return nil
+		},
+		OnError: func(info *proxy.ConnInfo, err error) {
+			log.Printf("reject %s, %s", info.Conn.RemoteAddr().String(), err.Error())
+		},
+		OnConnect: func(s *proxy.Session) {
+			log.Printf("session %d %s -> %s", s.ID, s.Client, s.Backend)
+		},
+		OnClose: func(s *proxy.Session) {
+			up, down := s.Flows()
+			log.Printf("session %d closed, %s, up %d down %d", s.ID, s.Reason(), up, down)
+		},
+	}
+
+	p := proxy.New(
+		proxy.WithCluster(cluster),
+		proxy.WithListener(*listen, cluster.Name),
+		proxy.WithIdleTimeout(5*time.Minute),
+		proxy.WithHooks(hooks),
+	)
+
+	err := p.Start(context.Background())
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	log.Printf("listen %s -> %s", p.Addrs()[0].String(), *to)
+
+	// 收到SIGHUP时把后端调整为环境变量BACKENDS中的地址
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	for sig := range signals {
+		if sig == syscall.SIGHUP {
+			if backends := os.Getenv("BACKENDS"); backends != "" {
+				p.UpdateEndpoints(cluster.Name, proxy.Endpoints(strings.Split(backends, ",")...))
+				log.Printf("backends %v", cluster.Endpoints())
+			}
+			continue
+		}
+		break
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = p.Shutdown(ctx)
+	if err != nil {
+		log.Printf("shutdown, %s", err.Error())
+	}
+}
@@ -0,0 +1,40 @@
+// 在自己的程序中运行完整的tcpproxy并增加中间件，命令行参数和配置文件与tcpproxy相同，
+// 不需要修改engine的代码。示例中间件拒绝同一客户端IP超过两个的并发连接，并为会话打标签。
+//
+//	go run ./examples/engine -config config.yaml
+package main
+
+import (
+	"fmt"
+	"github.com/lixiangyun/tcpproxy/engine"
+	"github.com/lixiangyun/tcpproxy/proxy"
+	"sync"
+)
+
+type perClient struct {
+	proxy.Base
+
+	lock  sync.Mutex
+	conns map[string]int
+}
+
+func (p *perClient) Accept(info *proxy.ConnInfo) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.conns[info.Client] >= 2 {
+		return fmt.Errorf("client %s has too many connections", info.Client)
+	}
+	p.conns[info.Client]++
+	info.Tag("client_conns", fmt.Sprint(p.conns[info.Client]))
+	return nil
+}
+
+func (p *perClient) Close(info *proxy.ConnInfo) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.conns[info.Client]--
+}
+
+func main() {
+	engine.Main(engine.WithMiddleware(&perClient{conns: make(map[string]int)}))
+}
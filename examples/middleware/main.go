@@ -0,0 +1,121 @@
+// 中间件示例：客户端连接的第一行必须是口令，每第三个连接转发到最后一个后端（灰度），
+// 会话结束后输出审计日志。使用proxytest在进程内运行并检查结果。
+//
+//	go run ./examples/middleware
+package main
+
+import (
+	"bufio"
+	"errors"
+	"github.com/lixiangyun/tcpproxy/discovery"
+	"github.com/lixiangyun/tcpproxy/proxy"
+	"github.com/lixiangyun/tcpproxy/proxy/proxytest"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const TOKEN = "secret"
+
+// 第一次读取时校验口令行，口令之后的数据原样转发
+type tokenConn struct {
+	net.Conn
+	reader *bufio.Reader
+	once   sync.Once
+	err    error
+}
+
+func (c *tokenConn) Read(b []byte) (int, error) {
+	c.once.Do(func() {
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			c.err = err
+		} else if strings.TrimSpace(line) != TOKEN {
+			c.err = errors.New("invalid token")
+		}
+	})
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// 保留半关闭，使应答能够完整返回
+func (c *tokenConn) CloseWrite() error {
+	if proxy.CloseWrite(c.Conn) {
+		return nil
+	}
+	return errors.New("close write not supported")
+}
+
+type token struct {
+	proxy.Base
+}
+
+func (token) WrapClient(info *proxy.ConnInfo, conn net.Conn) net.Conn {
+	return &tokenConn{Conn: conn, reader: bufio.NewReader(conn)}
+}
+
+type canary struct {
+	proxy.Base
+	count int64
+}
+
+func (c *canary) Select(info *proxy.ConnInfo, list []discovery.Endpoint) []discovery.Endpoint {
+	if atomic.AddInt64(&c.count, 1)%3 != 0 || len(list) == 0 {
+		return nil
+	}
+	info.Tag("canary", "true")
+	return list[len(list)-1:]
+}
+
+type audit struct {
+	proxy.Base
+	closed int64
+}
+
+func (a *audit) Close(info *proxy.ConnInfo) {
+	atomic.AddInt64(&a.closed, 1)
+	if info.Stats == nil {
+		log.Printf("audit %s rejected, %s", info.Client, info.Reason)
+		return
+	}
+	up, down := info.Stats.Flows()
+	log.Printf("audit %s -> %s %s up %d down %d tags %v",
+		info.Client, info.Endpoint.Address, info.Reason, up, down, info.Tags)
+}
+
+func main() {
+	logger := &audit{}
+	server, err := proxytest.NewServer(2, proxy.NewBalancer(proxy.LB_ROUNDROBIN),
+		proxy.WithMiddleware(logger, &canary{}, token{}))
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	defer server.Close()
+
+	for i := 0; i < 6; i++ {
+		reply, err := proxytest.Roundtrip(server.Addr, []byte(TOKEN+"\nhello"))
+		if err != nil || string(reply) != "hello" {
+			log.Printf("FAIL reply %q %v", reply, err)
+			os.Exit(1)
+		}
+	}
+	reply, _ := proxytest.Roundtrip(server.Addr, []byte("guess\nhello"))
+	if len(reply) != 0 {
+		log.Printf("FAIL invalid token reply %q", reply)
+		os.Exit(1)
+	}
+
+	server.Close()
+	first, last := server.Backends[0].Accepted(), server.Backends[1].Accepted()
+	log.Printf("backend accepted %d %d, audit %d", first, last, atomic.LoadInt64(&logger.closed))
+	if first+last != 7 || last <= first || atomic.LoadInt64(&logger.closed) != 7 {
+		log.Println("FAIL")
+		os.Exit(1)
+	}
+	log.Println("ok")
+}
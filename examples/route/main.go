@@ -0,0 +1,80 @@
+// 路由表达式示例：tls客户端按SNI转发到不同集群，其它连接转发到默认集群，
+// 指定网段的客户端被拒绝。使用proxytest的回显后端在进程内运行并检查结果。
+//
+//	go run ./examples/route
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/lixiangyun/tcpproxy/proxy"
+	"github.com/lixiangyun/tcpproxy/proxy/proxytest"
+	"log"
+	"net"
+	"os"
+	"time"
+)
+
+const EXPRESSION = `cidr(client, '10.0.0.0/8') ? 'reject' :
+	(sni == 'b.example' && health('b') > 0 ? 'cluster:b tag:sni=b' : 'tag:sni=none')`
+
+func check(ok bool, format string, args ...interface{}) {
+	if !ok {
+		log.Printf("FAIL "+format, args...)
+		os.Exit(1)
+	}
+	log.Printf("ok   "+format, args...)
+}
+
+func main() {
+	a, err := proxytest.NewEchoBackend()
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	defer a.Close()
+	b, err := proxytest.NewEchoBackend()
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	defer b.Close()
+
+	router, err := proxy.NewRouter(EXPRESSION, nil)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	router.Timeout = 500 * time.Millisecond
+
+	tags := make(chan map[string]string, 10)
+	p := proxy.New(
+		proxy.WithCluster(proxy.NewCluster("a", nil, proxy.ClusterEndpoints(proxy.Endpoints(a.Address)))),
+		proxy.WithCluster(proxy.NewCluster("b", nil, proxy.ClusterEndpoints(proxy.Endpoints(b.Address)))),
+		proxy.WithListener("127.0.0.1:0", "a", proxy.ListenRouter(router)),
+		proxy.WithHooks(proxy.Hooks{
+			OnClose: func(s *proxy.Session) {
+				tags <- s.Tags
+			},
+		}),
+	)
+	err = p.Start(context.Background())
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	defer p.Close()
+	address := p.Addrs()[0].String()
+
+	reply, err := proxytest.Roundtrip(address, []byte("plain"))
+	check(err == nil && string(reply) == "plain", "plain reply %q", reply)
+	check((<-tags)["sni"] == "none", "plain tagged")
+	check(a.Accepted() == 1 && b.Accepted() == 0, "plain to cluster a")
+
+	// 回显后端不会完成握手，只检查转发到的集群
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	conn.SetDeadline(time.Now().Add(time.Second))
+	tls.Client(conn, &tls.Config{ServerName: "b.example"}).Handshake()
+	conn.Close()
+	check((<-tags)["sni"] == "b", "tls tagged")
+	check(a.Accepted() == 1 && b.Accepted() == 1, "sni b.example to cluster b")
+}
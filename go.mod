@@ -7,6 +7,7 @@ require (
 	github.com/astaxie/beego v1.12.2
 	github.com/lxn/walk v0.0.0-20200924155701-77185e9c4aec
 	github.com/lxn/win v0.0.0-20191128105842-2da648fda5b4 // indirect
-	gopkg.in/Knetic/govaluate.v3 v3.0.0 // indirect
+	golang.org/x/sys v0.0.0-20200615200032-f1bc736245b1
+	gopkg.in/Knetic/govaluate.v3 v3.0.0
 	gopkg.in/yaml.v2 v2.3.0
 )
@@ -0,0 +1,241 @@
+// Package impair 提供网络损伤模拟，包括固定延时、随机抖动、按概率拒绝连接、
+// 转发一定字节后复位连接、拆分写入和随机卡顿，用于测试应用在弱网下的表现。
+package impair
+
+import (
+	"fmt"
+	"github.com/lixiangyun/tcpproxy/limit"
+	"github.com/lixiangyun/tcpproxy/proxy"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	REASON_REFUSE = "impair_refuse"
+	REASON_RESET  = "impair_reset"
+
+	// 已读取未写出的数据块上限，超过后读端等待
+	queueSize = 64
+)
+
+// 网络损伤模拟配置，0表示不启用对应项
+type Config struct {
+	Latency    int   // 固定延时，毫秒
+	Jitter     int   // 随机抖动，毫秒
+	RefuseRate int   // 拒绝连接的概率，百分比
+	ResetAfter int64 // 会话累计转发字节数超过后复位连接
+	Fragment   int   // 拆分写入的最大长度，字节
+	StallRate  int   // 每次转发卡顿的概率，百分比
+	StallTime  int   // 卡顿时长，毫秒
+}
+
+func (c *Config) Enable() bool {
+	return c != nil && *c != Config{}
+}
+
+func byteView(size int64) string {
+	switch {
+	case size < 1024:
+		return fmt.Sprintf("%dB", size)
+	case size < 1024*1024:
+		return fmt.Sprintf("%.1fKB", float64(size)/1024)
+	case size < 1024*1024*1024:
+		return fmt.Sprintf("%.1fMB", float64(size)/(1024*1024))
+	}
+	return fmt.Sprintf("%.1fGB", float64(size)/(1024*1024*1024))
+}
+
+func (c *Config) String() string {
+	if !c.Enable() {
+		return "none"
+	}
+	var output []string
+	if c.Latency > 0 || c.Jitter > 0 {
+		output = append(output, fmt.Sprintf("latency %dms±%dms", c.Latency, c.Jitter))
+	}
+	if c.RefuseRate > 0 {
+		output = append(output, fmt.Sprintf("refuse %d%%", c.RefuseRate))
+	}
+	if c.ResetAfter > 0 {
+		output = append(output, fmt.Sprintf("reset after %s", byteView(c.ResetAfter)))
+	}
+	if c.Fragment > 0 {
+		output = append(output, fmt.Sprintf("fragment %dB", c.Fragment))
+	}
+	if c.StallRate > 0 {
+		output = append(output, fmt.Sprintf("stall %d%% %dms", c.StallRate, c.StallTime))
+	}
+	return strings.Join(output, ", ")
+}
+
+func percent(rate int) bool {
+	return rate > 0 && rand.Intn(100) < rate
+}
+
+// 按概率拒绝新连接
+func (c *Config) Refuse() bool {
+	return c.Enable() && percent(c.RefuseRate)
+}
+
+// 本次转发的延时，抖动在[0, Jitter)之间随机
+func (c *Config) delay() time.Duration {
+	delay := time.Duration(c.Latency) * time.Millisecond
+	if c.Jitter > 0 {
+		delay += time.Duration(rand.Intn(c.Jitter)) * time.Millisecond
+	}
+	return delay
+}
+
+// 发送RST复位连接
+func Reset(conn net.Conn) {
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetLinger(0)
+	}
+	conn.Close()
+}
+
+type chunk struct {
+	body []byte
+	due  time.Time
+}
+
+// 带损伤模拟的单方向转发，Up表示客户端到后端方向
+type Forwarder struct {
+	Up     bool
+	Config *Config
+	// 会话限速，为nil不限速
+	Flow *limit.Flow
+	// 每次写出后统计流量
+	Count func(cnt int)
+	// 会话累计转发的字节数，超过ResetAfter时调用Reset复位会话
+	Total func() int64
+	Reset func()
+	// 转发结束后调用，rerr为读端结束的原因，werr为写端错误，与proxy.Forwarder相同
+	Done func(rerr error, werr error)
+}
+
+func (f *Forwarder) count(cnt int) {
+	if f.Count != nil {
+		f.Count(cnt)
+	}
+}
+
+// 按到期时间依次写出，返回写端错误，复位时返回io.ErrClosedPipe
+func (f *Forwarder) write(dst net.Conn, queue chan chunk) error {
+	cfg := f.Config
+	for c := range queue {
+		if delay := time.Until(c.due); delay > 0 {
+			time.Sleep(delay)
+		}
+		if percent(cfg.StallRate) {
+			time.Sleep(time.Duration(cfg.StallTime) * time.Millisecond)
+		}
+		body := c.body
+		for len(body) > 0 {
+			cnt := len(body)
+			if cfg.Fragment > 0 && cnt > cfg.Fragment {
+				cnt = cfg.Fragment
+			}
+			_, err := dst.Write(body[:cnt])
+			if err != nil {
+				return err
+			}
+			body = body[cnt:]
+		}
+		f.count(len(c.body))
+
+		if cfg.ResetAfter > 0 && f.Total != nil && f.Total() >= cfg.ResetAfter {
+			if f.Reset != nil {
+				f.Reset()
+			}
+			return io.ErrClosedPipe
+		}
+	}
+	return nil
+}
+
+// 读写分离，延时通过队列实现，不影响吞吐。读端正常结束时等待队列写完后
+// 只关闭对端的写方向，其它情况关闭两端并返回错误
+func (f *Forwarder) Forward(dst net.Conn, src net.Conn) error {
+	rerr, werr := f.forward(dst, src)
+	if f.Done != nil {
+		f.Done(rerr, werr)
+	}
+	if werr != nil {
+		return werr
+	}
+	if rerr == io.EOF {
+		return nil
+	}
+	return rerr
+}
+
+func (f *Forwarder) forward(dst net.Conn, src net.Conn) (error, error) {
+	queue := make(chan chunk, queueSize)
+	done := make(chan error, 1)
+	go func() {
+		err := f.write(dst, queue)
+		if err != nil {
+			src.Close()
+			dst.Close()
+			// 读端可能阻塞在写队列上
+			for range queue {
+			}
+		}
+		done <- err
+	}()
+
+	var rerr error
+	var last time.Time
+	for {
+		buf := make([]byte, f.Flow.Chunk(f.Up))
+		cnt, err := src.Read(buf)
+		if cnt > 0 {
+			f.Flow.Wait(f.Up, cnt)
+
+			// 保证抖动后数据仍然按序发送
+			due := time.Now().Add(f.Config.delay())
+			if due.Before(last) {
+				due = last
+			}
+			last = due
+			queue <- chunk{body: buf[:cnt], due: due}
+		}
+		if err != nil {
+			rerr = err
+			break
+		}
+	}
+
+	close(queue)
+	werr := <-done
+	if werr != nil {
+		return rerr, werr
+	}
+	if rerr == io.EOF && proxy.CloseWrite(dst) {
+		return rerr, nil
+	}
+	src.Close()
+	dst.Close()
+	return rerr, nil
+}
+
+// 双向转发，两个方向都结束后返回，errs依次为上行和下行的错误
+func Pipe(client net.Conn, backend net.Conn, up *Forwarder, down *Forwarder) (errs [2]error) {
+	wait := new(sync.WaitGroup)
+	wait.Add(2)
+	go func() {
+		defer wait.Done()
+		errs[0] = up.Forward(backend, client)
+	}()
+	go func() {
+		defer wait.Done()
+		errs[1] = down.Forward(client, backend)
+	}()
+	wait.Wait()
+	return errs
+}
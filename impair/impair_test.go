@@ -0,0 +1,268 @@
+package impair
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	list, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer list.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := list.Accept()
+		accepted <- conn
+	}()
+	conn, err := net.Dial("tcp", list.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := <-accepted
+	if peer == nil {
+		t.Fatal("accept failed")
+	}
+	return conn, peer
+}
+
+// in写入的数据经过src->dst的损伤转发后从out读出
+type pipeline struct {
+	in, src, dst, out net.Conn
+	result            chan error
+}
+
+func newPipeline(t *testing.T, f *Forwarder) *pipeline {
+	p := &pipeline{result: make(chan error, 1)}
+	p.in, p.src = tcpPair(t)
+	p.dst, p.out = tcpPair(t)
+	go func() {
+		p.result <- f.Forward(p.dst, p.src)
+	}()
+	return p
+}
+
+func (p *pipeline) Close() {
+	for _, conn := range []net.Conn{p.in, p.src, p.dst, p.out} {
+		conn.Close()
+	}
+}
+
+// 写入一个字节并等待从另一端读出，返回经过的时间
+func (p *pipeline) delay(t *testing.T, b byte) time.Duration {
+	start := time.Now()
+	if _, err := p.in.Write([]byte{b}); err != nil {
+		t.Fatal(err)
+	}
+	var buf [1]byte
+	p.out.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(p.out, buf[:]); err != nil {
+		t.Fatal(err)
+	}
+	if buf[0] != b {
+		t.Fatalf("read %d, want %d", buf[0], b)
+	}
+	return time.Since(start)
+}
+
+func TestRefuse(t *testing.T) {
+	var none *Config
+	if none.Refuse() || none.Enable() || none.String() != "none" {
+		t.Fatal("nil config must be disabled")
+	}
+	for i := 0; i < 100; i++ {
+		if (&Config{Latency: 10}).Refuse() {
+			t.Fatal("refuse with zero rate")
+		}
+		if !(&Config{RefuseRate: 100}).Refuse() {
+			t.Fatal("not refused with full rate")
+		}
+	}
+
+	cfg := &Config{Latency: 100, Jitter: 20, RefuseRate: 5, ResetAfter: 2048, Fragment: 10, StallRate: 1, StallTime: 500}
+	want := "latency 100ms±20ms, refuse 5%, reset after 2.0KB, fragment 10B, stall 1% 500ms"
+	if got := cfg.String(); got != want {
+		t.Fatalf("string got %q, want %q", got, want)
+	}
+}
+
+func TestLatencyJitter(t *testing.T) {
+	p := newPipeline(t, &Forwarder{Up: true, Config: &Config{Latency: 100, Jitter: 50}})
+	defer p.Close()
+
+	for i := 0; i < 5; i++ {
+		delay := p.delay(t, byte(i))
+		if delay < 100*time.Millisecond || delay > 300*time.Millisecond {
+			t.Fatalf("delay %s, want about 100ms to 150ms", delay)
+		}
+	}
+
+	// 连续写入时抖动不会打乱顺序
+	body := make([]byte, 0, 200)
+	for i := 0; i < 200; i++ {
+		body = append(body, byte(i))
+		p.in.Write([]byte{byte(i)})
+		time.Sleep(time.Millisecond)
+	}
+	p.in.(*net.TCPConn).CloseWrite()
+	p.out.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply, err := ioutil.ReadAll(p.out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reply, body) {
+		t.Fatalf("reply out of order %v", reply)
+	}
+	if err := <-p.result; err != nil {
+		t.Fatalf("forward got %v", err)
+	}
+}
+
+func TestStall(t *testing.T) {
+	p := newPipeline(t, &Forwarder{Config: &Config{StallRate: 100, StallTime: 100}})
+	defer p.Close()
+	if delay := p.delay(t, 1); delay < 100*time.Millisecond {
+		t.Fatalf("stall delay %s, want at least 100ms", delay)
+	}
+}
+
+func TestFragment(t *testing.T) {
+	src, in := tcpPair(t)
+	defer src.Close()
+	defer in.Close()
+	// net.Pipe每次读取对应一次写入，可以观察到拆分后的长度
+	dst, out := net.Pipe()
+	defer out.Close()
+
+	var counted int64
+	f := &Forwarder{Config: &Config{Fragment: 3}, Count: func(cnt int) { atomic.AddInt64(&counted, int64(cnt)) }}
+	result := make(chan error, 1)
+	go func() {
+		result <- f.Forward(dst, src)
+	}()
+
+	in.Write([]byte("0123456789"))
+	in.(*net.TCPConn).CloseWrite()
+	var reply []byte
+	buf := make([]byte, 1024)
+	for {
+		cnt, err := out.Read(buf)
+		if cnt > 3 {
+			t.Fatalf("write of %d bytes not fragmented", cnt)
+		}
+		reply = append(reply, buf[:cnt]...)
+		if err != nil {
+			break
+		}
+	}
+	if string(reply) != "0123456789" {
+		t.Fatalf("reply %q", reply)
+	}
+	// net.Pipe不支持半关闭，读端结束后完整关闭
+	if err := <-result; err != nil {
+		t.Fatalf("forward got %v", err)
+	}
+	if atomic.LoadInt64(&counted) != 10 {
+		t.Fatalf("counted %d, want 10", counted)
+	}
+}
+
+func TestResetAfter(t *testing.T) {
+	var total, resets int64
+	werrs := make(chan error, 1)
+	f := &Forwarder{
+		Config: &Config{ResetAfter: 100},
+		Count:  func(cnt int) { atomic.AddInt64(&total, int64(cnt)) },
+		Total:  func() int64 { return atomic.LoadInt64(&total) },
+		Done:   func(rerr error, werr error) { werrs <- werr },
+	}
+	p := newPipeline(t, f)
+	defer p.Close()
+	f.Reset = func() {
+		atomic.AddInt64(&resets, 1)
+		Reset(p.src)
+		Reset(p.dst)
+	}
+
+	p.in.Write(make([]byte, 60))
+	time.Sleep(50 * time.Millisecond)
+	p.in.Write(make([]byte, 60))
+
+	select {
+	case err := <-p.result:
+		if err != io.ErrClosedPipe {
+			t.Fatalf("forward got %v, want %v", err, io.ErrClosedPipe)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("not reset after limit")
+	}
+	if atomic.LoadInt64(&resets) != 1 {
+		t.Fatalf("reset %d times", resets)
+	}
+	if werr := <-werrs; werr != io.ErrClosedPipe {
+		t.Fatalf("done write error %v", werr)
+	}
+	// 对端收到RST
+	p.out.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := ioutil.ReadAll(p.out)
+	if err == nil {
+		t.Fatal("expect connection reset")
+	}
+}
+
+func TestPipeHalfClose(t *testing.T) {
+	client, src := tcpPair(t)
+	dst, backend := tcpPair(t)
+	defer client.Close()
+	defer backend.Close()
+
+	cfg := &Config{Latency: 20}
+	reads := make(chan error, 2)
+	finish := func(rerr error, werr error) {
+		if werr != nil {
+			rerr = werr
+		}
+		reads <- rerr
+	}
+	done := make(chan [2]error, 1)
+	go func() {
+		done <- Pipe(src, dst, &Forwarder{Up: true, Config: cfg, Done: finish}, &Forwarder{Config: cfg, Done: finish})
+	}()
+
+	// 客户端关闭写方向后，后端读到结束再应答
+	client.Write([]byte("request"))
+	client.(*net.TCPConn).CloseWrite()
+	backend.SetReadDeadline(time.Now().Add(5 * time.Second))
+	request, err := ioutil.ReadAll(backend)
+	if err != nil || string(request) != "request" {
+		t.Fatalf("backend read %q, %v", request, err)
+	}
+	backend.Write([]byte("response"))
+	backend.(*net.TCPConn).CloseWrite()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	response, err := ioutil.ReadAll(client)
+	if err != nil || string(response) != "response" {
+		t.Fatalf("client read %q, %v", response, err)
+	}
+
+	select {
+	case errs := <-done:
+		if errs[0] != nil || errs[1] != nil {
+			t.Fatalf("pipe errors %v", errs)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("pipe not finished")
+	}
+	// 两个方向的读端均正常结束
+	for i := 0; i < 2; i++ {
+		if err := <-reads; err != io.EOF {
+			t.Fatalf("done got %v, want %v", err, io.EOF)
+		}
+	}
+}
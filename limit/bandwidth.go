@@ -0,0 +1,172 @@
+package limit
+
+import (
+	"sync"
+	"time"
+)
+
+// 带宽限制，单位字节每秒，0表示不限制
+type BandwidthConfig struct {
+	Up          int64 `yaml:"up"`
+	Down        int64 `yaml:"down"`
+	ClientUp    int64 `yaml:"clientup"`
+	ClientDown  int64 `yaml:"clientdown"`
+	SessionUp   int64 `yaml:"sessionup"`
+	SessionDown int64 `yaml:"sessiondown"`
+}
+
+const (
+	// 限速时单次读取的最小和最大长度
+	throttleMinChunk = 512
+	throttleMaxChunk = 32 * 1024
+)
+
+type clientBucket struct {
+	up   *Bucket
+	down *Bucket
+	refs int
+}
+
+// 监听端口级别的带宽限制，链路级令牌桶由所有会话共享，客户端级令牌桶按IP共享
+type Throttle struct {
+	sync.Mutex
+
+	cfg     BandwidthConfig
+	up      *Bucket
+	down    *Bucket
+	clients map[string]*clientBucket
+}
+
+func NewThrottle(cfg *BandwidthConfig) *Throttle {
+	if cfg == nil {
+		return nil
+	}
+	return &Throttle{
+		cfg:     *cfg,
+		up:      NewBucket(float64(cfg.Up), int(cfg.Up)),
+		down:    NewBucket(float64(cfg.Down), int(cfg.Down)),
+		clients: make(map[string]*clientBucket, 1024),
+	}
+}
+
+// 会话的限速器，需要在会话结束时调用Close
+type Flow struct {
+	throttle *Throttle
+	client   string
+
+	up    []*Bucket
+	down  []*Bucket
+	chunk [2]int
+}
+
+func appendBucket(list []*Bucket, b *Bucket) []*Bucket {
+	if b != nil {
+		list = append(list, b)
+	}
+	return list
+}
+
+// 单次读取长度取最小限速的1/20，使限速更平滑
+func flowChunk(rates ...int64) int {
+	chunk := throttleMaxChunk
+	for _, rate := range rates {
+		if rate <= 0 {
+			continue
+		}
+		if int(rate/20) < chunk {
+			chunk = int(rate / 20)
+		}
+	}
+	if chunk < throttleMinChunk {
+		chunk = throttleMinChunk
+	}
+	return chunk
+}
+
+// 为会话创建限速器，未配置任何限速时返回nil
+func (t *Throttle) Session(client string) *Flow {
+	if t == nil {
+		return nil
+	}
+
+	t.Lock()
+	cb, ok := t.clients[client]
+	if !ok {
+		cb = &clientBucket{
+			up:   NewBucket(float64(t.cfg.ClientUp), int(t.cfg.ClientUp)),
+			down: NewBucket(float64(t.cfg.ClientDown), int(t.cfg.ClientDown)),
+		}
+		t.clients[client] = cb
+	}
+	cb.refs++
+	t.Unlock()
+
+	flow := &Flow{throttle: t, client: client}
+	flow.up = appendBucket(flow.up, t.up)
+	flow.up = appendBucket(flow.up, cb.up)
+	flow.up = appendBucket(flow.up, NewBucket(float64(t.cfg.SessionUp), int(t.cfg.SessionUp)))
+	flow.down = appendBucket(flow.down, t.down)
+	flow.down = appendBucket(flow.down, cb.down)
+	flow.down = appendBucket(flow.down, NewBucket(float64(t.cfg.SessionDown), int(t.cfg.SessionDown)))
+	flow.chunk[0] = flowChunk(t.cfg.Up, t.cfg.ClientUp, t.cfg.SessionUp)
+	flow.chunk[1] = flowChunk(t.cfg.Down, t.cfg.ClientDown, t.cfg.SessionDown)
+
+	return flow
+}
+
+// 该方向是否存在限速
+func (f *Flow) Limited(up bool) bool {
+	if f == nil {
+		return false
+	}
+	if up {
+		return len(f.up) > 0
+	}
+	return len(f.down) > 0
+}
+
+// 建议的单次读取长度
+func (f *Flow) Chunk(up bool) int {
+	if !f.Limited(up) {
+		return throttleMaxChunk
+	}
+	if up {
+		return f.chunk[0]
+	}
+	return f.chunk[1]
+}
+
+// 转发n个字节前调用，按最严格的限速等待
+func (f *Flow) Wait(up bool, n int) {
+	if !f.Limited(up) {
+		return
+	}
+	list := f.down
+	if up {
+		list = f.up
+	}
+	var delay time.Duration
+	for _, b := range list {
+		if d := b.Reserve(n); d > delay {
+			delay = d
+		}
+	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+func (f *Flow) Close() {
+	if f == nil {
+		return
+	}
+	t := f.throttle
+	t.Lock()
+	defer t.Unlock()
+
+	cb := t.clients[f.client]
+	cb.refs--
+	if cb.refs <= 0 {
+		delete(t.clients, f.client)
+	}
+}
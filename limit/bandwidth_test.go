@@ -0,0 +1,127 @@
+package limit
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// 按建议的长度分块等待total个字节，返回耗时
+func flowSend(f *Flow, up bool, total int) time.Duration {
+	start := time.Now()
+	chunk := f.Chunk(up)
+	for sent := 0; sent < total; sent += chunk {
+		f.Wait(up, chunk)
+	}
+	return time.Since(start)
+}
+
+// 令牌桶初始是满的，发送total字节的耗时约为(total-rate)/rate秒
+func expectElapsed(t *testing.T, name string, elapsed time.Duration, want time.Duration) {
+	if elapsed < want*8/10 || elapsed > want*13/10+100*time.Millisecond {
+		t.Fatalf("%s elapsed %s, want about %s", name, elapsed, want)
+	}
+}
+
+func TestFlowSessionRate(t *testing.T) {
+	throttle := NewThrottle(&BandwidthConfig{SessionUp: 1000000})
+	flow := throttle.Session("10.0.0.1")
+	defer flow.Close()
+
+	if !flow.Limited(true) || flow.Limited(false) {
+		t.Fatal("only up direction is limited")
+	}
+	expectElapsed(t, "session up", flowSend(flow, true, 2000000), time.Second)
+	if elapsed := flowSend(flow, false, 2000000); elapsed > 50*time.Millisecond {
+		t.Fatalf("unlimited down direction waited %s", elapsed)
+	}
+
+	// 会话级令牌桶每个会话独立
+	other := throttle.Session("10.0.0.1")
+	defer other.Close()
+	if elapsed := flowSend(other, true, 500000); elapsed > 50*time.Millisecond {
+		t.Fatalf("new session waited %s for the burst", elapsed)
+	}
+}
+
+func TestFlowClientShared(t *testing.T) {
+	throttle := NewThrottle(&BandwidthConfig{ClientDown: 1000000})
+
+	// 同一客户端的两个会话共享令牌桶，合计3MB约需2秒
+	var wait sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			flow := throttle.Session("10.0.0.1")
+			defer flow.Close()
+			flowSend(flow, false, 1500000)
+		}()
+	}
+	wait.Wait()
+	expectElapsed(t, "client down", time.Since(start), 2*time.Second)
+
+	// 其它客户端不受影响
+	flow := throttle.Session("10.0.0.2")
+	defer flow.Close()
+	if elapsed := flowSend(flow, false, 500000); elapsed > 50*time.Millisecond {
+		t.Fatalf("other client waited %s", elapsed)
+	}
+}
+
+func TestFlowChunk(t *testing.T) {
+	throttle := NewThrottle(&BandwidthConfig{Up: 100000, SessionUp: 1000000, Down: 1000})
+	flow := throttle.Session("10.0.0.1")
+	defer flow.Close()
+
+	if chunk := flow.Chunk(true); chunk != 5000 {
+		t.Fatalf("up chunk %d, want 5000", chunk)
+	}
+	if chunk := flow.Chunk(false); chunk != throttleMinChunk {
+		t.Fatalf("down chunk %d, want %d", chunk, throttleMinChunk)
+	}
+
+	unlimited := NewThrottle(&BandwidthConfig{}).Session("10.0.0.1")
+	defer unlimited.Close()
+	if unlimited.Limited(true) || unlimited.Limited(false) || unlimited.Chunk(true) != throttleMaxChunk {
+		t.Fatal("empty config must not limit")
+	}
+
+	// 未配置限速时为nil，调用不会出错
+	none := NewThrottle(nil)
+	nilFlow := none.Session("10.0.0.1")
+	nilFlow.Wait(true, 1000)
+	nilFlow.Close()
+}
+
+func TestFlowClose(t *testing.T) {
+	throttle := NewThrottle(&BandwidthConfig{ClientUp: 1000, SessionUp: 1000})
+	a := throttle.Session("10.0.0.1")
+	b := throttle.Session("10.0.0.1")
+	c := throttle.Session("10.0.0.2")
+
+	if a.up[0] != b.up[0] || a.up[0] == c.up[0] {
+		t.Fatal("client bucket must be shared by the same client only")
+	}
+	if a.up[1] == b.up[1] {
+		t.Fatal("session bucket must not be shared")
+	}
+
+	a.Close()
+	if len(throttle.clients) != 2 {
+		t.Fatalf("clients %d after first close, want 2", len(throttle.clients))
+	}
+	b.Close()
+	c.Close()
+	if len(throttle.clients) != 0 {
+		t.Fatalf("clients %d left after all sessions closed", len(throttle.clients))
+	}
+
+	// 释放后重新创建的客户端令牌桶是满的
+	d := throttle.Session("10.0.0.1")
+	defer d.Close()
+	if d.up[0] == a.up[0] {
+		t.Fatal("client bucket reused after release")
+	}
+}
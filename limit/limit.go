@@ -0,0 +1,241 @@
+// Package limit 提供连接数限制、排队和接入速率限制，用于过载保护。
+package limit
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Config struct {
+	MaxConns      int           `yaml:"maxconns"`
+	MaxPerBackend int           `yaml:"maxperbackend"`
+	MaxPerClient  int           `yaml:"maxperclient"`
+	Queue         int           `yaml:"queue"`
+	QueueTimeout  time.Duration `yaml:"queuetimeout"`
+	AcceptRate    float64       `yaml:"acceptrate"`
+	AcceptBurst   int           `yaml:"acceptburst"`
+}
+
+// 监听端口的连接限制，各维度未配置时不限制
+type Limiter struct {
+	Conns    *Semaphore
+	Clients  *KeyCounter
+	Backends *KeyCounter
+	Accept   *Bucket
+
+	rejected uint64
+}
+
+func New(cfg *Config) *Limiter {
+	if cfg == nil {
+		return &Limiter{}
+	}
+	return &Limiter{
+		Conns:    NewSemaphore(cfg.MaxConns, cfg.Queue, cfg.QueueTimeout),
+		Clients:  NewKeyCounter(cfg.MaxPerClient),
+		Backends: NewKeyCounter(cfg.MaxPerBackend),
+		Accept:   NewBucket(cfg.AcceptRate, cfg.AcceptBurst),
+	}
+}
+
+// 记录一次拒绝
+func (l *Limiter) Reject() {
+	atomic.AddUint64(&l.rejected, 1)
+}
+
+func (l *Limiter) Rejected() uint64 {
+	return atomic.LoadUint64(&l.rejected)
+}
+
+// 排队未配置等待时间时的默认值，避免排队的连接一直等待
+const DefaultQueueTimeout = 10 * time.Second
+
+// 并发数限制，超出时最多queue个请求排队等待timeout，queue为0表示立即拒绝
+type Semaphore struct {
+	slots   chan struct{}
+	queue   int32
+	waiting int32
+	timeout time.Duration
+}
+
+func NewSemaphore(max int, queue int, timeout time.Duration) *Semaphore {
+	if max <= 0 {
+		return nil
+	}
+	if queue > 0 && timeout <= 0 {
+		timeout = DefaultQueueTimeout
+	}
+	return &Semaphore{
+		slots:   make(chan struct{}, max),
+		queue:   int32(queue),
+		timeout: timeout,
+	}
+}
+
+func (s *Semaphore) Acquire() bool {
+	if s == nil {
+		return true
+	}
+
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	if atomic.AddInt32(&s.waiting, 1) > s.queue {
+		atomic.AddInt32(&s.waiting, -1)
+		return false
+	}
+	defer atomic.AddInt32(&s.waiting, -1)
+
+	timer := time.NewTimer(s.timeout)
+	defer timer.Stop()
+
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (s *Semaphore) Release() {
+	if s == nil {
+		return
+	}
+	<-s.slots
+}
+
+func (s *Semaphore) Count() int {
+	if s == nil {
+		return 0
+	}
+	return len(s.slots)
+}
+
+// 排队等待的请求数
+func (s *Semaphore) Waiting() int {
+	if s == nil {
+		return 0
+	}
+	return int(atomic.LoadInt32(&s.waiting))
+}
+
+// 按关键字计数的并发限制，例如客户端IP、后端地址
+type KeyCounter struct {
+	sync.Mutex
+
+	max    int
+	counts map[string]int
+}
+
+func NewKeyCounter(max int) *KeyCounter {
+	if max <= 0 {
+		return nil
+	}
+	return &KeyCounter{max: max, counts: make(map[string]int, 1024)}
+}
+
+func (k *KeyCounter) Acquire(key string) bool {
+	if k == nil {
+		return true
+	}
+	k.Lock()
+	defer k.Unlock()
+
+	if k.counts[key] >= k.max {
+		return false
+	}
+	k.counts[key]++
+	return true
+}
+
+func (k *KeyCounter) Release(key string) {
+	if k == nil {
+		return
+	}
+	k.Lock()
+	defer k.Unlock()
+
+	k.counts[key]--
+	if k.counts[key] <= 0 {
+		delete(k.counts, key)
+	}
+}
+
+// 令牌桶，rate为每秒产生的令牌数，burst为桶容量
+type Bucket struct {
+	sync.Mutex
+
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewBucket(rate float64, burst int) *Bucket {
+	if rate <= 0 {
+		return nil
+	}
+	if float64(burst) < rate {
+		burst = int(rate)
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &Bucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// 预留n个令牌，返回需要等待的时间，令牌不足时允许透支
+func (b *Bucket) Reserve(n int) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.Lock()
+	defer b.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// 阻塞直到获取n个令牌
+func (b *Bucket) Wait(n int) {
+	delay := b.Reserve(n)
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// 尝试获取一个令牌，不阻塞
+func (b *Bucket) Allow() bool {
+	if b == nil {
+		return true
+	}
+	b.Lock()
+	defer b.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
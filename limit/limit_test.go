@@ -0,0 +1,159 @@
+package limit
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSemaphoreQueueOverflow(t *testing.T) {
+	s := NewSemaphore(1, 1, time.Second)
+	if !s.Acquire() {
+		t.Fatal("first acquire failed")
+	}
+
+	// 一个排队，超出队列长度的立即拒绝
+	result := make(chan bool, 1)
+	go func() {
+		result <- s.Acquire()
+	}()
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		if s.Waiting() == 1 {
+			break
+		}
+		if time.Since(start) > time.Second {
+			t.Fatal("acquire not queued")
+		}
+	}
+	start := time.Now()
+	if s.Acquire() {
+		t.Fatal("acquire over queue must fail")
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("overflow rejected after %s", elapsed)
+	}
+
+	// 释放后排队的请求获得许可
+	s.Release()
+	select {
+	case ok := <-result:
+		if !ok {
+			t.Fatal("queued acquire failed after release")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("queued acquire not woken")
+	}
+	if s.Count() != 1 || s.Waiting() != 0 {
+		t.Fatalf("count %d waiting %d", s.Count(), s.Waiting())
+	}
+}
+
+func TestSemaphoreQueueTimeout(t *testing.T) {
+	s := NewSemaphore(1, 2, 100*time.Millisecond)
+	s.Acquire()
+
+	start := time.Now()
+	if s.Acquire() {
+		t.Fatal("acquire must time out")
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("queue timeout after %s", elapsed)
+	}
+
+	// 不排队时立即拒绝
+	s = NewSemaphore(1, 0, time.Hour)
+	s.Acquire()
+	start = time.Now()
+	if s.Acquire() || time.Since(start) > 100*time.Millisecond {
+		t.Fatal("acquire without queue must fail immediately")
+	}
+
+	// 配置了排队没有配置等待时间时使用默认值，不会一直等待
+	s = NewSemaphore(1, 1, 0)
+	if s.timeout != DefaultQueueTimeout {
+		t.Fatalf("default queue timeout %s", s.timeout)
+	}
+
+	var none *Semaphore
+	if !none.Acquire() || none.Count() != 0 {
+		t.Fatal("nil semaphore must not limit")
+	}
+	none.Release()
+}
+
+func TestKeyCounter(t *testing.T) {
+	k := NewKeyCounter(2)
+	for i := 0; i < 2; i++ {
+		if !k.Acquire("10.0.0.1:80") {
+			t.Fatalf("acquire %d failed", i)
+		}
+	}
+	if k.Acquire("10.0.0.1:80") {
+		t.Fatal("acquire over per-key limit must fail")
+	}
+	if !k.Acquire("10.0.0.2:80") {
+		t.Fatal("other key must not be limited")
+	}
+
+	k.Release("10.0.0.1:80")
+	if !k.Acquire("10.0.0.1:80") {
+		t.Fatal("acquire after release failed")
+	}
+	k.Release("10.0.0.1:80")
+	k.Release("10.0.0.1:80")
+	k.Release("10.0.0.2:80")
+	if len(k.counts) != 0 {
+		t.Fatalf("counts %v left after release", k.counts)
+	}
+
+	if NewKeyCounter(0) != nil {
+		t.Fatal("zero limit must be nil")
+	}
+	var none *KeyCounter
+	if !none.Acquire("x") {
+		t.Fatal("nil counter must not limit")
+	}
+	none.Release("x")
+}
+
+func TestKeyCounterConcurrent(t *testing.T) {
+	k := NewKeyCounter(5)
+	var wait sync.WaitGroup
+	var lock sync.Mutex
+	granted := 0
+	for i := 0; i < 50; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			if k.Acquire("backend") {
+				lock.Lock()
+				granted++
+				lock.Unlock()
+			}
+		}()
+	}
+	wait.Wait()
+	if granted != 5 {
+		t.Fatalf("granted %d, want 5", granted)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	l := New(&Config{MaxConns: 1, MaxPerBackend: 1, MaxPerClient: 1, Queue: 1})
+	if l.Conns == nil || l.Backends == nil || l.Clients == nil || l.Accept != nil {
+		t.Fatalf("limiter %+v", l)
+	}
+	if l.Conns.timeout != DefaultQueueTimeout {
+		t.Fatalf("queue timeout %s", l.Conns.timeout)
+	}
+	l.Reject()
+	l.Reject()
+	if l.Rejected() != 2 {
+		t.Fatalf("rejected %d", l.Rejected())
+	}
+
+	empty := New(nil)
+	if empty.Conns != nil || empty.Backends != nil || !empty.Backends.Acquire("x") {
+		t.Fatal("nil config must not limit")
+	}
+}
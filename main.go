@@ -0,0 +1,10 @@
+// tcpproxy命令行程序，实现见engine包
+package main
+
+import (
+	"github.com/lixiangyun/tcpproxy/engine"
+)
+
+func main() {
+	engine.Main()
+}
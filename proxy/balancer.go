@@ -0,0 +1,114 @@
+// Package proxy 是引擎和桌面版共用的tcp代理实现，包括监听、接入检查、
+// 后端集群、负载均衡、双向转发和流量统计，也可以被其它程序直接引用。
+package proxy
+
+import (
+	"github.com/lixiangyun/tcpproxy/discovery"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	LB_ROUNDROBIN = "roundrobin"
+	LB_RANDOM     = "random"
+	LB_LEASTCONN  = "leastconn"
+	LB_HASH       = "hash"
+)
+
+// 支持的负载均衡方式，为空时使用roundrobin
+var Modes = []string{LB_ROUNDROBIN, LB_RANDOM, LB_LEASTCONN, LB_HASH}
+
+// 日志输出，桌面版替换为自己的日志
+var Logf = log.Printf
+
+func ValidMode(mode string) bool {
+	if mode == "" {
+		return true
+	}
+	for _, v := range Modes {
+		if v == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// 负载均衡，在同一优先级的成员中选择起始成员，连接失败时从起始成员依次尝试后面的成员，
+// Acquire和Release在后端连接建立和结束时调用
+type Balancer interface {
+	Next(group []discovery.Endpoint, client string) int
+	Acquire(address string)
+	Release(address string)
+}
+
+type balancer struct {
+	sync.Mutex
+
+	mode  string
+	times uint32
+	conns map[string]int
+}
+
+// 按方式创建负载均衡，不支持的方式按roundrobin处理，成员权重在roundrobin、random和hash中生效
+func NewBalancer(mode string) Balancer {
+	if !ValidMode(mode) || mode == "" {
+		mode = LB_ROUNDROBIN
+	}
+	return &balancer{mode: mode, conns: make(map[string]int)}
+}
+
+func (b *balancer) Next(group []discovery.Endpoint, client string) int {
+	switch b.mode {
+	case LB_RANDOM:
+		return discovery.Pick(group, rand.Uint32())
+	case LB_HASH:
+		h := fnv.New32a()
+		h.Write([]byte(client))
+		return discovery.Pick(group, h.Sum32())
+	case LB_LEASTCONN:
+		return b.least(group, atomic.AddUint32(&b.times, 1)-1)
+	}
+	return discovery.Pick(group, atomic.AddUint32(&b.times, 1)-1)
+}
+
+func weight(e discovery.Endpoint) int {
+	if e.Weight <= 0 {
+		return 1
+	}
+	return e.Weight
+}
+
+// 活动连接数和权重的比值最小的成员，相同时按轮询顺序
+func (b *balancer) least(group []discovery.Endpoint, n uint32) int {
+	b.Lock()
+	defer b.Unlock()
+
+	start := int(n % uint32(len(group)))
+	best := start
+	for i := 1; i < len(group); i++ {
+		idx := (start + i) % len(group)
+		a, c := group[idx], group[best]
+		if b.conns[a.Address]*weight(c) < b.conns[c.Address]*weight(a) {
+			best = idx
+		}
+	}
+	return best
+}
+
+func (b *balancer) Acquire(address string) {
+	b.Lock()
+	b.conns[address]++
+	b.Unlock()
+}
+
+func (b *balancer) Release(address string) {
+	b.Lock()
+	b.conns[address]--
+	if b.conns[address] <= 0 {
+		delete(b.conns, address)
+	}
+	b.Unlock()
+}
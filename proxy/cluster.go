@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"github.com/lixiangyun/tcpproxy/discovery"
+	"github.com/lixiangyun/tcpproxy/limit"
+	"net"
+	"sync/atomic"
+)
+
+var (
+	ErrNoBackend    = errors.New("no backend available")
+	ErrBackendLimit = errors.New("backend connect limit reached")
+)
+
+// 后端集群，成员按优先级分组，组内由负载均衡选择，成员变化时整体替换
+type Cluster struct {
+	Name     string
+	Balancer Balancer
+	// 单个后端的连接数限制，为nil不限制
+	Backends *limit.KeyCounter
+	// 建立后端连接，默认直接使用net.Dial
+	Dial func(ep discovery.Endpoint) (net.Conn, error)
+	// 后端连接使用tls，未设置ServerName时按选中的后端设置，见discovery.Endpoint.Host
+	TLS *tls.Config
+
+	groups atomic.Value
+}
+
+type ClusterOption func(c *Cluster)
+
+// 初始成员
+func ClusterEndpoints(list []discovery.Endpoint) ClusterOption {
+	return func(c *Cluster) {
+		c.UpdateEndpoints(list)
+	}
+}
+
+// 单个后端的连接数限制
+func ClusterLimit(max int) ClusterOption {
+	return func(c *Cluster) {
+		c.Backends = limit.NewKeyCounter(max)
+	}
+}
+
+// 连接后端，*net.Dialer和*sockopt.Dialer均可使用
+type Dialer interface {
+	Dial(network, address string) (net.Conn, error)
+}
+
+func ClusterDialer(dialer Dialer) ClusterOption {
+	return func(c *Cluster) {
+		c.Dial = func(ep discovery.Endpoint) (net.Conn, error) {
+			return dialer.Dial("tcp", ep.Address)
+		}
+	}
+}
+
+func ClusterTLS(cfg *tls.Config) ClusterOption {
+	return func(c *Cluster) {
+		c.TLS = cfg
+	}
+}
+
+func NewCluster(name string, balancer Balancer, opts ...ClusterOption) *Cluster {
+	if balancer == nil {
+		balancer = NewBalancer("")
+	}
+	c := &Cluster{Name: name, Balancer: balancer}
+	c.Dial = func(ep discovery.Endpoint) (net.Conn, error) {
+		return net.Dial("tcp", ep.Address)
+	}
+	c.groups.Store([][]discovery.Endpoint(nil))
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+func (c *Cluster) dial(ep discovery.Endpoint) (net.Conn, error) {
+	conn, err := c.Dial(ep)
+	if err != nil || c.TLS == nil {
+		return conn, err
+	}
+	cfg := c.TLS
+	if cfg.ServerName == "" {
+		cfg = cfg.Clone()
+		cfg.ServerName = ep.Host()
+	}
+	return tls.Client(conn, cfg), nil
+}
+
+// 替换全部成员，可以直接作为discovery.Pool的OnUpdate
+func (c *Cluster) UpdateEndpoints(list []discovery.Endpoint) {
+	c.groups.Store(discovery.Groups(list))
+}
+
+func (c *Cluster) Endpoints() []discovery.Endpoint {
+	var output []discovery.Endpoint
+	for _, group := range c.groups.Load().([][]discovery.Endpoint) {
+		output = append(output, group...)
+	}
+	return output
+}
+
+// 选择后端并建立连接，按优先级分组依次尝试，跳过连接数已满或连接失败的后端，
+// 成功后需要调用Release
+func (c *Cluster) Connect(client string) (net.Conn, discovery.Endpoint, error) {
+	return c.ConnectWith(client, nil, nil)
+}
+
+// 与Connect相同，list不为nil时在list中选择，dialed不为nil时在每次连接后调用
+func (c *Cluster) ConnectWith(client string, list []discovery.Endpoint,
+	dialed func(ep discovery.Endpoint, err error)) (net.Conn, discovery.Endpoint, error) {
+	return c.connect(client, list, dialed, nil)
+}
+
+// 同时占用集群和监听的单个后端连接数，任意一个已满时失败
+func (c *Cluster) acquire(address string, backends *limit.KeyCounter) bool {
+	if !c.Backends.Acquire(address) {
+		return false
+	}
+	if !backends.Acquire(address) {
+		c.Backends.Release(address)
+		return false
+	}
+	return true
+}
+
+// backends为监听级别的单个后端连接数限制，为nil时只使用集群的限制，
+// 成功后需要使用同样的backends调用release。失败的原因为连接错误时同时返回最后一个连接失败的后端
+func (c *Cluster) connect(client string, list []discovery.Endpoint,
+	dialed func(ep discovery.Endpoint, err error), backends *limit.KeyCounter) (net.Conn, discovery.Endpoint, error) {
+	groups := c.groups.Load().([][]discovery.Endpoint)
+	if list != nil {
+		groups = discovery.Groups(list)
+	}
+
+	err := ErrNoBackend
+	var failed discovery.Endpoint
+	for _, group := range groups {
+		start := c.Balancer.Next(group, client)
+		for i := 0; i < len(group); i++ {
+			ep := group[(start+i)%len(group)]
+
+			if !c.acquire(ep.Address, backends) {
+				Logf("backend %s connect limit reached", ep.Address)
+				if err == ErrNoBackend {
+					err = ErrBackendLimit
+				}
+				continue
+			}
+
+			conn, derr := c.dial(ep)
+			if dialed != nil {
+				dialed(ep, derr)
+			}
+			if derr != nil {
+				c.Backends.Release(ep.Address)
+				backends.Release(ep.Address)
+				Logf("backend %s connect failed, %s", ep.Address, derr.Error())
+				err = derr
+				failed = ep
+				continue
+			}
+
+			c.Balancer.Acquire(ep.Address)
+			return conn, ep, nil
+		}
+	}
+	return nil, failed, err
+}
+
+// 后端连接结束
+func (c *Cluster) Release(address string) {
+	c.release(address, nil)
+}
+
+func (c *Cluster) release(address string, backends *limit.KeyCounter) {
+	c.Balancer.Release(address)
+	c.Backends.Release(address)
+	backends.Release(address)
+}
@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"errors"
+	"github.com/lixiangyun/tcpproxy/limit"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// 零拷贝转发时每段数据的长度，每段结束后统计一次流量
+	spliceChunk = 256 * 1024
+	// 零拷贝转发的统计周期，通过读超时让低速连接也能及时刷新流量和活跃时间
+	spliceInterval = time.Second
+	// 零拷贝转发出错时探测读端是否仍然可用的等待时间
+	probeTimeout = 10 * time.Millisecond
+	bufferSize   = 32 * 1024
+)
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, bufferSize)
+		return &buf
+	},
+}
+
+// 单方向转发，Up表示客户端到后端方向
+type Forwarder struct {
+	Up bool
+	// 会话限速，为nil不限速
+	Flow *limit.Flow
+	// 每次转发后统计流量
+	Count func(cnt int)
+	// 需要转发的数据内容时设置，此时不使用零拷贝
+	Tap func(body []byte)
+	// 转发结束、关闭连接之前调用，用于记录结束原因
+	Done func(rerr error, werr error)
+}
+
+// 两端都是明文tcp连接时，io.Copy在linux下会使用splice(2)零拷贝
+func spliceAble(dst net.Conn, src net.Conn) bool {
+	_, ok1 := dst.(*net.TCPConn)
+	_, ok2 := src.(*net.TCPConn)
+	return ok1 && ok2
+}
+
+// 关闭连接的写方向，向对端发送FIN，tcp与tls连接均支持
+func CloseWrite(conn net.Conn) bool {
+	cw, ok := conn.(interface{ CloseWrite() error })
+	if !ok {
+		return false
+	}
+	return cw.CloseWrite() == nil
+}
+
+// 根据io.Copy返回的错误区分读端错误和写端错误。零拷贝时两端的错误都包装为readfrom，
+// 内层为net.OpError时按内层区分，否则为splice的系统调用错误，此时EPIPE或者src仍然可读时为写端错误
+func copyError(err error, src net.Conn) (error, error) {
+	oe, ok := err.(*net.OpError)
+	if !ok {
+		return err, nil
+	}
+	switch oe.Op {
+	case "write":
+		return nil, err
+	case "readfrom":
+	default:
+		return err, nil
+	}
+	if inner, ok := oe.Err.(*net.OpError); ok {
+		if inner.Op == "write" {
+			return nil, err
+		}
+		return err, nil
+	}
+	if errors.Is(oe.Err, syscall.EPIPE) || readable(src) {
+		return nil, err
+	}
+	return err, nil
+}
+
+// 探测连接是否仍然可读，可能读走数据，只用于出错后即将关闭的连接。
+// 走到这里时rerr或werr不是io.EOF，Forward随后关闭两端，读走的字节不会再被转发，不会丢失有效数据
+func readable(conn net.Conn) bool {
+	var b [1]byte
+	conn.SetReadDeadline(time.Now().Add(probeTimeout))
+	_, err := conn.Read(b[:])
+	if err == nil {
+		return true
+	}
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+func (f *Forwarder) count(cnt int) {
+	if f.Count != nil {
+		f.Count(cnt)
+	}
+}
+
+// 零拷贝转发，按段统计流量，返回读端错误与写端错误。
+// 读超时只会在splice从src读入管道时触发，此时管道为空，已读入的数据都已写到dst并计入cnt，
+// 超时后继续下一轮不会丢数据；src只有当前协程读取，覆盖其读超时也不影响其它逻辑，
+// 空闲超时由Stats.Watch按活跃时间判断，与这里的读超时无关
+func (f *Forwarder) splice(dst net.Conn, src net.Conn) (error, error) {
+	for {
+		src.SetReadDeadline(time.Now().Add(spliceInterval))
+		cnt, err := io.CopyN(dst, src, spliceChunk)
+		if cnt > 0 {
+			f.count(int(cnt))
+		}
+		if err == nil {
+			continue
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			continue
+		}
+		return copyError(err, src)
+	}
+}
+
+// 使用缓存池中的内存转发，适用于tls、限速等无法零拷贝的场景，返回读端错误与写端错误
+func (f *Forwarder) buffer(dst net.Conn, src net.Conn) (error, error) {
+	pbuf := bufferPool.Get().(*[]byte)
+	defer bufferPool.Put(pbuf)
+
+	buf := *pbuf
+	if size := f.Flow.Chunk(f.Up); size > 0 && size < len(buf) {
+		buf = buf[:size]
+	}
+	for {
+		cnt, err := src.Read(buf)
+		if cnt > 0 {
+			f.count(cnt)
+			if f.Tap != nil {
+				f.Tap(buf[:cnt])
+			}
+			f.Flow.Wait(f.Up, cnt)
+			_, werr := dst.Write(buf[:cnt])
+			if werr != nil {
+				return nil, werr
+			}
+		}
+		if err != nil {
+			return err, nil
+		}
+	}
+}
+
+// 从src转发到dst直到任意一端出错，返回读端错误与写端错误
+func (f *Forwarder) Copy(dst net.Conn, src net.Conn) (error, error) {
+	if f.Tap == nil && !f.Flow.Limited(f.Up) && spliceAble(dst, src) {
+		return f.splice(dst, src)
+	}
+	return f.buffer(dst, src)
+}
+
+// 转发直到结束，读端正常结束时只关闭对端的写方向，反方向继续转发，其它情况关闭两端
+func (f *Forwarder) Forward(dst net.Conn, src net.Conn) (error, error) {
+	rerr, werr := f.Copy(dst, src)
+	if f.Done != nil {
+		f.Done(rerr, werr)
+	}
+	if werr == nil && rerr == io.EOF && CloseWrite(dst) {
+		return rerr, werr
+	}
+	src.Close()
+	dst.Close()
+	return rerr, werr
+}
+
+// 双向转发，两个方向都结束后返回
+func Pipe(client net.Conn, backend net.Conn, up *Forwarder, down *Forwarder) {
+	wait := new(sync.WaitGroup)
+	wait.Add(2)
+	go func() {
+		defer wait.Done()
+		up.Forward(backend, client)
+	}()
+	go func() {
+		defer wait.Done()
+		down.Forward(client, backend)
+	}()
+	wait.Wait()
+}
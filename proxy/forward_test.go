@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// 建立一对本地tcp连接，返回客户端和服务端
+func tcpPair(t testing.TB) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+// 持续写入直到连接出错
+func writeLoop(conn net.Conn) {
+	block := make([]byte, bufferSize)
+	for {
+		if _, err := conn.Write(block); err != nil {
+			return
+		}
+	}
+}
+
+// 发送RST关闭连接
+func reset(conn net.Conn) {
+	conn.(*net.TCPConn).SetLinger(0)
+	conn.Close()
+}
+
+func TestForwardBackendReset(t *testing.T) {
+	client, src := tcpPair(t)
+	dst, backend := tcpPair(t)
+	defer client.Close()
+
+	go writeLoop(client)
+	go func() {
+		io.CopyN(ioutil.Discard, backend, 1024*1024)
+		reset(backend)
+	}()
+
+	session := NewSession("test", src, dst)
+	session.Forwarder(true, nil).Forward(dst, src)
+	if reason := session.Reason(); reason != REASON_BACKEND_ERROR {
+		t.Fatalf("backend reset while uploading, reason %s", reason)
+	}
+}
+
+func TestForwardClientReset(t *testing.T) {
+	client, src := tcpPair(t)
+	dst, backend := tcpPair(t)
+	defer backend.Close()
+
+	go func() {
+		client.Write([]byte("hello"))
+		time.Sleep(100 * time.Millisecond)
+		reset(client)
+	}()
+	go io.Copy(ioutil.Discard, backend)
+
+	session := NewSession("test", src, dst)
+	session.Forwarder(true, nil).Forward(dst, src)
+	if reason := session.Reason(); reason != REASON_CLIENT_ERROR {
+		t.Fatalf("client reset while uploading, reason %s", reason)
+	}
+}
+
+// 转发b.N个32KB的数据块，统计吞吐量和内存分配
+func benchmarkForward(b *testing.B, copy func(f *Forwarder, dst net.Conn, src net.Conn) (error, error)) {
+	in, src := tcpPair(b)
+	dst, out := tcpPair(b)
+	defer in.Close()
+	defer src.Close()
+	defer dst.Close()
+	defer out.Close()
+
+	block := make([]byte, bufferSize)
+	go func() {
+		for i := 0; i < b.N; i++ {
+			in.Write(block)
+		}
+		in.(*net.TCPConn).CloseWrite()
+	}()
+	done := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, out)
+		close(done)
+	}()
+
+	b.SetBytes(int64(len(block)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	rerr, werr := copy(&Forwarder{Up: true}, dst, src)
+	dst.(*net.TCPConn).CloseWrite()
+	<-done
+	if rerr != io.EOF || werr != nil {
+		b.Fatalf("forward failed, read %v, write %v", rerr, werr)
+	}
+}
+
+func BenchmarkForwardSplice(b *testing.B) {
+	benchmarkForward(b, (*Forwarder).splice)
+}
+
+func BenchmarkForwardBuffer(b *testing.B) {
+	benchmarkForward(b, (*Forwarder).buffer)
+}
+
+// 重构之前tcpChannel的转发方式，每个连接分配64KB缓存，逐次读写，作为对比基准
+func baselineCopy(f *Forwarder, dst net.Conn, src net.Conn) (error, error) {
+	buf := make([]byte, 65535)
+	for {
+		cnt, err := src.Read(buf)
+		if cnt > 0 {
+			f.count(cnt)
+			for sent := 0; sent < cnt; {
+				n, werr := dst.Write(buf[sent:cnt])
+				if werr != nil {
+					return nil, werr
+				}
+				sent += n
+			}
+		}
+		if err != nil {
+			return err, nil
+		}
+	}
+}
+
+func BenchmarkForwardBaseline(b *testing.B) {
+	benchmarkForward(b, baselineCopy)
+}
@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"fmt"
+	"github.com/lixiangyun/tcpproxy/acl"
+	"github.com/lixiangyun/tcpproxy/ban"
+	"github.com/lixiangyun/tcpproxy/limit"
+	"github.com/lixiangyun/tcpproxy/sockopt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 监听端口，接收速率由Limiter控制
+type Listener struct {
+	Address string
+	Limiter *limit.Limiter
+
+	list   net.Listener
+	closed int32
+	wait   sync.WaitGroup
+}
+
+func Listen(address string, opt *sockopt.Options, limiter *limit.Limiter) (*Listener, error) {
+	list, err := sockopt.Listen("tcp", address, opt)
+	if err != nil {
+		return nil, err
+	}
+	if limiter == nil {
+		limiter = limit.New(nil)
+	}
+	return &Listener{Address: address, Limiter: limiter, list: list}, nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.list.Addr()
+}
+
+// 循环接收连接，每个连接在独立的协程中处理，关闭后等待全部连接处理结束再返回
+func (l *Listener) Serve(handle func(conn net.Conn)) {
+	for atomic.LoadInt32(&l.closed) == 0 {
+		l.Limiter.Accept.Wait(1)
+		conn, err := l.list.Accept()
+		if err != nil {
+			if atomic.LoadInt32(&l.closed) == 0 {
+				Logf("listener %s accept failed, %s", l.Address, err.Error())
+				time.Sleep(10 * time.Millisecond)
+			}
+			continue
+		}
+		l.wait.Add(1)
+		go func() {
+			defer l.wait.Done()
+			handle(conn)
+		}()
+	}
+	l.wait.Wait()
+}
+
+// 停止接收新连接，已建立的连接由调用者关闭
+func (l *Listener) Close() error {
+	atomic.StoreInt32(&l.closed, 1)
+	return l.list.Close()
+}
+
+// 接入检查拒绝的原因，Deny表示访问控制或者封禁，否则为连接数限制
+type AdmitError struct {
+	Deny   bool
+	Reason string
+}
+
+func (e *AdmitError) Error() string {
+	return e.Reason
+}
+
+// 接入检查，依次为访问控制、封禁、客户端连接数和总连接数限制
+type Gate struct {
+	Acl     *acl.List
+	Ban     *ban.Detector
+	Limiter *limit.Limiter
+}
+
+// 客户端IP，无法解析时使用完整地址
+func ClientIP(addr net.Addr) string {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP.String()
+	}
+	return addr.String()
+}
+
+// 检查通过时返回客户端IP和释放函数，连接结束后调用释放函数
+func (g *Gate) Admit(conn net.Conn) (string, func(), error) {
+	if ok, rule := g.Acl.Allow(conn.RemoteAddr()); !ok {
+		return "", nil, &AdmitError{Deny: true, Reason: "acl rule " + rule}
+	}
+
+	client := ClientIP(conn.RemoteAddr())
+	if banned, item := g.Ban.Banned(client); banned {
+		return "", nil, &AdmitError{Deny: true, Reason: fmt.Sprintf("banned until %s for %s",
+			item.Until.Format(time.RFC3339), item.Reason)}
+	}
+	if !g.Ban.Connect(client) {
+		return "", nil, &AdmitError{Deny: true, Reason: "client banned"}
+	}
+
+	limiter := g.Limiter
+	if limiter == nil {
+		limiter = limit.New(nil)
+	}
+	if !limiter.Clients.Acquire(client) {
+		limiter.Reject()
+		return "", nil, &AdmitError{Reason: "client connect limit reached"}
+	}
+	if !limiter.Conns.Acquire() {
+		limiter.Clients.Release(client)
+		limiter.Reject()
+		return "", nil, &AdmitError{Reason: "listener connect limit reached"}
+	}
+	return client, func() {
+		limiter.Conns.Release()
+		limiter.Clients.Release(client)
+	}, nil
+}
@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"github.com/lixiangyun/tcpproxy/discovery"
+	"net"
+)
+
+// 一个客户端连接在中间件之间传递的信息
+type ConnInfo struct {
+	Listener string
+	// 转发的集群，接入阶段修改后使用新的集群，调用者只有一个集群时忽略
+	Cluster string
+	// 客户端IP
+	Client string
+	// 客户端连接，接入阶段可以替换，例如预读数据后重放的连接
+	Conn net.Conn
+	// 选中的后端，连接成功后设置，全部连接失败时为最后一个失败的后端
+	Endpoint discovery.Endpoint
+	// 会话统计，建立会话后设置，没有建立会话时为nil
+	Stats *Stats
+	// 结束原因，关闭时设置，没有建立会话时为拒绝或者连接失败的原因
+	Reason string
+	// 中间件之间传递或者写入日志的标签
+	Tags map[string]string
+}
+
+func (i *ConnInfo) Tag(key string, value string) {
+	if i.Tags == nil {
+		i.Tags = make(map[string]string)
+	}
+	i.Tags[key] = value
+}
+
+// 连接处理的中间件，嵌入Base后只需实现关心的方法
+type Middleware interface {
+	// 接入检查通过后调用，返回错误时拒绝连接
+	Accept(info *ConnInfo) error
+	// 选择后端前调用，list为当前候选成员，返回非nil时只在返回的成员中选择
+	Select(info *ConnInfo, list []discovery.Endpoint) []discovery.Endpoint
+	// 每次后端连接成功或失败后调用，失败时会继续尝试其它成员
+	Dial(info *ConnInfo, ep discovery.Endpoint, err error)
+	// 握手完成、开始转发前包装客户端连接，包装后的连接不再使用零拷贝
+	WrapClient(info *ConnInfo, conn net.Conn) net.Conn
+	// 握手完成、开始转发前包装后端连接
+	WrapBackend(info *ConnInfo, conn net.Conn) net.Conn
+	// 接入通过的连接结束时调用，此时连接均已关闭
+	Close(info *ConnInfo)
+}
+
+// 不做任何处理的中间件
+type Base struct{}
+
+func (Base) Accept(info *ConnInfo) error {
+	return nil
+}
+
+func (Base) Select(info *ConnInfo, list []discovery.Endpoint) []discovery.Endpoint {
+	return nil
+}
+
+func (Base) Dial(info *ConnInfo, ep discovery.Endpoint, err error) {}
+
+func (Base) WrapClient(info *ConnInfo, conn net.Conn) net.Conn {
+	return conn
+}
+
+func (Base) WrapBackend(info *ConnInfo, conn net.Conn) net.Conn {
+	return conn
+}
+
+func (Base) Close(info *ConnInfo) {}
+
+// 中间件链，按添加顺序调用，Close按相反顺序调用
+type Chain []Middleware
+
+// 依次调用，任意中间件拒绝时返回，已通过的中间件按相反顺序调用Close
+func (c Chain) Accept(info *ConnInfo) error {
+	for i, m := range c {
+		if err := m.Accept(info); err != nil {
+			info.Reason = err.Error()
+			c[:i].Close(info)
+			return err
+		}
+	}
+	return nil
+}
+
+// 每个中间件在前一个的结果上选择，没有中间件修改时返回nil
+func (c Chain) Select(info *ConnInfo, cluster *Cluster) []discovery.Endpoint {
+	if len(c) == 0 {
+		return nil
+	}
+	var output []discovery.Endpoint
+	list := cluster.Endpoints()
+	for _, m := range c {
+		if selected := m.Select(info, list); selected != nil {
+			list, output = selected, selected
+		}
+	}
+	return output
+}
+
+func (c Chain) Dial(info *ConnInfo, ep discovery.Endpoint, err error) {
+	for _, m := range c {
+		m.Dial(info, ep, err)
+	}
+}
+
+// 后添加的中间件包装在外层
+func (c Chain) WrapClient(info *ConnInfo, conn net.Conn) net.Conn {
+	for _, m := range c {
+		conn = m.WrapClient(info, conn)
+	}
+	return conn
+}
+
+func (c Chain) WrapBackend(info *ConnInfo, conn net.Conn) net.Conn {
+	for _, m := range c {
+		conn = m.WrapBackend(info, conn)
+	}
+	return conn
+}
+
+func (c Chain) Close(info *ConnInfo) {
+	for i := len(c) - 1; i >= 0; i-- {
+		c[i].Close(info)
+	}
+}
+
+// 后端连接回调，中间件链为空时返回nil
+func (c Chain) Dialed(info *ConnInfo) func(ep discovery.Endpoint, err error) {
+	if len(c) == 0 {
+		return nil
+	}
+	return func(ep discovery.Endpoint, err error) {
+		c.Dial(info, ep, err)
+	}
+}
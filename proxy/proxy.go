@@ -0,0 +1,546 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/lixiangyun/tcpproxy/acl"
+	"github.com/lixiangyun/tcpproxy/ban"
+	"github.com/lixiangyun/tcpproxy/discovery"
+	"github.com/lixiangyun/tcpproxy/limit"
+	"github.com/lixiangyun/tcpproxy/sockopt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrStarted = errors.New("proxy already started")
+
+// 连接事件回调，均可为nil，回调在连接所在的协程中执行
+type Hooks struct {
+	// 接入检查通过后调用，返回错误时拒绝连接
+	OnAccept func(conn net.Conn) error
+	// 连接被拒绝或者后端连接失败，此时没有建立会话。info.Conn为客户端连接，
+	// 后端连接失败时info.Endpoint为最后一个连接失败的后端
+	OnError func(info *ConnInfo, err error)
+	// 后端连接建立、tls握手完成，开始转发前调用
+	OnConnect func(s *Session)
+	// 会话结束，连接均已关闭，可以读取最终的流量和结束原因
+	OnClose func(s *Session)
+}
+
+// 代理实例，由若干监听组成，每个监听把连接转发到一个集群
+type Proxy struct {
+	hooks     Hooks
+	chain     Chain
+	idle      time.Duration
+	max       time.Duration
+	handshake time.Duration
+	total     *Stats
+	clusters  map[string]*Cluster
+	routes    []*route
+
+	lock    sync.Mutex
+	started bool
+	done    chan struct{}
+	// 已开始强制关闭，之后建立的会话立即关闭
+	closing  bool
+	seq      uint64
+	sessions map[uint64]*Session
+	// 全部监听及其连接的处理协程
+	wait sync.WaitGroup
+	// 开始强制关闭之前建立的会话，强制关闭时只等待这些会话结束
+	active sync.WaitGroup
+}
+
+// 监听及其接入配置
+type route struct {
+	address  string
+	cluster  string
+	tls      *tls.Config
+	opt      *sockopt.Options
+	gate     Gate
+	throttle *limit.Throttle
+	router   *Router
+	taps     []func(s *Session) Tap
+	pipe     PipeFunc
+	chain    Chain
+	list     *Listener
+
+	// 为0时使用代理的设置
+	idle      time.Duration
+	max       time.Duration
+	handshake time.Duration
+}
+
+// 会话的双向转发，两个方向都结束后返回，flow为会话限速
+type PipeFunc func(s *Session, client net.Conn, backend net.Conn, flow *limit.Flow)
+
+// 默认的双向转发，统计流量、旁路数据并根据读写错误记录结束原因
+func SessionPipe(s *Session, client net.Conn, backend net.Conn, flow *limit.Flow) {
+	Pipe(client, backend, s.Forwarder(true, flow), s.Forwarder(false, flow))
+}
+
+type Option func(p *Proxy)
+
+type ListenerOption func(r *route)
+
+// 添加集群，同名集群后添加的生效
+func WithCluster(cluster *Cluster) Option {
+	return func(p *Proxy) {
+		p.clusters[cluster.Name] = cluster
+	}
+}
+
+// 添加监听，连接转发到名为cluster的集群，address可以使用":0"由系统分配端口
+func WithListener(address string, cluster string, opts ...ListenerOption) Option {
+	return func(p *Proxy) {
+		r := &route{address: address, cluster: cluster}
+		for _, opt := range opts {
+			opt(r)
+		}
+		p.routes = append(p.routes, r)
+	}
+}
+
+func WithHooks(hooks Hooks) Option {
+	return func(p *Proxy) {
+		p.hooks = hooks
+	}
+}
+
+// 追加中间件，在Hooks之后调用
+func WithMiddleware(m ...Middleware) Option {
+	return func(p *Proxy) {
+		p.chain = append(p.chain, m...)
+	}
+}
+
+// 会话空闲超时，为0不限制
+func WithIdleTimeout(timeout time.Duration) Option {
+	return func(p *Proxy) {
+		p.idle = timeout
+	}
+}
+
+// 会话最长存活时间，为0不限制
+func WithMaxDuration(duration time.Duration) Option {
+	return func(p *Proxy) {
+		p.max = duration
+	}
+}
+
+// tls握手超时，为0不限制
+func WithHandshakeTimeout(timeout time.Duration) Option {
+	return func(p *Proxy) {
+		p.handshake = timeout
+	}
+}
+
+// 汇总全部会话的流量
+func WithStats(total *Stats) Option {
+	return func(p *Proxy) {
+		p.total = total
+	}
+}
+
+// 客户端连接使用tls
+func ListenTLS(cfg *tls.Config) ListenerOption {
+	return func(r *route) {
+		r.tls = cfg
+	}
+}
+
+func ListenSockOpt(opt *sockopt.Options) ListenerOption {
+	return func(r *route) {
+		r.opt = opt
+	}
+}
+
+// 接收速率和连接数限制
+func ListenLimit(limiter *limit.Limiter) ListenerOption {
+	return func(r *route) {
+		r.gate.Limiter = limiter
+	}
+}
+
+func ListenACL(list *acl.List) ListenerOption {
+	return func(r *route) {
+		r.gate.Acl = list
+	}
+}
+
+func ListenBan(detector *ban.Detector) ListenerOption {
+	return func(r *route) {
+		r.gate.Ban = detector
+	}
+}
+
+// 按表达式拒绝连接、选择集群或者打标签，在其它中间件之前调用，
+// 未设置health时使用代理中集群的成员数
+func ListenRouter(router *Router) ListenerOption {
+	return func(r *route) {
+		r.router = router
+	}
+}
+
+// 会话限速
+func ListenThrottle(throttle *limit.Throttle) ListenerOption {
+	return func(r *route) {
+		r.throttle = throttle
+	}
+}
+
+// 监听的会话空闲超时，覆盖WithIdleTimeout
+func ListenIdleTimeout(timeout time.Duration) ListenerOption {
+	return func(r *route) {
+		r.idle = timeout
+	}
+}
+
+// 监听的会话最长存活时间，覆盖WithMaxDuration
+func ListenMaxDuration(duration time.Duration) ListenerOption {
+	return func(r *route) {
+		r.max = duration
+	}
+}
+
+// 监听的tls握手超时，覆盖WithHandshakeTimeout
+func ListenHandshakeTimeout(timeout time.Duration) ListenerOption {
+	return func(r *route) {
+		r.handshake = timeout
+	}
+}
+
+// 会话建立后创建数据旁路，例如抓包或者录制，返回nil时该会话不使用
+func ListenTap(fn func(s *Session) Tap) ListenerOption {
+	return func(r *route) {
+		r.taps = append(r.taps, fn)
+	}
+}
+
+// 替换默认的双向转发，例如增加网络损伤模拟
+func ListenPipe(pipe PipeFunc) ListenerOption {
+	return func(r *route) {
+		r.pipe = pipe
+	}
+}
+
+func New(opts ...Option) *Proxy {
+	p := &Proxy{
+		clusters: make(map[string]*Cluster),
+		sessions: make(map[uint64]*Session),
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// 按地址生成同一优先级、相同权重的后端成员
+func Endpoints(address ...string) []discovery.Endpoint {
+	output := make([]discovery.Endpoint, 0, len(address))
+	for _, v := range address {
+		output = append(output, discovery.Endpoint{Address: v, Weight: 1, Source: v})
+	}
+	return output
+}
+
+func (p *Proxy) Cluster(name string) *Cluster {
+	return p.clusters[name]
+}
+
+// 集群的当前成员数，集群不存在时为0
+func (p *Proxy) healthy(name string) int {
+	c, ok := p.clusters[name]
+	if !ok {
+		return 0
+	}
+	return len(c.Endpoints())
+}
+
+// 替换集群成员，可以在运行中调用
+func (p *Proxy) UpdateEndpoints(cluster string, list []discovery.Endpoint) error {
+	c, ok := p.clusters[cluster]
+	if !ok {
+		return fmt.Errorf("cluster %s not found", cluster)
+	}
+	c.UpdateEndpoints(list)
+	return nil
+}
+
+// 启动全部监听，任意监听失败时关闭已启动的监听并返回错误，
+// ctx结束时立即关闭代理，平滑退出使用Shutdown
+func (p *Proxy) Start(ctx context.Context) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.started {
+		return ErrStarted
+	}
+	for _, r := range p.routes {
+		if _, ok := p.clusters[r.cluster]; !ok {
+			return fmt.Errorf("listener %s cluster %s not found", r.address, r.cluster)
+		}
+	}
+
+	for i, r := range p.routes {
+		list, err := Listen(r.address, r.opt, r.gate.Limiter)
+		if err != nil {
+			for _, v := range p.routes[:i] {
+				v.list.Close()
+				v.list = nil
+			}
+			return fmt.Errorf("listener %s start failed, %s", r.address, err.Error())
+		}
+		r.list = list
+		r.gate.Limiter = list.Limiter
+	}
+
+	p.started = true
+	p.done = make(chan struct{})
+	for _, r := range p.routes {
+		r.chain = p.chain
+		if r.idle == 0 {
+			r.idle = p.idle
+		}
+		if r.max == 0 {
+			r.max = p.max
+		}
+		if r.handshake == 0 {
+			r.handshake = p.handshake
+		}
+		if r.pipe == nil {
+			r.pipe = SessionPipe
+		}
+		if r.router != nil {
+			if r.router.health == nil {
+				r.router.health = p.healthy
+			}
+			r.chain = append(Chain{r.router}, p.chain...)
+		}
+		p.wait.Add(1)
+		go func(r *route) {
+			defer p.wait.Done()
+			r.list.Serve(func(conn net.Conn) {
+				p.handle(r, conn)
+			})
+		}(r)
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			p.Close()
+		case <-p.done:
+		}
+	}()
+	return nil
+}
+
+// 监听的实际地址，顺序与添加顺序一致，未启动时为空
+func (p *Proxy) Addrs() []net.Addr {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	var output []net.Addr
+	for _, r := range p.routes {
+		if r.list != nil {
+			output = append(output, r.list.Addr())
+		}
+	}
+	return output
+}
+
+// 当前会话，按建立顺序排列
+func (p *Proxy) Sessions() []*Session {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	output := make([]*Session, 0, len(p.sessions))
+	for _, s := range p.sessions {
+		output = append(output, s)
+	}
+	sort.Slice(output, func(i, j int) bool {
+		return output[i].ID < output[j].ID
+	})
+	return output
+}
+
+// 停止接收新连接，可以重复调用
+func (p *Proxy) stop() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if !p.started {
+		return
+	}
+	select {
+	case <-p.done:
+		return
+	default:
+	}
+	close(p.done)
+	for _, r := range p.routes {
+		r.list.Close()
+	}
+}
+
+// 停止接收新连接并等待已有会话结束，ctx结束时关闭剩余会话并返回ctx的错误。
+// 此时仍在接入检查、排队、中间件或者连接后端的连接不再等待，它们建立会话后立即关闭
+func (p *Proxy) Shutdown(ctx context.Context) error {
+	p.stop()
+
+	finish := make(chan struct{})
+	go func() {
+		p.wait.Wait()
+		close(finish)
+	}()
+
+	select {
+	case <-finish:
+		return nil
+	case <-ctx.Done():
+	}
+	p.lock.Lock()
+	p.closing = true
+	p.lock.Unlock()
+	for _, s := range p.Sessions() {
+		s.Close()
+	}
+	p.active.Wait()
+	return ctx.Err()
+}
+
+// 立即关闭全部监听和会话
+func (p *Proxy) Close() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p.Shutdown(ctx)
+	return nil
+}
+
+func (p *Proxy) reject(info *ConnInfo, err error) {
+	if info.Reason == "" {
+		info.Reason = err.Error()
+	}
+	if p.hooks.OnError != nil {
+		p.hooks.OnError(info, err)
+	}
+	info.Conn.Close()
+}
+
+// 单个连接的处理，依次为接入检查、中间件、选择后端、握手和双向转发
+func (p *Proxy) handle(r *route, conn net.Conn) {
+	info := &ConnInfo{Listener: r.address, Cluster: r.cluster, Client: ClientIP(conn.RemoteAddr()), Conn: conn}
+	client, release, err := r.gate.Admit(conn)
+	if err != nil {
+		p.reject(info, err)
+		return
+	}
+	defer release()
+
+	if p.hooks.OnAccept != nil {
+		if err := p.hooks.OnAccept(conn); err != nil {
+			p.reject(info, err)
+			return
+		}
+	}
+
+	if err := r.chain.Accept(info); err != nil {
+		p.reject(info, err)
+		return
+	}
+	defer r.chain.Close(info)
+	conn = info.Conn
+
+	cluster, ok := p.clusters[info.Cluster]
+	if !ok {
+		p.reject(info, fmt.Errorf("cluster %s not found", info.Cluster))
+		return
+	}
+	// 监听的单个后端连接数限制与集群的限制同时生效
+	backends := r.gate.Limiter.Backends
+	backend, ep, err := cluster.connect(client, r.chain.Select(info, cluster), r.chain.Dialed(info), backends)
+	info.Endpoint = ep
+	if err != nil {
+		if err == ErrBackendLimit {
+			r.gate.Limiter.Reject()
+		}
+		p.reject(info, err)
+		return
+	}
+	defer cluster.release(ep.Address, backends)
+
+	if r.tls != nil {
+		conn = tls.Server(conn, r.tls)
+	}
+
+	session := NewSession(r.address, conn, backend)
+	session.Cluster = cluster.Name
+	session.Tags = info.Tags
+	session.total = p.total
+	info.Stats = session.Stats
+	p.lock.Lock()
+	p.seq++
+	session.ID = p.seq
+	p.sessions[session.ID] = session
+	closing := p.closing
+	if !closing {
+		p.active.Add(1)
+		defer p.active.Done()
+	}
+	p.lock.Unlock()
+
+	// 接入、中间件或者连接后端期间代理开始关闭，不在关闭时的会话列表中
+	if closing {
+		session.Close()
+	}
+	for _, fn := range r.taps {
+		session.AddTap(fn(session))
+	}
+
+	flow := r.throttle.Session(client)
+	stop := session.Watch(r.idle, r.max)
+
+	if session.Handshake(r.handshake) == nil {
+		if p.hooks.OnConnect != nil {
+			p.hooks.OnConnect(session)
+		}
+		r.pipe(session, r.chain.WrapClient(info, conn), r.chain.WrapBackend(info, backend), flow)
+	}
+	stop()
+	flow.Close()
+	conn.Close()
+	backend.Close()
+	session.closeTaps()
+	info.Reason = session.Reason()
+
+	p.lock.Lock()
+	delete(p.sessions, session.ID)
+	p.lock.Unlock()
+
+	banRecord(r.gate.Ban, client, session)
+	if p.hooks.OnClose != nil {
+		p.hooks.OnClose(session)
+	}
+}
+
+// 会话结束后统计客户端tls握手失败和立即断开的次数
+func banRecord(detector *ban.Detector, client string, session *Session) {
+	if detector == nil {
+		return
+	}
+	reason := session.Reason()
+	if reason == REASON_HANDSHAKE_ERROR || reason == REASON_HANDSHAKE_TIMEOUT {
+		tlsconn, ok := session.ClientConn().(*tls.Conn)
+		if ok && !tlsconn.ConnectionState().HandshakeComplete {
+			detector.HandshakeFail(client)
+			return
+		}
+	}
+	up, _ := session.Flows()
+	detector.Closed(client, session.Age(), up, session.ClientClosed())
+}
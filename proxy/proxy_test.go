@@ -0,0 +1,801 @@
+package proxy_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"github.com/lixiangyun/tcpproxy/ban"
+	"github.com/lixiangyun/tcpproxy/discovery"
+	"github.com/lixiangyun/tcpproxy/limit"
+	"github.com/lixiangyun/tcpproxy/proxy"
+	"github.com/lixiangyun/tcpproxy/proxy/proxytest"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newServer(t *testing.T, count int, opts ...proxy.Option) *proxytest.Server {
+	server, err := proxytest.NewServer(count, proxy.NewBalancer(proxy.LB_ROUNDROBIN), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func roundtrip(t *testing.T, address string, body string) {
+	reply, err := proxytest.Roundtrip(address, []byte(body))
+	if err != nil {
+		t.Fatalf("roundtrip %q failed, %s", body, err.Error())
+	}
+	if string(reply) != body {
+		t.Fatalf("roundtrip %q reply %q", body, reply)
+	}
+}
+
+// 与代理建立一个会话并等待会话出现在会话列表中
+func openSession(t *testing.T, server *proxytest.Server) net.Conn {
+	conn, err := server.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundtripConn(t, conn, "ping")
+	return conn
+}
+
+func roundtripConn(t *testing.T, conn net.Conn, body string) {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte(body)); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, len(body))
+	if _, err := conn.Read(reply); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Time{})
+}
+
+// 等待fn返回，超时失败
+func within(t *testing.T, timeout time.Duration, name string, fn func()) {
+	done := make(chan struct{})
+	go func() {
+		fn()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		t.Fatalf("%s not finished in %s", name, timeout)
+	}
+}
+
+func TestRoundRobinAndUpdateEndpoints(t *testing.T) {
+	var lock sync.Mutex
+	var closed int
+	hooks := proxy.Hooks{
+		OnClose: func(s *proxy.Session) {
+			lock.Lock()
+			closed++
+			lock.Unlock()
+		},
+	}
+	server := newServer(t, 3, proxy.WithHooks(hooks))
+	defer server.Close()
+
+	for i := 0; i < 6; i++ {
+		roundtrip(t, server.Addr, fmt.Sprintf("request %d", i))
+	}
+	for i, b := range server.Backends {
+		if b.Accepted() != 2 {
+			t.Fatalf("backend %d accepted %d, want 2", i, b.Accepted())
+		}
+	}
+
+	// 只保留第一个后端
+	err := server.UpdateEndpoints(proxytest.CLUSTER, proxy.Endpoints(server.Backends[0].Address))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		roundtrip(t, server.Addr, "again")
+	}
+	if cnt := server.Backends[0].Accepted(); cnt != 5 {
+		t.Fatalf("backend 0 accepted %d, want 5", cnt)
+	}
+	if err := server.UpdateEndpoints("unknown", nil); err == nil {
+		t.Fatal("update unknown cluster must fail")
+	}
+
+	server.Close()
+	lock.Lock()
+	defer lock.Unlock()
+	if closed != 9 {
+		t.Fatalf("closed sessions %d, want 9", closed)
+	}
+}
+
+func TestStart(t *testing.T) {
+	server := newServer(t, 1)
+	defer server.Close()
+	if err := server.Start(context.Background()); err != proxy.ErrStarted {
+		t.Fatalf("start twice got %v", err)
+	}
+
+	p := proxy.New(proxy.WithListener("127.0.0.1:0", "missing"))
+	if err := p.Start(context.Background()); err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Fatalf("start with unknown cluster got %v", err)
+	}
+
+	// 后一个监听失败时关闭已启动的监听
+	cluster := proxy.NewCluster("c", nil)
+	p = proxy.New(proxy.WithCluster(cluster),
+		proxy.WithListener("127.0.0.1:0", "c"),
+		proxy.WithListener(server.Addr, "c"))
+	if err := p.Start(context.Background()); err == nil {
+		t.Fatal("start on a used address must fail")
+	}
+	if addrs := p.Addrs(); len(addrs) != 0 {
+		t.Fatalf("listeners %v left open", addrs)
+	}
+}
+
+func TestStartContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	server := newServer(t, 1)
+	defer server.Close()
+
+	p := proxy.New(proxy.WithCluster(server.Cluster(proxytest.CLUSTER)),
+		proxy.WithListener("127.0.0.1:0", proxytest.CLUSTER))
+	if err := p.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	address := p.Addrs()[0].String()
+	roundtrip(t, address, "hello")
+
+	cancel()
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := net.Dial("tcp", address); err != nil {
+			break
+		}
+		if time.Since(start) > 2*time.Second {
+			t.Fatal("listener still open after context canceled")
+		}
+	}
+}
+
+func TestShutdownWaitsForSessions(t *testing.T) {
+	server := newServer(t, 1)
+	defer server.Close()
+
+	conn := openSession(t, server)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		conn.Close()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown got %v", err)
+	}
+	if _, err := server.Dial(); err == nil {
+		t.Fatal("listener still open after shutdown")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	var lock sync.Mutex
+	var reason string
+	hooks := proxy.Hooks{
+		OnClose: func(s *proxy.Session) {
+			lock.Lock()
+			reason = s.Reason()
+			lock.Unlock()
+		},
+	}
+	server := newServer(t, 1, proxy.WithHooks(hooks))
+	defer server.Close()
+
+	conn := openSession(t, server)
+	defer conn.Close()
+	if cnt := len(server.Sessions()); cnt != 1 {
+		t.Fatalf("sessions %d, want 1", cnt)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	within(t, 5*time.Second, "shutdown", func() {
+		if err := server.Shutdown(ctx); err != context.DeadlineExceeded {
+			t.Errorf("shutdown got %v", err)
+		}
+	})
+	lock.Lock()
+	defer lock.Unlock()
+	if reason != proxy.REASON_TERMINATE {
+		t.Fatalf("session reason %s, want %s", reason, proxy.REASON_TERMINATE)
+	}
+}
+
+// Accept阻塞到release关闭的中间件，模拟关闭时仍在接入阶段的连接
+type blockMiddleware struct {
+	proxy.Base
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (m *blockMiddleware) Accept(info *proxy.ConnInfo) error {
+	close(m.entered)
+	<-m.release
+	return nil
+}
+
+func TestCloseSessionAfterSnapshot(t *testing.T) {
+	block := &blockMiddleware{entered: make(chan struct{}), release: make(chan struct{})}
+	server := newServer(t, 1, proxy.WithMiddleware(block))
+	defer server.Close()
+
+	conn, err := server.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	<-block.entered
+
+	// 关闭时连接还没有会话，会话在中间件返回后建立，客户端保持空闲
+	done := make(chan struct{})
+	go func() {
+		server.Proxy.Close()
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	close(block.release)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("close blocked by a session created after the snapshot")
+	}
+}
+
+// 强制关闭不等待仍在中间件中阻塞的连接，超过ctx后立即返回
+func TestShutdownStuckAccept(t *testing.T) {
+	block := &blockMiddleware{entered: make(chan struct{}), release: make(chan struct{})}
+	server := newServer(t, 1, proxy.WithMiddleware(block))
+	defer server.Close()
+	defer close(block.release)
+
+	conn, err := server.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	<-block.entered
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	within(t, time.Second, "shutdown", func() {
+		if err := server.Shutdown(ctx); err != context.DeadlineExceeded {
+			t.Errorf("shutdown got %v", err)
+		}
+	})
+}
+
+// 记录钩子和中间件的调用顺序
+type recorder struct {
+	lock   sync.Mutex
+	events []string
+}
+
+func (r *recorder) add(event string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.events = append(r.events, event)
+}
+
+func (r *recorder) String() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return strings.Join(r.events, " ")
+}
+
+type recordMiddleware struct {
+	*recorder
+}
+
+func (m recordMiddleware) Accept(info *proxy.ConnInfo) error {
+	m.add("mw.accept")
+	info.Tag("by", "recorder")
+	return nil
+}
+
+func (m recordMiddleware) Select(info *proxy.ConnInfo, list []discovery.Endpoint) []discovery.Endpoint {
+	m.add("mw.select")
+	return nil
+}
+
+func (m recordMiddleware) Dial(info *proxy.ConnInfo, ep discovery.Endpoint, err error) {
+	m.add("mw.dial")
+}
+
+func (m recordMiddleware) WrapClient(info *proxy.ConnInfo, conn net.Conn) net.Conn {
+	m.add("mw.client")
+	return conn
+}
+
+func (m recordMiddleware) WrapBackend(info *proxy.ConnInfo, conn net.Conn) net.Conn {
+	m.add("mw.backend")
+	return conn
+}
+
+func (m recordMiddleware) Close(info *proxy.ConnInfo) {
+	m.add("mw.close:" + info.Reason)
+}
+
+func recordHooks(r *recorder, reject error) proxy.Hooks {
+	return proxy.Hooks{
+		OnAccept: func(conn net.Conn) error {
+			r.add("accept")
+			return reject
+		},
+		OnError: func(info *proxy.ConnInfo, err error) {
+			r.add("error:" + err.Error())
+		},
+		OnConnect: func(s *proxy.Session) {
+			r.add("connect")
+		},
+		OnClose: func(s *proxy.Session) {
+			r.add("close:" + s.Reason() + ":" + s.Tags["by"])
+		},
+	}
+}
+
+func TestHookOrder(t *testing.T) {
+	r := new(recorder)
+	server := newServer(t, 1, proxy.WithHooks(recordHooks(r, nil)), proxy.WithMiddleware(recordMiddleware{r}))
+	roundtrip(t, server.Addr, "hello")
+	server.Close()
+
+	want := "accept mw.accept mw.select mw.dial connect mw.client mw.backend " +
+		"close:client_close:recorder mw.close:client_close"
+	if got := r.String(); got != want {
+		t.Fatalf("events\n got: %s\nwant: %s", got, want)
+	}
+}
+
+func TestHookReject(t *testing.T) {
+	r := new(recorder)
+	server := newServer(t, 1, proxy.WithHooks(recordHooks(r, errors.New("denied"))),
+		proxy.WithMiddleware(recordMiddleware{r}))
+	defer server.Close()
+
+	// 被拒绝的连接直接关闭，读到空应答或者连接错误
+	proxytest.Roundtrip(server.Addr, []byte("hello"))
+	server.Close()
+
+	if got := r.String(); got != "accept error:denied" {
+		t.Fatalf("events %s", got)
+	}
+	if cnt := server.Backends[0].Accepted(); cnt != 0 {
+		t.Fatalf("backend accepted %d rejected connections", cnt)
+	}
+}
+
+// 客户端关闭写方向后，后端读到结束才开始应答，客户端仍能读到完整应答
+func TestHalfClose(t *testing.T) {
+	response := []byte(strings.Repeat("0123456789abcdef", 64*1024))
+	backend, err := proxytest.NewBackend(func(conn net.Conn) {
+		io.Copy(ioutil.Discard, conn)
+		conn.Write(response)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	cluster := proxy.NewCluster("half", nil, proxy.ClusterEndpoints(proxy.Endpoints(backend.Address)))
+	p := proxy.New(proxy.WithCluster(cluster), proxy.WithListener("127.0.0.1:0", "half"))
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	reply, err := proxytest.Roundtrip(p.Addrs()[0].String(), []byte("request"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reply, response) {
+		t.Fatalf("reply %d bytes, want %d", len(reply), len(response))
+	}
+}
+
+// 隐藏CloseWrite的连接包装
+type plainConn struct {
+	net.Conn
+}
+
+type plainMiddleware struct {
+	proxy.Base
+}
+
+func (plainMiddleware) WrapClient(info *proxy.ConnInfo, conn net.Conn) net.Conn {
+	return plainConn{conn}
+}
+
+// 中间件包装后的连接不支持半关闭时，后端结束后完整关闭客户端连接
+func TestHalfCloseFallback(t *testing.T) {
+	backend, err := proxytest.NewBackend(func(conn net.Conn) {
+		conn.Write([]byte("bye"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	closed := make(chan string, 1)
+	cluster := proxy.NewCluster("plain", nil, proxy.ClusterEndpoints(proxy.Endpoints(backend.Address)))
+	p := proxy.New(proxy.WithCluster(cluster), proxy.WithListener("127.0.0.1:0", "plain"),
+		proxy.WithMiddleware(plainMiddleware{}),
+		proxy.WithHooks(proxy.Hooks{OnClose: func(s *proxy.Session) { closed <- s.Reason() }}))
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	conn, err := net.Dial("tcp", p.Addrs()[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// 客户端不关闭写方向，只有代理完整关闭连接时才能读到结束
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reply, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("read until close got %v", err)
+	}
+	if string(reply) != "bye" {
+		t.Fatalf("reply %q", reply)
+	}
+	select {
+	case reason := <-closed:
+		if reason != proxy.REASON_BACKEND_CLOSE {
+			t.Fatalf("session reason %s, want %s", reason, proxy.REASON_BACKEND_CLOSE)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("session not closed")
+	}
+}
+
+// 等待OnClose回调返回的结束原因
+func closeReason(t *testing.T, closed chan string) string {
+	select {
+	case reason := <-closed:
+		return reason
+	case <-time.After(5 * time.Second):
+		t.Fatal("session not closed")
+	}
+	return ""
+}
+
+func closeHooks(closed chan string) proxy.Option {
+	return proxy.WithHooks(proxy.Hooks{OnClose: func(s *proxy.Session) { closed <- s.Reason() }})
+}
+
+func TestIdleTimeout(t *testing.T) {
+	closed := make(chan string, 1)
+	// 零拷贝转发最晚在spliceInterval之后才刷新活跃时间，空闲超时需要大于该间隔
+	server := newServer(t, 1, closeHooks(closed), proxy.WithIdleTimeout(1500*time.Millisecond))
+	defer server.Close()
+
+	conn := openSession(t, server)
+	defer conn.Close()
+	for i := 0; i < 8; i++ {
+		time.Sleep(300 * time.Millisecond)
+		roundtripConn(t, conn, "keep")
+	}
+	select {
+	case reason := <-closed:
+		t.Fatalf("active session closed by %s", reason)
+	default:
+	}
+	if reason := closeReason(t, closed); reason != proxy.REASON_IDLE_TIMEOUT {
+		t.Fatalf("reason %s, want %s", reason, proxy.REASON_IDLE_TIMEOUT)
+	}
+}
+
+func TestMaxDuration(t *testing.T) {
+	closed := make(chan string, 1)
+	server := newServer(t, 1, closeHooks(closed), proxy.WithMaxDuration(300*time.Millisecond))
+	defer server.Close()
+
+	conn := openSession(t, server)
+	defer conn.Close()
+	start := time.Now()
+	if reason := closeReason(t, closed); reason != proxy.REASON_MAX_DURATION {
+		t.Fatalf("reason %s, want %s", reason, proxy.REASON_MAX_DURATION)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("max duration fired after %s", elapsed)
+	}
+}
+
+// 本地自签名证书
+func selfSigned(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	closed := make(chan string, 1)
+	server := newServer(t, 1)
+	defer server.Close()
+
+	p := proxy.New(proxy.WithCluster(server.Cluster(proxytest.CLUSTER)),
+		proxy.WithListener("127.0.0.1:0", proxytest.CLUSTER, proxy.ListenTLS(selfSigned(t))),
+		proxy.WithHandshakeTimeout(200*time.Millisecond), closeHooks(closed))
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	address := p.Addrs()[0].String()
+
+	// 只建立tcp连接不发送ClientHello
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if reason := closeReason(t, closed); reason != proxy.REASON_HANDSHAKE_TIMEOUT {
+		t.Fatalf("reason %s, want %s", reason, proxy.REASON_HANDSHAKE_TIMEOUT)
+	}
+
+	// 握手失败
+	conn, err = net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("not a client hello\r\n\r\n"))
+	if reason := closeReason(t, closed); reason != proxy.REASON_HANDSHAKE_ERROR {
+		t.Fatalf("reason %s, want %s", reason, proxy.REASON_HANDSHAKE_ERROR)
+	}
+
+	// 正常握手后转发
+	tlsconn, err := tls.Dial("tcp", address, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tlsconn.Close()
+	roundtripConn(t, tlsconn, "secure")
+}
+
+// 监听的单个后端连接数限制，超出时拒绝并计数
+func TestListenerBackendLimit(t *testing.T) {
+	server := newServer(t, 1)
+	defer server.Close()
+
+	errs := make(chan error, 1)
+	limiter := limit.New(&limit.Config{MaxPerBackend: 1})
+	p := proxy.New(proxy.WithCluster(server.Cluster(proxytest.CLUSTER)),
+		proxy.WithListener("127.0.0.1:0", proxytest.CLUSTER, proxy.ListenLimit(limiter)),
+		proxy.WithHooks(proxy.Hooks{OnError: func(info *proxy.ConnInfo, err error) { errs <- err }}))
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	address := p.Addrs()[0].String()
+
+	first, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundtripConn(t, first, "first")
+
+	if reply, _ := proxytest.Roundtrip(address, []byte("second")); len(reply) != 0 {
+		t.Fatalf("second connection over backend limit got %q", reply)
+	}
+	select {
+	case err := <-errs:
+		if err != proxy.ErrBackendLimit {
+			t.Fatalf("reject error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("second connection not rejected")
+	}
+	if limiter.Rejected() != 1 {
+		t.Fatalf("rejected %d, want 1", limiter.Rejected())
+	}
+
+	// 会话结束后释放
+	first.Close()
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if reply, _ := proxytest.Roundtrip(address, []byte("third")); string(reply) == "third" {
+			break
+		}
+		if time.Since(start) > 2*time.Second {
+			t.Fatal("backend limit not released")
+		}
+		<-errs
+	}
+	// 集群本身没有限制，其它监听不受影响
+	if server.Cluster(proxytest.CLUSTER).Backends != nil {
+		t.Fatal("listener limit must not change the cluster")
+	}
+	roundtrip(t, server.Addr, "other listener")
+}
+
+// 会话结束后记录客户端握手失败和立即断开，超过阈值时封禁
+func TestBanRecord(t *testing.T) {
+	server := newServer(t, 1)
+	defer server.Close()
+
+	table, err := ban.NewTable("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newProxy := func(cfg ban.Config, opts ...proxy.ListenerOption) (*proxy.Proxy, *ban.Detector, chan string) {
+		closed := make(chan string, 4)
+		detector := ban.NewDetector(&cfg, "test", table)
+		opts = append(opts, proxy.ListenBan(detector))
+		p := proxy.New(proxy.WithCluster(server.Cluster(proxytest.CLUSTER)),
+			proxy.WithListener("127.0.0.1:0", proxytest.CLUSTER, opts...), closeHooks(closed))
+		if err := p.Start(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		return p, detector, closed
+	}
+
+	// 握手失败
+	p, detector, closed := newProxy(ban.Config{MaxHandshakeFails: 1}, proxy.ListenTLS(selfSigned(t)))
+	defer p.Close()
+	address := p.Addrs()[0].String()
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte("not a client hello\r\n\r\n"))
+		closeReason(t, closed)
+		conn.Close()
+	}
+	if ok, item := detector.Banned("127.0.0.1"); !ok || item.Reason != ban.REASON_HANDSHAKE_FAILS {
+		t.Fatalf("handshake failures not banned, %v", item)
+	}
+	table.Clear("")
+
+	// 客户端未发送数据立即断开，发送过数据的会话不计数
+	p, detector, closed = newProxy(ban.Config{MaxQuickCloses: 1, QuickClose: time.Minute})
+	defer p.Close()
+	address = p.Addrs()[0].String()
+	roundtrip(t, address, "data")
+	closeReason(t, closed)
+	for i := 0; i < 2; i++ {
+		if ok, _ := detector.Banned("127.0.0.1"); ok {
+			t.Fatalf("banned after %d quick closes", i)
+		}
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		if reason := closeReason(t, closed); reason != proxy.REASON_CLIENT_CLOSE {
+			t.Fatalf("reason %s, want %s", reason, proxy.REASON_CLIENT_CLOSE)
+		}
+	}
+	if ok, item := detector.Banned("127.0.0.1"); !ok || item.Reason != ban.REASON_QUICK_CLOSES {
+		t.Fatalf("quick closes not banned, %v", item)
+	}
+}
+
+// 记录旁路数据的Tap
+type bufferTap struct {
+	lock   sync.Mutex
+	up     bytes.Buffer
+	down   bytes.Buffer
+	closed bool
+}
+
+func (b *bufferTap) Data(up bool, body []byte) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if up {
+		b.up.Write(body)
+	} else {
+		b.down.Write(body)
+	}
+}
+
+func (b *bufferTap) Close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.closed = true
+}
+
+// 监听的旁路、转发替换和全局流量汇总
+func TestListenTapPipe(t *testing.T) {
+	closed := make(chan string, 1)
+	server := newServer(t, 1)
+	defer server.Close()
+
+	tap := new(bufferTap)
+	var piped int32
+	total := proxy.NewStats()
+	p := proxy.New(proxy.WithCluster(server.Cluster(proxytest.CLUSTER)),
+		proxy.WithListener("127.0.0.1:0", proxytest.CLUSTER,
+			proxy.ListenTap(func(s *proxy.Session) proxy.Tap { return tap }),
+			proxy.ListenTap(func(s *proxy.Session) proxy.Tap { return nil }),
+			proxy.ListenPipe(func(s *proxy.Session, client net.Conn, backend net.Conn, flow *limit.Flow) {
+				atomic.AddInt32(&piped, 1)
+				proxy.SessionPipe(s, client, backend, flow)
+			})),
+		proxy.WithStats(total), closeHooks(closed))
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	roundtrip(t, p.Addrs()[0].String(), "tapped")
+	closeReason(t, closed)
+
+	tap.lock.Lock()
+	defer tap.lock.Unlock()
+	if tap.up.String() != "tapped" || tap.down.String() != "tapped" || !tap.closed {
+		t.Fatalf("tap up %q down %q closed %v", tap.up.String(), tap.down.String(), tap.closed)
+	}
+	if atomic.LoadInt32(&piped) != 1 {
+		t.Fatalf("pipe called %d times", piped)
+	}
+	if up, down := total.Flows(); up != 6 || down != 6 {
+		t.Fatalf("total up %d down %d", up, down)
+	}
+}
+
+// 监听的空闲超时覆盖代理的设置
+func TestListenIdleTimeout(t *testing.T) {
+	closed := make(chan string, 1)
+	server := newServer(t, 1)
+	defer server.Close()
+
+	p := proxy.New(proxy.WithCluster(server.Cluster(proxytest.CLUSTER)),
+		proxy.WithListener("127.0.0.1:0", proxytest.CLUSTER, proxy.ListenIdleTimeout(200*time.Millisecond)),
+		proxy.WithIdleTimeout(time.Hour), closeHooks(closed))
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	conn, err := net.Dial("tcp", p.Addrs()[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if reason := closeReason(t, closed); reason != proxy.REASON_IDLE_TIMEOUT {
+		t.Fatalf("reason %s, want %s", reason, proxy.REASON_IDLE_TIMEOUT)
+	}
+}
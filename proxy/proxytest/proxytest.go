@@ -0,0 +1,145 @@
+// Package proxytest 提供进程内的代理测试工具，包括回显后端、
+// 监听在本地随机端口的代理以及简单的请求应答函数，用法类似net/http/httptest。
+package proxytest
+
+import (
+	"context"
+	"fmt"
+	"github.com/lixiangyun/tcpproxy/proxy"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 测试集群名
+const CLUSTER = "test"
+
+// 监听在本地随机端口的后端
+type Backend struct {
+	Address string
+
+	list     net.Listener
+	accepted int64
+	wait     sync.WaitGroup
+}
+
+// 启动后端，每个连接在独立的协程中由handle处理，handle返回后关闭连接
+func NewBackend(handle func(conn net.Conn)) (*Backend, error) {
+	list, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	b := &Backend{Address: list.Addr().String(), list: list}
+	b.wait.Add(1)
+	go func() {
+		defer b.wait.Done()
+		for {
+			conn, err := list.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt64(&b.accepted, 1)
+			b.wait.Add(1)
+			go func() {
+				defer b.wait.Done()
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return b, nil
+}
+
+// 原样返回收到的数据，客户端关闭写方向后关闭连接
+func NewEchoBackend() (*Backend, error) {
+	return NewBackend(func(conn net.Conn) {
+		io.Copy(conn, conn)
+	})
+}
+
+// 已接收的连接数
+func (b *Backend) Accepted() int64 {
+	return atomic.LoadInt64(&b.accepted)
+}
+
+// 停止接收新连接，已建立的连接由handle自行结束
+func (b *Backend) Close() {
+	b.list.Close()
+}
+
+// 进程内代理，一个监听转发到由全部后端组成的集群
+type Server struct {
+	*proxy.Proxy
+
+	Addr     string
+	Backends []*Backend
+}
+
+// 启动count个回显后端和一个监听本地随机端口的代理，opts追加在默认配置之后，
+// 可以用于设置钩子、超时等
+func NewServer(count int, balancer proxy.Balancer, opts ...proxy.Option) (*Server, error) {
+	s := new(Server)
+	var address []string
+	for i := 0; i < count; i++ {
+		backend, err := NewEchoBackend()
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.Backends = append(s.Backends, backend)
+		address = append(address, backend.Address)
+	}
+
+	cluster := proxy.NewCluster(CLUSTER, balancer, proxy.ClusterEndpoints(proxy.Endpoints(address...)))
+	options := []proxy.Option{
+		proxy.WithCluster(cluster),
+		proxy.WithListener("127.0.0.1:0", CLUSTER),
+	}
+	s.Proxy = proxy.New(append(options, opts...)...)
+
+	err := s.Start(context.Background())
+	if err != nil {
+		s.Proxy = nil
+		s.Close()
+		return nil, err
+	}
+	s.Addr = s.Addrs()[0].String()
+	return s, nil
+}
+
+// 关闭代理和全部后端
+func (s *Server) Close() {
+	if s.Proxy != nil {
+		s.Proxy.Close()
+	}
+	for _, b := range s.Backends {
+		b.Close()
+	}
+}
+
+// 连接代理
+func (s *Server) Dial() (net.Conn, error) {
+	return net.DialTimeout("tcp", s.Addr, 5*time.Second)
+}
+
+// 连接address发送body，关闭写方向后读取全部应答，超时时间为5秒
+func Roundtrip(address string, body []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", address, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write(body)
+	if err != nil {
+		return nil, err
+	}
+	if !proxy.CloseWrite(conn) {
+		return nil, fmt.Errorf("close write %s failed", address)
+	}
+	return ioutil.ReadAll(conn)
+}
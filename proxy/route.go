@@ -0,0 +1,242 @@
+package proxy
+
+import (
+	"fmt"
+	"gopkg.in/Knetic/govaluate.v3"
+	"net"
+	"strings"
+	"time"
+)
+
+// 路由表达式结果中的指令，多个指令以空格分隔
+const (
+	ROUTE_REJECT  = "reject"
+	ROUTE_CLUSTER = "cluster:"
+	ROUTE_TAG     = "tag:"
+
+	// 表达式使用sni时预读ClientHello的默认超时时间
+	ROUTE_PEEK_TIMEOUT = 3 * time.Second
+)
+
+// 路由表达式可以使用的变量
+var RouteVars = []string{"client", "client_port", "port", "sni", "hour", "minute", "weekday", "cluster", "healthy"}
+
+// 按表达式路由，每个连接接入时求值一次。表达式的结果为false时拒绝连接，为nil、true或空字符串时不做处理，
+// 为字符串时依次执行其中的指令：reject拒绝连接，cluster:NAME转发到指定集群，tag:KEY=VALUE为会话打标签。
+// 例如：
+//
+//	sni == 'api.example.com' ? 'cluster:api tag:route=api' : (hour < 6 ? 'reject' : '')
+//
+// 只有表达式使用sni时才预读客户端的ClientHello。服务端先发送数据的协议（例如smtp、mysql、ssh）
+// 客户端在收到应答前不会发送数据，预读会等待到Timeout后才连接后端，这类监听不要使用sni。
+type Router struct {
+	Base
+
+	Expression string
+	// 预读ClientHello的超时时间，为0时使用ROUTE_PEEK_TIMEOUT
+	Timeout time.Duration
+
+	health func(cluster string) int
+	expr   *govaluate.EvaluableExpression
+	sni    bool
+}
+
+// 编译路由表达式，health返回集群的可用成员数，用于healthy变量和health函数
+func NewRouter(expression string, health func(cluster string) int) (*Router, error) {
+	r := &Router{Expression: expression, health: health}
+	functions := map[string]govaluate.ExpressionFunction{
+		"cidr":   routeCIDR,
+		"health": r.healthFunc,
+	}
+
+	expr, err := govaluate.NewEvaluableExpressionWithFunctions(expression, functions)
+	if err != nil {
+		return nil, err
+	}
+	r.expr = expr
+	for _, name := range expr.Vars() {
+		if !routeVar(name) {
+			return nil, fmt.Errorf("unknown variable %s, support %s", name, strings.Join(RouteVars, ", "))
+		}
+		if name == "sni" {
+			r.sni = true
+		}
+	}
+	for _, cmd := range r.literals() {
+		if _, _, err := routeCommand(cmd); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func routeVar(name string) bool {
+	for _, v := range RouteVars {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+// cidr(ip, '10.0.0.0/8', ...)，ip属于任意网段时为true
+func routeCIDR(args ...interface{}) (interface{}, error) {
+	if len(args) < 2 {
+		return nil, fmt.Errorf("cidr need an ip and at least one network")
+	}
+	text, ok := args[0].(string)
+	ip := net.ParseIP(text)
+	if !ok || ip == nil {
+		return nil, fmt.Errorf("cidr invalid ip %v", args[0])
+	}
+	for _, v := range args[1:] {
+		network, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("cidr invalid network %v", v)
+		}
+		_, ipnet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, err
+		}
+		if ipnet.Contains(ip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// health('name')，集群的可用成员数
+func (r *Router) healthFunc(args ...interface{}) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("health need a cluster name")
+	}
+	name, ok := args[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("health invalid cluster %v", args[0])
+	}
+	return r.healthy(name), nil
+}
+
+func (r *Router) healthy(cluster string) float64 {
+	if r.health == nil {
+		return 0
+	}
+	return float64(r.health(cluster))
+}
+
+// 表达式中的字符串常量里的指令
+func (r *Router) literals() []string {
+	var output []string
+	for _, token := range r.expr.Tokens() {
+		text, ok := token.Value.(string)
+		if token.Kind != govaluate.STRING || !ok {
+			continue
+		}
+		for _, cmd := range strings.Fields(text) {
+			if cmd == ROUTE_REJECT || strings.HasPrefix(cmd, ROUTE_CLUSTER) || strings.HasPrefix(cmd, ROUTE_TAG) {
+				output = append(output, cmd)
+			}
+		}
+	}
+	return output
+}
+
+// 表达式中可能转发到的集群，用于配置检查
+func (r *Router) Clusters() []string {
+	var output []string
+	for _, cmd := range r.literals() {
+		if strings.HasPrefix(cmd, ROUTE_CLUSTER) {
+			output = append(output, strings.TrimPrefix(cmd, ROUTE_CLUSTER))
+		}
+	}
+	return output
+}
+
+// 解析单个指令，返回指令类型和参数
+func routeCommand(cmd string) (string, []string, error) {
+	switch {
+	case cmd == ROUTE_REJECT:
+		return ROUTE_REJECT, nil, nil
+	case strings.HasPrefix(cmd, ROUTE_CLUSTER):
+		name := strings.TrimPrefix(cmd, ROUTE_CLUSTER)
+		if name == "" {
+			return "", nil, fmt.Errorf("route %s missing cluster name", cmd)
+		}
+		return ROUTE_CLUSTER, []string{name}, nil
+	case strings.HasPrefix(cmd, ROUTE_TAG):
+		pair := strings.SplitN(strings.TrimPrefix(cmd, ROUTE_TAG), "=", 2)
+		if len(pair) != 2 || pair[0] == "" {
+			return "", nil, fmt.Errorf("route %s must be tag:KEY=VALUE", cmd)
+		}
+		return ROUTE_TAG, pair, nil
+	}
+	return "", nil, fmt.Errorf("route %s unknown, support %s, %sNAME, %sKEY=VALUE",
+		cmd, ROUTE_REJECT, ROUTE_CLUSTER, ROUTE_TAG)
+}
+
+func addrPort(addr net.Addr) float64 {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return float64(tcp.Port)
+	}
+	return 0
+}
+
+// 连接对应的表达式变量，sni只在表达式使用时预读，此时会替换info.Conn
+func (r *Router) vars(info *ConnInfo) map[string]interface{} {
+	sni := ""
+	if r.sni {
+		timeout := r.Timeout
+		if timeout <= 0 {
+			timeout = ROUTE_PEEK_TIMEOUT
+		}
+		sni, info.Conn = PeekSNI(info.Conn, timeout)
+	}
+
+	now := time.Now()
+	return map[string]interface{}{
+		"client":      info.Client,
+		"client_port": addrPort(info.Conn.RemoteAddr()),
+		"port":        addrPort(info.Conn.LocalAddr()),
+		"sni":         sni,
+		"hour":        float64(now.Hour()),
+		"minute":      float64(now.Minute()),
+		"weekday":     float64(now.Weekday()),
+		"cluster":     info.Cluster,
+		"healthy":     r.healthy(info.Cluster),
+	}
+}
+
+// 求值并执行结果中的指令，求值失败时拒绝连接
+func (r *Router) Accept(info *ConnInfo) error {
+	result, err := r.expr.Evaluate(r.vars(info))
+	if err != nil {
+		return fmt.Errorf("route evaluate failed, %s", err.Error())
+	}
+
+	switch value := result.(type) {
+	case nil:
+		return nil
+	case bool:
+		if !value {
+			return fmt.Errorf("route rejected")
+		}
+		return nil
+	case string:
+		for _, cmd := range strings.Fields(value) {
+			kind, args, err := routeCommand(cmd)
+			if err != nil {
+				return err
+			}
+			switch kind {
+			case ROUTE_REJECT:
+				return fmt.Errorf("route rejected")
+			case ROUTE_CLUSTER:
+				info.Cluster = args[0]
+			case ROUTE_TAG:
+				info.Tag(args[0], args[1])
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("route result %v not support", result)
+}
@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+)
+
+func newRouter(t *testing.T, expression string, health func(cluster string) int) *Router {
+	r, err := NewRouter(expression, health)
+	if err != nil {
+		t.Fatalf("router %q, %s", expression, err.Error())
+	}
+	return r
+}
+
+// 代理一侧的连接和客户端一侧的对端，对端由调用者关闭
+func routeConn() (net.Conn, net.Conn) {
+	client, server := net.Pipe()
+	return server, client
+}
+
+func TestNewRouter(t *testing.T) {
+	invalid := []string{
+		"",
+		"client ==",
+		"unknown == 1",
+		"'cluster:'",
+		"'tag:key'",
+		"'tag:=value'",
+		"sni == 'a' ? 'cluster: reject' : ''",
+	}
+	for _, expression := range invalid {
+		if _, err := NewRouter(expression, nil); err == nil {
+			t.Errorf("router %q accepted", expression)
+		}
+	}
+
+	r := newRouter(t, "sni == 'a' ? 'cluster:a tag:x=1' : (hour < 6 ? 'cluster:b' : 'reject')", nil)
+	clusters := r.Clusters()
+	if len(clusters) != 2 || clusters[0] != "a" || clusters[1] != "b" {
+		t.Fatalf("clusters %v", clusters)
+	}
+	if !r.sni {
+		t.Fatal("sni not detected")
+	}
+	if newRouter(t, "client == '10.0.0.1'", nil).sni {
+		t.Fatal("sni detected without use")
+	}
+}
+
+func TestRouteCIDR(t *testing.T) {
+	r := newRouter(t, "cidr(client, '10.0.0.0/8', '2001:db8::/32')", nil)
+	cases := map[string]bool{
+		"10.1.2.3":    true,
+		"11.0.0.1":    false,
+		"2001:db8::1": true,
+		"2001:db9::1": false,
+	}
+	for client, allow := range cases {
+		conn, peer := routeConn()
+		err := r.Accept(&ConnInfo{Client: client, Conn: conn})
+		if (err == nil) != allow {
+			t.Errorf("client %s allow %v, got %v", client, allow, err)
+		}
+		peer.Close()
+	}
+
+	// 无效的地址和网段求值失败，连接被拒绝
+	for _, expression := range []string{"cidr(client, 'bad')", "cidr('bad', '10.0.0.0/8')", "cidr(client)"} {
+		conn, peer := routeConn()
+		if err := newRouter(t, expression, nil).Accept(&ConnInfo{Client: "10.0.0.1", Conn: conn}); err == nil {
+			t.Errorf("%s accepted", expression)
+		}
+		peer.Close()
+	}
+}
+
+// 结果为false或reject时拒绝，cluster和tag指令修改连接信息
+func TestRouteResult(t *testing.T) {
+	cases := []struct {
+		expression string
+		reject     bool
+		cluster    string
+		tag        string
+	}{
+		{"false", true, "web", ""},
+		{"true", false, "web", ""},
+		{"''", false, "web", ""},
+		{"'reject'", true, "web", ""},
+		{"'cluster:api tag:route=api'", false, "api", "api"},
+		{"'tag:route=x reject'", true, "web", "x"},
+		{"cluster == 'web' ? 'cluster:other' : ''", false, "other", ""},
+		{"1", true, "web", ""},
+	}
+	for _, c := range cases {
+		conn, peer := routeConn()
+		info := &ConnInfo{Cluster: "web", Client: "10.0.0.1", Conn: conn}
+		err := newRouter(t, c.expression, nil).Accept(info)
+		peer.Close()
+		if (err != nil) != c.reject || info.Cluster != c.cluster || info.Tags["route"] != c.tag {
+			t.Errorf("%s got err %v cluster %s tags %v", c.expression, err, info.Cluster, info.Tags)
+		}
+	}
+}
+
+func TestRouteHealthy(t *testing.T) {
+	members := map[string]int{"web": 2, "api": 0}
+	health := func(cluster string) int {
+		return members[cluster]
+	}
+	r := newRouter(t, "healthy > 0 ? '' : (health('backup') > 0 ? 'cluster:backup' : 'reject')", health)
+
+	cases := map[string]string{"web": "web", "api": "", "backup": ""}
+	members["backup"] = 0
+	for cluster, want := range cases {
+		conn, peer := routeConn()
+		info := &ConnInfo{Cluster: cluster, Client: "10.0.0.1", Conn: conn}
+		err := r.Accept(info)
+		peer.Close()
+		if want == "" && err == nil || want != "" && (err != nil || info.Cluster != want) {
+			t.Errorf("cluster %s got %s, %v", cluster, info.Cluster, err)
+		}
+	}
+
+	members["backup"] = 1
+	conn, peer := routeConn()
+	defer peer.Close()
+	info := &ConnInfo{Cluster: "api", Client: "10.0.0.1", Conn: conn}
+	if err := r.Accept(info); err != nil || info.Cluster != "backup" {
+		t.Fatalf("unhealthy cluster routed to %s, %v", info.Cluster, err)
+	}
+
+	// 未设置health时集群均视为没有成员
+	conn, peer = routeConn()
+	defer peer.Close()
+	if err := newRouter(t, "healthy == 0 && health('web') == 0", nil).Accept(&ConnInfo{Cluster: "web", Conn: conn}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 按ClientHello中的SNI选择集群，预读的数据在转发时重放
+func TestRouteSNI(t *testing.T) {
+	r := newRouter(t, "sni == 'api.example' ? 'cluster:api' : ''", nil)
+	conn, peer := routeConn()
+	defer peer.Close()
+	go tls.Client(peer, &tls.Config{ServerName: "api.example", InsecureSkipVerify: true}).Handshake()
+
+	info := &ConnInfo{Cluster: "web", Client: "10.0.0.1", Conn: conn}
+	if err := r.Accept(info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Cluster != "api" {
+		t.Fatalf("cluster %s, want api", info.Cluster)
+	}
+	if info.Conn == conn {
+		t.Fatal("peeked data not replayed")
+	}
+	head := make([]byte, 1)
+	info.Conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := info.Conn.Read(head); err != nil || head[0] != 0x16 {
+		t.Fatalf("replay got %x, %v", head, err)
+	}
+}
+
+// 表达式不使用sni时不预读，服务端先发送数据的协议不受影响；
+// 使用sni时客户端不发送数据，等待到超时后按空的sni求值
+func TestRoutePeekTimeout(t *testing.T) {
+	conn, peer := routeConn()
+	defer peer.Close()
+	info := &ConnInfo{Cluster: "web", Client: "10.0.0.1", Conn: conn}
+	start := time.Now()
+	if err := newRouter(t, "port >= 0", nil).Accept(info); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > 50*time.Millisecond || info.Conn != conn {
+		t.Fatal("peeked without sni in the expression")
+	}
+
+	r := newRouter(t, "sni == '' ? 'tag:sni=none' : ''", nil)
+	r.Timeout = 200 * time.Millisecond
+	start = time.Now()
+	if err := r.Accept(info); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatalf("peek returned after %s", elapsed)
+	}
+	if info.Tags["sni"] != "none" || info.Conn != conn {
+		t.Fatalf("tags %v", info.Tags)
+	}
+}
@@ -0,0 +1,202 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"github.com/lixiangyun/tcpproxy/limit"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// 会话结束原因
+const (
+	REASON_CLIENT_CLOSE      = "client_close"
+	REASON_BACKEND_CLOSE     = "backend_close"
+	REASON_CLIENT_ERROR      = "client_error"
+	REASON_BACKEND_ERROR     = "backend_error"
+	REASON_TERMINATE         = "terminated"
+	REASON_IDLE_TIMEOUT      = "idle_timeout"
+	REASON_MAX_DURATION      = "max_duration"
+	REASON_HANDSHAKE_TIMEOUT = "handshake_timeout"
+	REASON_HANDSHAKE_ERROR   = "handshake_error"
+)
+
+// 代理会话，记录一条客户端到后端的连接
+type Session struct {
+	ID       uint64
+	Listener string
+	Cluster  string
+	Client   string
+	Backend  string
+	Start    time.Time
+	// 中间件设置的标签
+	Tags map[string]string
+
+	*Stats
+
+	reasonOnce sync.Once
+	reason     string
+
+	client  net.Conn
+	backend net.Conn
+	taps    []Tap
+	// 代理的全局流量汇总，可以为nil
+	total *Stats
+}
+
+// 会话数据旁路，用于抓包、录制等场景，Data在转发协程中调用，两个方向可能并发
+type Tap interface {
+	Data(up bool, body []byte)
+	Close()
+}
+
+func NewSession(listener string, client net.Conn, backend net.Conn) *Session {
+	return &Session{
+		Listener: listener,
+		Client:   client.RemoteAddr().String(),
+		Backend:  backend.RemoteAddr().String(),
+		Start:    time.Now(),
+		Stats:    NewStats(),
+		client:   client,
+		backend:  backend,
+	}
+}
+
+// 添加数据旁路，需要在开始转发前调用，tap为nil时忽略
+func (s *Session) AddTap(tap Tap) {
+	if tap != nil {
+		s.taps = append(s.taps, tap)
+	}
+}
+
+func (s *Session) tapData(up bool, body []byte) {
+	for _, tap := range s.taps {
+		tap.Data(up, body)
+	}
+}
+
+func (s *Session) closeTaps() {
+	for _, tap := range s.taps {
+		tap.Close()
+	}
+}
+
+// 统计会话流量，同时计入全局汇总
+func (s *Session) count(up int, down int) {
+	s.Add(up, down)
+	if s.total != nil {
+		s.total.Add(up, down)
+	}
+}
+
+// 客户端连接，监听配置了tls时为*tls.Conn
+func (s *Session) ClientConn() net.Conn {
+	return s.client
+}
+
+// 后端连接
+func (s *Session) BackendConn() net.Conn {
+	return s.backend
+}
+
+// 记录会话结束原因，只保留第一次设置的值
+func (s *Session) SetReason(reason string) {
+	s.reasonOnce.Do(func() {
+		s.reason = reason
+	})
+}
+
+// 根据读写错误推断结束原因，client表示出错的一端是否为客户端
+func (s *Session) SetError(client bool, err error) {
+	switch {
+	case client && err == io.EOF:
+		s.SetReason(REASON_CLIENT_CLOSE)
+	case client:
+		s.SetReason(REASON_CLIENT_ERROR)
+	case err == io.EOF:
+		s.SetReason(REASON_BACKEND_CLOSE)
+	default:
+		s.SetReason(REASON_BACKEND_ERROR)
+	}
+}
+
+// 会话是否由客户端先断开，包括正常关闭和出错
+func (s *Session) ClientClosed() bool {
+	reason := s.Reason()
+	return reason == REASON_CLIENT_CLOSE || reason == REASON_CLIENT_ERROR
+}
+
+// 获取结束原因，未记录时视为客户端正常关闭
+func (s *Session) Reason() string {
+	s.SetReason(REASON_CLIENT_CLOSE)
+	return s.reason
+}
+
+func (s *Session) Close() {
+	s.Terminate(REASON_TERMINATE)
+}
+
+// 以指定原因关闭会话
+func (s *Session) Terminate(reason string) {
+	s.SetReason(reason)
+	s.client.Close()
+	s.backend.Close()
+}
+
+// 会话超时看护，空闲超过idle或存活超过max时关闭会话，为0表示不限制
+func (s *Session) Watch(idle time.Duration, max time.Duration) (stop func()) {
+	return s.Stats.Watch(idle, max, s.Terminate)
+}
+
+// tls连接在转发前完成握手，超时或失败时记录对应的结束原因
+func (s *Session) Handshake(timeout time.Duration) error {
+	for _, conn := range []net.Conn{s.client, s.backend} {
+		tlsconn, ok := conn.(*tls.Conn)
+		if !ok {
+			continue
+		}
+		if timeout > 0 {
+			tlsconn.SetDeadline(time.Now().Add(timeout))
+		}
+		err := tlsconn.Handshake()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				s.SetReason(REASON_HANDSHAKE_TIMEOUT)
+			} else {
+				s.SetReason(REASON_HANDSHAKE_ERROR)
+			}
+			return err
+		}
+		tlsconn.SetDeadline(time.Time{})
+	}
+	return nil
+}
+
+// 会话的单方向转发，统计流量、旁路数据并根据读写错误记录结束原因，flow为nil不限速
+func (s *Session) Forwarder(up bool, flow *limit.Flow) *Forwarder {
+	forwarder := &Forwarder{
+		Up:   up,
+		Flow: flow,
+		Count: func(cnt int) {
+			if up {
+				s.count(cnt, 0)
+			} else {
+				s.count(0, cnt)
+			}
+		},
+		Done: func(rerr error, werr error) {
+			if werr != nil {
+				s.SetError(!up, werr)
+			} else {
+				s.SetError(up, rerr)
+			}
+		},
+	}
+	if len(s.taps) > 0 {
+		forwarder.Tap = func(body []byte) {
+			s.tapData(up, body)
+		}
+	}
+	return forwarder
+}
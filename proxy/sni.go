@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"net"
+	"time"
+)
+
+var errPeekDone = errors.New("client hello peeked")
+
+// 记录读取的数据，丢弃写入的数据，用于只解析ClientHello而不应答客户端
+type recordConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *recordConn) Read(b []byte) (int, error) {
+	cnt, err := c.Conn.Read(b)
+	c.buf.Write(b[:cnt])
+	return cnt, err
+}
+
+func (c *recordConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+// 先返回预读的数据，再从原连接读取
+type replayConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	if len(c.prefix) == 0 {
+		return c.Conn.Read(b)
+	}
+	cnt := copy(b, c.prefix)
+	c.prefix = c.prefix[cnt:]
+	return cnt, nil
+}
+
+func (c *replayConn) CloseWrite() error {
+	if CloseWrite(c.Conn) {
+		return nil
+	}
+	return errors.New("close write not supported")
+}
+
+// 预读客户端的tls ClientHello获取SNI，客户端不是tls或者在timeout内没有发送数据时SNI为空，
+// 返回的连接会重放预读的数据，后续转发不再使用零拷贝
+func PeekSNI(conn net.Conn, timeout time.Duration) (string, net.Conn) {
+	var name string
+	record := &recordConn{Conn: conn}
+	server := tls.Server(record, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			name = hello.ServerName
+			return nil, errPeekDone
+		},
+	})
+
+	if timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+	}
+	server.Handshake()
+	conn.SetReadDeadline(time.Time{})
+
+	if record.buf.Len() == 0 {
+		return name, conn
+	}
+	return name, &replayConn{Conn: conn, prefix: record.buf.Bytes()}
+}
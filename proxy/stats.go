@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 流量统计和活跃时间，用于会话、监听或者全局汇总
+type Stats struct {
+	up     int64
+	down   int64
+	active int64
+	start  time.Time
+
+	lock      sync.Mutex
+	lastUp    int64
+	lastDown  int64
+	lastTime  time.Time
+	upSpeed   int64
+	downSpeed int64
+}
+
+// 速率的采样间隔，间隔内的多次查询返回同一结果，多个调用者互不影响
+const speedInterval = time.Second
+
+func NewStats() *Stats {
+	now := time.Now()
+	return &Stats{start: now, active: now.UnixNano(), lastTime: now}
+}
+
+// 统计流量并刷新活跃时间
+func (s *Stats) Add(up int, down int) {
+	atomic.AddInt64(&s.up, int64(up))
+	atomic.AddInt64(&s.down, int64(down))
+	atomic.StoreInt64(&s.active, time.Now().UnixNano())
+}
+
+func (s *Stats) Flows() (int64, int64) {
+	return atomic.LoadInt64(&s.up), atomic.LoadInt64(&s.down)
+}
+
+func (s *Stats) Idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&s.active)))
+}
+
+// 从创建开始经过的时间
+func (s *Stats) Age() time.Duration {
+	return time.Since(s.start)
+}
+
+// 速率按最近一个采样间隔的流量差值计算
+func (s *Stats) Speed() (int64, int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	elapsed := now.Sub(s.lastTime)
+	if elapsed < speedInterval {
+		return s.upSpeed, s.downSpeed
+	}
+	up, down := s.Flows()
+	s.upSpeed = int64(float64(up-s.lastUp) / elapsed.Seconds())
+	s.downSpeed = int64(float64(down-s.lastDown) / elapsed.Seconds())
+	s.lastUp, s.lastDown, s.lastTime = up, down, now
+	return s.upSpeed, s.downSpeed
+}
+
+// 超时看护，空闲超过idle或存活超过max时以对应原因调用terminate，为0表示不限制，
+// 返回停止看护的函数
+func (s *Stats) Watch(idle time.Duration, max time.Duration, terminate func(reason string)) (stop func()) {
+	if idle <= 0 && max <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			next := time.Duration(-1)
+			if idle > 0 {
+				remain := idle - s.Idle()
+				if remain <= 0 {
+					terminate(REASON_IDLE_TIMEOUT)
+					return
+				}
+				next = remain
+			}
+			if max > 0 {
+				remain := max - s.Age()
+				if remain <= 0 {
+					terminate(REASON_MAX_DURATION)
+					return
+				}
+				if next < 0 || remain < next {
+					next = remain
+				}
+			}
+
+			timer := time.NewTimer(next)
+			select {
+			case <-done:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func watchReason(s *Stats, idle time.Duration, max time.Duration) (chan string, func()) {
+	reason := make(chan string, 1)
+	stop := s.Watch(idle, max, func(r string) { reason <- r })
+	return reason, stop
+}
+
+func TestWatchIdle(t *testing.T) {
+	s := NewStats()
+	reason, stop := watchReason(s, 100*time.Millisecond, 0)
+	defer stop()
+
+	// 持续有流量时不会空闲超时
+	for i := 0; i < 5; i++ {
+		time.Sleep(50 * time.Millisecond)
+		s.Add(1, 0)
+	}
+	select {
+	case r := <-reason:
+		t.Fatalf("active session terminated by %s", r)
+	default:
+	}
+
+	start := time.Now()
+	select {
+	case r := <-reason:
+		if r != REASON_IDLE_TIMEOUT {
+			t.Fatalf("reason %s, want %s", r, REASON_IDLE_TIMEOUT)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("idle timeout fired after %s", elapsed)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("idle timeout not fired")
+	}
+}
+
+func TestWatchMaxDuration(t *testing.T) {
+	s := NewStats()
+	reason, stop := watchReason(s, time.Hour, 200*time.Millisecond)
+	defer stop()
+
+	// 存活时间不受流量影响
+	deadline := time.After(2 * time.Second)
+	for {
+		s.Add(0, 1)
+		select {
+		case r := <-reason:
+			if r != REASON_MAX_DURATION {
+				t.Fatalf("reason %s, want %s", r, REASON_MAX_DURATION)
+			}
+			if age := s.Age(); age < 200*time.Millisecond {
+				t.Fatalf("max duration fired at %s", age)
+			}
+			return
+		case <-deadline:
+			t.Fatal("max duration not fired")
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+}
+
+func TestWatchStop(t *testing.T) {
+	s := NewStats()
+	reason, stop := watchReason(s, 50*time.Millisecond, 50*time.Millisecond)
+	stop()
+	select {
+	case r := <-reason:
+		t.Fatalf("stopped watch terminated by %s", r)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// 不限制时不启动看护
+	reason, stop = watchReason(s, 0, 0)
+	defer stop()
+	select {
+	case r := <-reason:
+		t.Fatalf("unlimited watch terminated by %s", r)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,156 @@
+// Package schema 定义引擎yaml配置和桌面link.json共用的版本号、
+// 桌面版链路的格式，以及旧版本文件到当前版本的迁移。
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/lixiangyun/tcpproxy/acl"
+	"github.com/lixiangyun/tcpproxy/ban"
+	"github.com/lixiangyun/tcpproxy/impair"
+	"github.com/lixiangyun/tcpproxy/limit"
+	"github.com/lixiangyun/tcpproxy/sockopt"
+	"gopkg.in/yaml.v2"
+)
+
+// 当前配置版本，没有version字段的文件视为版本1
+const VERSION = 2
+
+// 版本号无效或者高于当前支持的版本
+type VersionError struct {
+	Version interface{}
+}
+
+func (e *VersionError) Error() string {
+	if version, ok := e.Version.(int); ok && version > 0 {
+		return fmt.Sprintf("config version %d is newer than supported version %d", version, VERSION)
+	}
+	return fmt.Sprintf("invalid config version %v", e.Version)
+}
+
+// 桌面版链路的后端
+type Backend struct {
+	Address string
+	Timeout int
+	Weight  int
+	Standby bool
+}
+
+// 桌面版link.json中的链路，引擎的export和import子命令按同样的字段转换
+type Link struct {
+	Iface     string
+	Port      int
+	Timeout   int
+	MaxLife   int
+	Resolve   int `json:",omitempty"`
+	Mode      string
+	Backend   []Backend
+	SockOpt   *sockopt.Options       `json:",omitempty"`
+	Limit     *limit.Config          `json:",omitempty"`
+	Bandwidth *limit.BandwidthConfig `json:",omitempty"`
+	Impair    *impair.Config         `json:",omitempty"`
+	Acl       *acl.Config            `json:",omitempty"`
+	Ban       *ban.Config            `json:",omitempty"`
+	Route     string                 `json:",omitempty"`
+}
+
+// link.json文件格式，版本1为链路数组，版本2起带版本号
+type LinkFile struct {
+	Version int
+	Links   []Link
+}
+
+// 单个版本的链路迁移
+type linkStep func(links []Link)
+
+// linkSteps[i]把版本i+1迁移到版本i+2
+var linkSteps = []linkStep{
+	// 版本1的Timeout是界面上的Bind Timeout，默认60且没有作用，
+	// 版本2起为会话空闲超时，原样保留会让迁移后的会话60秒无数据即被关闭
+	func(links []Link) {
+		for i := range links {
+			links[i].Timeout = 0
+		}
+	},
+}
+
+// 读取link.json并迁移到当前版本，返回链路和文件原来的版本
+func DecodeLinks(body []byte) ([]Link, int, error) {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return nil, VERSION, nil
+	}
+	var file LinkFile
+	if body[0] == '[' {
+		file.Version = 1
+		err := json.Unmarshal(body, &file.Links)
+		if err != nil {
+			return nil, 0, err
+		}
+	} else {
+		err := json.Unmarshal(body, &file)
+		if err != nil {
+			return nil, 0, err
+		}
+		if file.Version <= 0 || file.Version > VERSION {
+			return nil, file.Version, &VersionError{Version: file.Version}
+		}
+	}
+	for v := file.Version; v < VERSION; v++ {
+		linkSteps[v-1](file.Links)
+	}
+	return file.Links, file.Version, nil
+}
+
+// 按当前版本生成link.json
+func EncodeLinks(links []Link) ([]byte, error) {
+	if links == nil {
+		links = []Link{}
+	}
+	return jsonEncode(&LinkFile{Version: VERSION, Links: links}, "  ")
+}
+
+// 路由表达式中的&&、<等字符保持原样，方便手工编辑
+func jsonEncode(value interface{}, indent string) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", indent)
+	err := encoder.Encode(value)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(buf.Bytes(), "\n"), nil
+}
+
+func yamlVersion(doc yaml.MapSlice) (int, error) {
+	for _, v := range doc {
+		if key, ok := v.Key.(string); ok && key == "version" {
+			version, ok := v.Value.(int)
+			if !ok || version <= 0 {
+				return 0, &VersionError{Version: v.Value}
+			}
+			return version, nil
+		}
+	}
+	return 1, nil
+}
+
+// 检查引擎yaml配置的版本，返回文件原来的版本。版本2的改动只在link.json，
+// 引擎字段没有变化，旧版本原样返回内容，保证错误提示的行号和原文件一致
+func MigrateYAML(body []byte) ([]byte, int, error) {
+	var doc yaml.MapSlice
+	err := yaml.Unmarshal(body, &doc)
+	if err != nil {
+		return nil, 0, err
+	}
+	version, err := yamlVersion(doc)
+	if err != nil {
+		return nil, 0, err
+	}
+	if version > VERSION {
+		return nil, version, &VersionError{Version: version}
+	}
+	return body, version, nil
+}
@@ -0,0 +1,93 @@
+package schema
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeLinks(t *testing.T) {
+	// 版本1为链路数组，Timeout是没有作用的Bind Timeout
+	links, version, err := DecodeLinks([]byte(`[{"Iface":"0.0.0.0","Port":8080,"Timeout":60,"Mode":"RoundRobin",
+		"Backend":[{"Address":"127.0.0.1:80","Timeout":10,"Weight":50,"Standby":false}]}]`))
+	if err != nil || version != 1 {
+		t.Fatalf("version %d, %v", version, err)
+	}
+	if len(links) != 1 || links[0].Port != 8080 || links[0].Timeout != 0 || links[0].Backend[0].Timeout != 10 {
+		t.Fatalf("migrated links %+v", links)
+	}
+
+	links, version, err = DecodeLinks([]byte(`{"Version":2,"Links":[{"Port":8080,"Timeout":60}]}`))
+	if err != nil || version != 2 || links[0].Timeout != 60 {
+		t.Fatalf("version %d links %+v, %v", version, links, err)
+	}
+
+	links, version, err = DecodeLinks([]byte(" \n"))
+	if err != nil || version != VERSION || len(links) != 0 {
+		t.Fatalf("empty file version %d links %+v, %v", version, links, err)
+	}
+
+	for _, body := range []string{`{"Version":3,"Links":[]}`, `{"Links":[]}`} {
+		if _, _, err := DecodeLinks([]byte(body)); err == nil {
+			t.Errorf("%s decoded", body)
+		} else if _, ok := err.(*VersionError); !ok {
+			t.Errorf("%s error %v, want version error", body, err)
+		}
+	}
+	if _, _, err := DecodeLinks([]byte(`[{"Port":"x"}]`)); err == nil {
+		t.Error("invalid link decoded")
+	}
+}
+
+func TestEncodeLinks(t *testing.T) {
+	links := []Link{{
+		Iface:   "0.0.0.0",
+		Port:    8080,
+		Timeout: 300,
+		Mode:    "LeastConn",
+		Backend: []Backend{{Address: "127.0.0.1:80", Timeout: 60, Weight: 50}},
+		Route:   "hour < 6 && port > 0",
+	}}
+	body, err := EncodeLinks(links)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(body, []byte("hour < 6 && port > 0")) {
+		t.Fatalf("route escaped\n%s", body)
+	}
+	output, version, err := DecodeLinks(body)
+	if err != nil || version != VERSION || !reflect.DeepEqual(output, links) {
+		t.Fatalf("round trip version %d %+v, %v", version, output, err)
+	}
+
+	body, err = EncodeLinks(nil)
+	if err != nil || !bytes.Contains(body, []byte(`"Links": []`)) {
+		t.Fatalf("empty links\n%s", body)
+	}
+}
+
+func TestMigrateYAML(t *testing.T) {
+	cases := []struct {
+		body    string
+		version int
+		invalid bool
+	}{
+		{"listeners: []\n", 1, false},
+		{"version: 2\nlisteners: []\n", 2, false},
+		{"version: 3\n", 3, true},
+		{"version: 0\n", 0, true},
+		{"version: two\n", 0, true},
+		{"version: [\n", 0, true},
+	}
+	for _, c := range cases {
+		body, version, err := MigrateYAML([]byte(c.body))
+		if (err != nil) != c.invalid || version != c.version {
+			t.Errorf("%q version %d, %v", c.body, version, err)
+			continue
+		}
+		// 引擎字段没有变化，内容原样返回以保持行号
+		if err == nil && string(body) != c.body {
+			t.Errorf("%q changed to %q", c.body, body)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+// Package sockopt 提供监听端口和后端连接的socket选项设置，
+// 通过 net.ListenConfig.Control 和 net.Dialer.Control 在建立连接前生效，
+// nodelay等会被标准库覆盖的选项在连接建立后再次设置。
+package sockopt
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+type Options struct {
+	KeepAlive         time.Duration `yaml:"keepalive"`
+	KeepAliveInterval time.Duration `yaml:"keepaliveinterval"`
+	KeepAliveCount    int           `yaml:"keepalivecount"`
+	NoDelay           *bool         `yaml:"nodelay"`
+	RecvBuf           int           `yaml:"rcvbuf"`
+	SendBuf           int           `yaml:"sndbuf"`
+	UserTimeout       time.Duration `yaml:"usertimeout"`
+	ReusePort         bool          `yaml:"reuseport"`
+	TOS               int           `yaml:"tos"`
+	DSCP              int           `yaml:"dscp"`
+}
+
+// 计算IP_TOS字段，DSCP占高6位
+func (o *Options) tos() int {
+	if o.DSCP > 0 {
+		return o.DSCP << 2
+	}
+	return o.TOS
+}
+
+// 已自行设置keepalive时关闭标准库的默认keepalive，避免覆盖
+func (o *Options) keepAlive() time.Duration {
+	if o != nil && o.KeepAlive != 0 {
+		return -1
+	}
+	return 0
+}
+
+// 作为 net.ListenConfig.Control 或 net.Dialer.Control 使用
+func (o *Options) Control(network, address string, c syscall.RawConn) error {
+	if o == nil {
+		return nil
+	}
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		err = setOptions(fd, network, o, true)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// 设置已建立连接的选项，用于accept得到的连接
+func Apply(conn net.Conn, o *Options) error {
+	if o == nil {
+		return nil
+	}
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	network := "tcp4"
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok && addr.IP.To4() == nil {
+		network = "tcp6"
+	}
+	cerr := raw.Control(func(fd uintptr) {
+		err = setOptions(fd, network, o, false)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+type listener struct {
+	net.Listener
+	opt *Options
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	err = Apply(conn, l.opt)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("apply socket option to %s failed, %s", conn.RemoteAddr(), err.Error())
+	}
+	return conn, nil
+}
+
+// 按选项创建监听，accept得到的连接同样设置连接级选项
+func Listen(network, address string, o *Options) (net.Listener, error) {
+	lc := net.ListenConfig{Control: o.Control, KeepAlive: o.keepAlive()}
+	list, err := lc.Listen(context.Background(), network, address)
+	if err != nil {
+		return nil, err
+	}
+	if o == nil {
+		return list, nil
+	}
+	return &listener{Listener: list, opt: o}, nil
+}
+
+// 按选项连接后端，标准库在连接建立后会强制开启TCP_NODELAY，所以nodelay在连接建立后设置
+type Dialer struct {
+	dialer *net.Dialer
+	opt    *Options
+}
+
+func NewDialer(timeout time.Duration, o *Options) *Dialer {
+	return &Dialer{
+		dialer: &net.Dialer{Timeout: timeout, Control: o.Control, KeepAlive: o.keepAlive()},
+		opt:    o,
+	}
+}
+
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	conn, err := d.dialer.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if d.opt == nil || d.opt.NoDelay == nil {
+		return conn, nil
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		if err = tcp.SetNoDelay(*d.opt.NoDelay); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
@@ -0,0 +1,91 @@
+package sockopt
+
+import (
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// bind为true表示在bind/connect之前调用，此时额外设置端口复用和缓冲区大小
+func setOptions(fd uintptr, network string, o *Options, bind bool) error {
+	s := int(fd)
+
+	if bind {
+		if o.ReusePort {
+			err := unix.SetsockoptInt(s, unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			if err != nil {
+				return err
+			}
+		}
+		if o.RecvBuf > 0 {
+			err := unix.SetsockoptInt(s, unix.SOL_SOCKET, unix.SO_RCVBUF, o.RecvBuf)
+			if err != nil {
+				return err
+			}
+		}
+		if o.SendBuf > 0 {
+			err := unix.SetsockoptInt(s, unix.SOL_SOCKET, unix.SO_SNDBUF, o.SendBuf)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if o.KeepAlive > 0 {
+		err := unix.SetsockoptInt(s, unix.SOL_SOCKET, unix.SO_KEEPALIVE, 1)
+		if err != nil {
+			return err
+		}
+		err = unix.SetsockoptInt(s, unix.IPPROTO_TCP, unix.TCP_KEEPIDLE, int(o.KeepAlive.Seconds()))
+		if err != nil {
+			return err
+		}
+		if o.KeepAliveInterval > 0 {
+			err = unix.SetsockoptInt(s, unix.IPPROTO_TCP, unix.TCP_KEEPINTVL, int(o.KeepAliveInterval.Seconds()))
+			if err != nil {
+				return err
+			}
+		}
+		if o.KeepAliveCount > 0 {
+			err = unix.SetsockoptInt(s, unix.IPPROTO_TCP, unix.TCP_KEEPCNT, o.KeepAliveCount)
+			if err != nil {
+				return err
+			}
+		}
+	} else if o.KeepAlive < 0 {
+		err := unix.SetsockoptInt(s, unix.SOL_SOCKET, unix.SO_KEEPALIVE, 0)
+		if err != nil {
+			return err
+		}
+	}
+
+	if o.NoDelay != nil {
+		value := 0
+		if *o.NoDelay {
+			value = 1
+		}
+		err := unix.SetsockoptInt(s, unix.IPPROTO_TCP, unix.TCP_NODELAY, value)
+		if err != nil {
+			return err
+		}
+	}
+
+	if o.UserTimeout > 0 {
+		err := unix.SetsockoptInt(s, unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, int(o.UserTimeout/1e6))
+		if err != nil {
+			return err
+		}
+	}
+
+	if tos := o.tos(); tos > 0 {
+		if strings.HasSuffix(network, "6") {
+			return unix.SetsockoptInt(s, unix.IPPROTO_IPV6, unix.IPV6_TCLASS, tos)
+		}
+		err := unix.SetsockoptInt(s, unix.IPPROTO_IP, unix.IP_TOS, tos)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,62 @@
+package sockopt
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func noDelay(t *testing.T, conn net.Conn) int {
+	raw, err := conn.(syscall.Conn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var value int
+	raw.Control(func(fd uintptr) {
+		value, err = unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_NODELAY)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func TestNoDelayDisabled(t *testing.T) {
+	off := false
+	opt := &Options{NoDelay: &off}
+
+	list, err := Listen("tcp", "127.0.0.1:0", opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer list.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := list.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- conn
+	}()
+
+	conn, err := NewDialer(0, opt).Dial("tcp", list.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if value := noDelay(t, conn); value != 0 {
+		t.Fatalf("dial nodelay %d, want 0", value)
+	}
+
+	server := <-accepted
+	if server == nil {
+		return
+	}
+	defer server.Close()
+	if value := noDelay(t, server); value != 0 {
+		t.Fatalf("accept nodelay %d, want 0", value)
+	}
+}
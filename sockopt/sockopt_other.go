@@ -0,0 +1,61 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package sockopt
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// 其它平台只支持通用选项
+func setOptions(fd uintptr, network string, o *Options, bind bool) error {
+	s := int(fd)
+
+	if o.ReusePort || o.UserTimeout > 0 || o.KeepAliveInterval > 0 || o.KeepAliveCount > 0 {
+		return fmt.Errorf("socket option not support on this platform")
+	}
+
+	if bind {
+		if o.RecvBuf > 0 {
+			err := syscall.SetsockoptInt(s, syscall.SOL_SOCKET, syscall.SO_RCVBUF, o.RecvBuf)
+			if err != nil {
+				return err
+			}
+		}
+		if o.SendBuf > 0 {
+			err := syscall.SetsockoptInt(s, syscall.SOL_SOCKET, syscall.SO_SNDBUF, o.SendBuf)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if o.KeepAlive != 0 {
+		value := 0
+		if o.KeepAlive > 0 {
+			value = 1
+		}
+		err := syscall.SetsockoptInt(s, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, value)
+		if err != nil {
+			return err
+		}
+	}
+
+	if o.NoDelay != nil {
+		value := 0
+		if *o.NoDelay {
+			value = 1
+		}
+		err := syscall.SetsockoptInt(s, syscall.IPPROTO_TCP, syscall.TCP_NODELAY, value)
+		if err != nil {
+			return err
+		}
+	}
+
+	if tos := o.tos(); tos > 0 {
+		return syscall.SetsockoptInt(s, syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+	}
+
+	return nil
+}
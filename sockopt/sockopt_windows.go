@@ -0,0 +1,94 @@
+package sockopt
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	sioKeepAliveVals = syscall.IOC_IN | syscall.IOC_VENDOR | 4
+	tcpMaxRt         = 5
+	tcpKeepCnt       = 16
+)
+
+// windows不支持端口复用和TOS设置，tcp用户超时使用TCP_MAXRT近似
+func setOptions(fd uintptr, network string, o *Options, bind bool) error {
+	s := syscall.Handle(fd)
+
+	if o.ReusePort {
+		return fmt.Errorf("reuseport not support on windows")
+	}
+	if o.tos() > 0 {
+		return fmt.Errorf("tos not support on windows")
+	}
+
+	if bind {
+		if o.RecvBuf > 0 {
+			err := syscall.SetsockoptInt(s, syscall.SOL_SOCKET, syscall.SO_RCVBUF, o.RecvBuf)
+			if err != nil {
+				return err
+			}
+		}
+		if o.SendBuf > 0 {
+			err := syscall.SetsockoptInt(s, syscall.SOL_SOCKET, syscall.SO_SNDBUF, o.SendBuf)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if o.KeepAlive > 0 {
+		interval := o.KeepAliveInterval
+		if interval <= 0 {
+			interval = o.KeepAlive
+		}
+		ka := syscall.TCPKeepalive{
+			OnOff:    1,
+			Time:     uint32(o.KeepAlive.Milliseconds()),
+			Interval: uint32(interval.Milliseconds()),
+		}
+		ret := uint32(0)
+		size := uint32(unsafe.Sizeof(ka))
+		err := syscall.WSAIoctl(s, sioKeepAliveVals, (*byte)(unsafe.Pointer(&ka)), size, nil, 0, &ret, nil, 0)
+		if err != nil {
+			return err
+		}
+		if o.KeepAliveCount > 0 {
+			// TCP_KEEPCNT仅windows 10 1703以上版本支持
+			err = syscall.SetsockoptInt(s, syscall.IPPROTO_TCP, tcpKeepCnt, o.KeepAliveCount)
+			if err != nil {
+				return err
+			}
+		}
+	} else if o.KeepAlive < 0 {
+		err := syscall.SetsockoptInt(s, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 0)
+		if err != nil {
+			return err
+		}
+	}
+
+	if o.NoDelay != nil {
+		value := 0
+		if *o.NoDelay {
+			value = 1
+		}
+		err := syscall.SetsockoptInt(s, syscall.IPPROTO_TCP, syscall.TCP_NODELAY, value)
+		if err != nil {
+			return err
+		}
+	}
+
+	if o.UserTimeout > 0 {
+		seconds := int(o.UserTimeout.Seconds())
+		if seconds == 0 {
+			seconds = 1
+		}
+		err := syscall.SetsockoptInt(s, syscall.IPPROTO_TCP, tcpMaxRt, seconds)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}